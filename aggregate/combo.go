@@ -31,6 +31,7 @@ var _ sql.Aggregation = (*Filter)(nil)
 func (a *Filter) Resolved() (ok bool) { return a.Aggr.Resolved()&&a.Expr.Resolved() }
 func (a *Filter) String() string { return fmt.Sprintf("filter(%v,%v)",a.Aggr,a.Expr) }
 func (a *Filter) Type() sql.Type { return a.Aggr.Type() }
+func (a *Filter) Shape() sql.Type { return ShapeOf(a.Aggr) }
 func (a *Filter) IsNullable() bool { return true }
 func (a *Filter) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
 	b,err := a.Aggr.TransformUp(st)
@@ -88,6 +89,7 @@ var _ sql.Aggregation = (*GroupBy)(nil)
 func (a *GroupBy) Resolved() (ok bool) { return a.Aggr.Resolved()&&a.Expr.Resolved() }
 func (a *GroupBy) String() string { return fmt.Sprintf("group_by(%v,%v,%v)",a.Aggr,a.Expr,a.Maximum) }
 func (a *GroupBy) Type() sql.Type { return sql.Array(a.Aggr.Type()) }
+func (a *GroupBy) Shape() sql.Type { return ListOf(ShapeOf(a.Aggr)) }
 func (a *GroupBy) IsNullable() bool { return true }
 func (a *GroupBy) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
 	e,err := a.Expr.TransformUp(st)
@@ -109,7 +111,7 @@ func (a *GroupBy) Update(ctx *sql.Context, buffer, row sql.Row) error {
 	i := buffer[1].(*uint64)
 	v,ok := m.Get(key)
 	if !ok {
-		if *i >= a.Maximum { return nil }
+		if *i >= a.Maximum { return ErrTooManyGroups }
 		*i++
 		v = a.Aggr.NewBuffer()
 		m.Put(key,v)
@@ -124,9 +126,10 @@ func (a *GroupBy) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
 	for oth.Next() {
 		v,ok := m.Get(oth.Key())
 		if !ok {
-			if *i >= a.Maximum { break }
+			if *i >= a.Maximum { return ErrTooManyGroups }
 			*i++
 			m.Put(oth.Key(),oth.Value())
+			continue
 		}
 		err := a.Aggr.Merge(ctx,v.(sql.Row),oth.Value().(sql.Row))
 		if err!=nil { return err }
@@ -31,6 +31,20 @@ func (a Dict) Resolved() (ok bool) {
 func (a Dict) String() string { return "dict"+expression.Tuple(a).String() }
 //Implements sql.Expression
 func (a Dict) Type() sql.Type { return sql.JSON }
+/*
+Implements Shaped
+
+If all names are literals, the shape is a *DictType describing the fields.
+*/
+func (a Dict) Shape() sql.Type {
+	fields := make([]DictField,0,len(a)/2)
+	for i := 0; i+1<len(a); i+=2 {
+		lit,ok := a[i].(*expression.Literal)
+		if !ok { return sql.JSON }
+		fields = append(fields,DictField{cast.ToString(lit.Value()),ShapeOf(a[i+1])})
+	}
+	return NewDictType(fields...)
+}
 //Implements sql.Expression
 func (a Dict) IsNullable() bool { return false }
 //Implements sql.Expression
@@ -74,6 +88,16 @@ func (a Array) Resolved() (ok bool) {
 func (a Array) String() string { return "array"+expression.Tuple(a).String() }
 //Implements sql.Expression
 func (a Array) Type() sql.Type { return sql.JSON }
+/*
+Implements Shaped
+
+The shape is an *ArrayType. If the elements differ in shape, the element shape is sql.JSON.
+*/
+func (a Array) Shape() sql.Type {
+	shapes := make([]sql.Type,len(a))
+	for i,e := range a { shapes[i] = ShapeOf(e) }
+	return &ArrayType{shaped{sql.JSON},commonType(shapes...)}
+}
 //Implements sql.Expression
 func (a Array) IsNullable() bool { return false }
 //Implements sql.Expression
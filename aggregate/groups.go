@@ -0,0 +1,146 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package aggregate
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "fmt"
+
+func unalias(e sql.Expression) sql.Expression {
+	if a,ok := e.(*expression.Alias); ok { return a.Child }
+	return e
+}
+
+func aggregateSchema(aggregate []sql.Expression) sql.Schema {
+	s := make(sql.Schema,len(aggregate))
+	for i,e := range aggregate {
+		var name string
+		if n,ok := e.(sql.Nameable); ok {
+			name = n.Name()
+		} else {
+			name = e.String()
+		}
+		s[i] = &sql.Column{Name:name,Type:e.Type(),Nullable:e.IsNullable()}
+	}
+	return s
+}
+
+func transformAll(exprs []sql.Expression,f sql.TransformExprFunc) (r []sql.Expression, e error) {
+	r = make([]sql.Expression,len(exprs))
+	for i,x := range exprs {
+		r[i],e = x.TransformUp(f)
+		if e!=nil { return }
+	}
+	return
+}
+
+/*
+The groups of a GROUP BY, that are held in memory.
+Per group, there is a sql.Row buffer for every aggregation, or
+the value of the first row for every other expression.
+*/
+type groupSet struct{
+	aggregate []sql.Expression
+	grouping  []sql.Expression
+	index     map[string]int
+	groups    [][]interface{}
+}
+func newGroupSet(aggregate,grouping []sql.Expression) *groupSet {
+	return &groupSet{aggregate,grouping,make(map[string]int),nil}
+}
+func (gs *groupSet) key(ctx *sql.Context,row sql.Row) (string,error) {
+	gk := make([]interface{},len(gs.grouping))
+	for i,x := range gs.grouping {
+		v,err := x.Eval(ctx,row)
+		if err!=nil { return "",err }
+		gk[i] = v
+	}
+	
+	/* %#v keeps the values apart, which fmt.Sprint would concatenate (such as "a b" and "a","b"). */
+	return fmt.Sprintf("%#v",gk),nil
+}
+func (gs *groupSet) len() int { return len(gs.groups) }
+func (gs *groupSet) lookup(key string) (int,bool) {
+	i,ok := gs.index[key]
+	return i,ok
+}
+func (gs *groupSet) add(ctx *sql.Context,key string,row sql.Row) (i int,err error) {
+	g := make([]interface{},len(gs.aggregate))
+	for j,e := range gs.aggregate {
+		if a,ok := unalias(e).(sql.Aggregation); ok {
+			g[j] = a.NewBuffer()
+		} else {
+			g[j],err = e.Eval(ctx,row)
+			if err!=nil { return }
+		}
+	}
+	i = len(gs.groups)
+	gs.index[key] = i
+	gs.groups = append(gs.groups,g)
+	return
+}
+func (gs *groupSet) update(ctx *sql.Context,i int,row sql.Row) error {
+	for j,e := range gs.aggregate {
+		if a,ok := unalias(e).(sql.Aggregation); ok {
+			err := a.Update(ctx,gs.groups[i][j].(sql.Row),row)
+			if err!=nil { return err }
+		}
+	}
+	return nil
+}
+
+/* Merges the partial state of a group into the set. */
+func (gs *groupSet) merge(ctx *sql.Context,key string,state []interface{}) error {
+	i,ok := gs.index[key]
+	if !ok {
+		gs.index[key] = len(gs.groups)
+		gs.groups = append(gs.groups,state)
+		return nil
+	}
+	for j,e := range gs.aggregate {
+		if a,ok := unalias(e).(sql.Aggregation); ok {
+			err := a.Merge(ctx,gs.groups[i][j].(sql.Row),state[j].(sql.Row))
+			if err!=nil { return err }
+		}
+	}
+	return nil
+}
+func (gs *groupSet) reset() {
+	gs.groups = nil
+	gs.index = make(map[string]int)
+}
+
+/* Evaluates all groups, appends them to out and empties the set. */
+func (gs *groupSet) flush(ctx *sql.Context,out []sql.Row) ([]sql.Row,error) {
+	for _,g := range gs.groups {
+		row := make(sql.Row,len(g))
+		for i,e := range gs.aggregate {
+			if a,ok := unalias(e).(sql.Aggregation); ok {
+				v,err := a.Eval(ctx,g[i].(sql.Row))
+				if err!=nil { return nil,err }
+				row[i] = v
+			} else {
+				row[i] = g[i]
+			}
+		}
+		out = append(out,row)
+	}
+	gs.groups = gs.groups[:0]
+	gs.index = make(map[string]int)
+	return out,nil
+}
@@ -28,10 +28,30 @@ var Defaults = sql.Functions{
 	"first"  :sql.Function1(NewFirst),
 	"last"   :sql.Function1(NewLast),
 	
+	// Statistical and approximate aggregations
+	"count_distinct"       :sql.Function1(NewCountDistinct),
+	"approx_count_distinct":sql.Function1(NewApproxCountDistinct),
+	"percentile"           :sql.FunctionN(NewPercentile),
+	"median"               :sql.Function1(NewMedian),
+	"variance"             :sql.Function1(NewVariance),
+	"var_pop"              :sql.Function1(NewVarPop),
+	"stddev"               :sql.Function1(NewStddev),
+	"stddev_pop"           :sql.Function1(NewStddevPop),
+	"min_by"               :sql.Function2(NewMinBy),
+	"max_by"               :sql.Function2(NewMaxBy),
+	"bit_and"              :sql.Function1(NewBitAnd),
+	"bit_or"               :sql.Function1(NewBitOr),
+	"bool_and"             :sql.Function1(NewBoolAnd),
+	"bool_or"              :sql.Function1(NewBoolOr),
+	"string_agg"           :sql.FunctionN(NewStringAgg),
+	
 	// Compound aggregations
 	"filter"  :sql.FunctionN(NewFilter),
 	"group_by":sql.FunctionN(NewGroupBy),
 	
+	// Aggregation arguments (order_by is shared with WindowFunctions)
+	"order_by":sql.FunctionN(NewOrderBy),
+	
 	// Regular functions
 	"dict" :sql.FunctionN(NewDict),
 	"array":sql.FunctionN(NewArray),
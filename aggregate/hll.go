@@ -0,0 +1,94 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package aggregate
+
+import farm "github.com/dgryski/go-farm"
+import "math"
+import "math/bits"
+
+/* HyperLogLog with 2^hllP registers. */
+const hllP = 14
+const hllM = 1<<hllP
+
+/* Number of registers, that are held in the sparse representation at most. */
+const hllSparse = hllM/32
+
+/*
+The state of approx_count_distinct(). The registers are held in a map, until more
+than hllSparse of them are set, and in an array of 2^hllP bytes afterwards. This
+keeps small groups small. The fields are exported for encoding/gob.
+*/
+type HyperLogLog struct{
+	Sparse map[uint16]uint8
+	Dense  []uint8
+}
+
+func newHyperLogLog() *HyperLogLog { return &HyperLogLog{Sparse:make(map[uint16]uint8)} }
+func (h *HyperLogLog) set(i uint16,rho uint8) {
+	if h.Dense!=nil {
+		if rho > h.Dense[i] { h.Dense[i] = rho }
+		return
+	}
+	if h.Sparse==nil { h.Sparse = make(map[uint16]uint8) }
+	if rho > h.Sparse[i] { h.Sparse[i] = rho }
+	if len(h.Sparse) > hllSparse {
+		h.Dense = make([]uint8,hllM)
+		for j,r := range h.Sparse { h.Dense[j] = r }
+		h.Sparse = nil
+	}
+}
+func (h *HyperLogLog) add(data []byte) {
+	x := farm.Hash64(data)
+	i := x>>(64-hllP)
+	w := x<<hllP
+	rho := uint8(bits.LeadingZeros64(w))+1
+	if rho > 64-hllP+1 { rho = 64-hllP+1 }
+	h.set(uint16(i),rho)
+}
+func (h *HyperLogLog) merge(o *HyperLogLog) {
+	if o.Dense==nil {
+		for i,r := range o.Sparse { h.set(i,r) }
+		return
+	}
+	for i,r := range o.Dense {
+		if r!=0 { h.set(uint16(i),r) }
+	}
+}
+func (h *HyperLogLog) estimate() uint64 {
+	const alpha = 0.7213/(1+1.079/hllM)
+	sum := 0.0
+	zeros := hllM
+	if h.Dense==nil {
+		for _,r := range h.Sparse { sum += math.Ldexp(1,-int(r)) }
+		zeros -= len(h.Sparse)
+		sum += float64(zeros)
+	} else {
+		zeros = 0
+		for _,r := range h.Dense {
+			sum += math.Ldexp(1,-int(r))
+			if r==0 { zeros++ }
+		}
+	}
+	e := alpha*hllM*hllM/sum
+	
+	/* Small range correction: linear counting. */
+	if e <= 2.5*hllM && zeros!=0 {
+		e = hllM*math.Log(float64(hllM)/float64(zeros))
+	}
+	return uint64(e+0.5)
+}
@@ -0,0 +1,223 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package aggregate
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/plan"
+import "gopkg.in/src-d/go-vitess.v1/sqltypes"
+import "gopkg.in/src-d/go-vitess.v1/vt/proto/query"
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "reflect"
+import "sort"
+import "strings"
+
+/*
+Optional interface for expressions, whose values have a known structure, such as
+the ones of dict(...) and array(...). Shape returns a *DictType or an *ArrayType,
+or the sql.Type, if the structure isn't known. Type() still returns sql.JSON or
+sql.Array(...), so that the rest of the engine treats the values as usual.
+*/
+type Shaped interface{
+	sql.Expression
+	Shape() sql.Type
+}
+
+/*
+Returns the shape of the expression (see Shaped), or its sql.Type.
+*/
+func ShapeOf(e sql.Expression) sql.Type {
+	if a,ok := e.(*expression.Alias); ok { e = a.Child }
+	if s,ok := e.(Shaped); ok { return s.Shape() }
+	return e.Type()
+}
+
+/* Returns the sql.Type, the shape describes. */
+func baseType(t sql.Type) sql.Type {
+	switch v := t.(type) {
+	case *DictType: return v.Base
+	case *ArrayType: return v.Base
+	}
+	return t
+}
+
+/*
+Returns the shapes of the columns of a node. The shapes of the columns, that
+are passed through by a node (such as Limit or Sort), are taken from its child.
+Columns of an unknown shape are described by their sql.Type.
+*/
+func SchemaShapes(node sql.Node) []sql.Type {
+	schema := node.Schema()
+	shapes := make([]sql.Type,len(schema))
+	for i,c := range schema { shapes[i] = c.Type }
+	var exprs []sql.Expression
+	switch v := node.(type) {
+	case *plan.Project: exprs = v.Projections
+	case *plan.GroupBy: exprs = v.Aggregate
+	case *ClusterGroupBy: exprs = v.Aggregate
+	case *SpillGroupBy: exprs = v.Aggregate
+	default:
+		children := node.Children()
+		if len(children)!=1 { return shapes }
+		inner := SchemaShapes(children[0])
+		for i,t := range shapes {
+			if i<len(inner) && baseType(inner[i]).String()==t.String() { shapes[i] = inner[i] }
+		}
+		return shapes
+	}
+	for i,e := range exprs {
+		if i<len(shapes) { shapes[i] = ShapeOf(e) }
+	}
+	return shapes
+}
+
+/*
+Forwards the sql.Type methods to Base. sql.Type can't be embedded directly,
+as the field would be named Type, like the method.
+*/
+type shaped struct{
+	Base sql.Type
+}
+func (s shaped) Type() query.Type { return s.Base.Type() }
+func (s shaped) Convert(v interface{}) (interface{}, error) { return s.Base.Convert(v) }
+func (s shaped) Compare(a,b interface{}) (int, error) { return s.Base.Compare(a,b) }
+func (s shaped) SQL(v interface{}) sqltypes.Value { return s.Base.SQL(v) }
+
+type DictField struct{
+	Name string
+	Type sql.Type
+}
+
+/*
+The shape of a JSON-Style Object with known fields, as created by dict(...).
+It behaves like sql.JSON, but describes the names and shapes of its fields.
+*/
+type DictType struct{
+	shaped
+	Fields []DictField
+}
+func NewDictType(fields ...DictField) *DictType { return &DictType{shaped{sql.JSON},fields} }
+func (d *DictType) String() string {
+	s := make([]string,len(d.Fields))
+	for i,f := range d.Fields { s[i] = fmt.Sprintf("%q %v",f.Name,f.Type) }
+	return "DICT("+strings.Join(s,", ")+")"
+}
+
+/* Returns the shape of the named field. */
+func (d *DictType) Field(name string) (sql.Type,bool) {
+	for _,f := range d.Fields {
+		if f.Name==name { return f.Type,true }
+	}
+	return nil,false
+}
+
+/*
+The shape of an array, whose elements are of shape Elem.
+It behaves like its Base, which is sql.Array(...) or sql.JSON.
+*/
+type ArrayType struct{
+	shaped
+	Elem sql.Type
+}
+
+/* Returns the shape of a sql.Array of the given element shape. */
+func ListOf(elem sql.Type) *ArrayType { return &ArrayType{shaped{sql.Array(baseType(elem))},elem} }
+func (a *ArrayType) String() string { return fmt.Sprintf("ARRAY(%v)",a.Elem) }
+
+/*
+Computes the common shape of the given shapes. If they differ, sql.JSON is returned.
+*/
+func commonType(types ...sql.Type) sql.Type {
+	if len(types)==0 { return sql.JSON }
+	for _,t := range types[1:] {
+		if t.String()!=types[0].String() { return sql.JSON }
+	}
+	return types[0]
+}
+
+/*
+Serializes a value as JSON. The fields of objects of a DictType shape are written in
+the order of their declaration, any other object keys are written in sorted order.
+*/
+func MarshalJSON(t sql.Type,v interface{}) ([]byte, error) {
+	b := new(bytes.Buffer)
+	err := WriteJSON(b,t,v)
+	if err!=nil { return nil,err }
+	return b.Bytes(),nil
+}
+
+func WriteJSON(b *bytes.Buffer,t sql.Type,v interface{}) error {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		var fields []DictField
+		if d,ok := t.(*DictType); ok { fields = d.Fields }
+		done := make(map[string]bool,len(fields))
+		sep := "{"
+		for _,f := range fields {
+			fv,ok := m[f.Name]
+			if !ok || done[f.Name] { continue }
+			done[f.Name] = true
+			err := writeJSONField(b,sep,f.Name,f.Type,fv)
+			if err!=nil { return err }
+			sep = ","
+		}
+		keys := make([]string,0,len(m))
+		for k := range m {
+			if !done[k] { keys = append(keys,k) }
+		}
+		sort.Strings(keys)
+		for _,k := range keys {
+			err := writeJSONField(b,sep,k,sql.JSON,m[k])
+			if err!=nil { return err }
+			sep = ","
+		}
+		if sep=="{" { b.WriteString("{") }
+		b.WriteString("}")
+		return nil
+	case []byte:
+	case nil:
+		b.WriteString("null")
+		return nil
+	default:
+		rv := reflect.ValueOf(v)
+		if rv.Kind()!=reflect.Slice && rv.Kind()!=reflect.Array { break }
+		var elem sql.Type = sql.JSON
+		if a,ok := t.(*ArrayType); ok { elem = a.Elem }
+		b.WriteString("[")
+		for i := 0; i<rv.Len(); i++ {
+			if i>0 { b.WriteString(",") }
+			err := WriteJSON(b,elem,rv.Index(i).Interface())
+			if err!=nil { return err }
+		}
+		b.WriteString("]")
+		return nil
+	}
+	data,err := json.Marshal(v)
+	if err!=nil { return err }
+	b.Write(data)
+	return nil
+}
+func writeJSONField(b *bytes.Buffer,sep,name string,t sql.Type,v interface{}) error {
+	b.WriteString(sep)
+	key,_ := json.Marshal(name)
+	b.Write(key)
+	b.WriteString(":")
+	return WriteJSON(b,t,v)
+}
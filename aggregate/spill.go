@@ -0,0 +1,313 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package aggregate
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import farm "github.com/dgryski/go-farm"
+import "encoding/gob"
+import "errors"
+import "io"
+import "io/ioutil"
+import "os"
+import "bufio"
+import "strings"
+import "time"
+
+func init() {
+	gob.Register(time.Time{})
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	gob.Register(map[string]bool{})
+	gob.Register(sql.Row{})
+	gob.Register(&HyperLogLog{})
+	gob.Register(&TDigest{})
+	gob.Register([]StringAggElem(nil))
+	gob.Register([]ListElem(nil))
+}
+
+/*
+Returned, if there are more groups than allowed.
+*/
+var ErrTooManyGroups = errors.New("too many groups")
+
+/* Maximum depth of re-partitioning. */
+const maxSpillDepth = 8
+
+/*
+A GROUP BY with bounded memory. Once MaxGroups groups are held in memory, the partial
+states of the groups are hash-partitioned into temporary files, and the memory is reused.
+At the end of the input, the states of each partition are combined using the Merge method
+of the aggregations (and partitioned again, if needed).
+
+If the states of the aggregations can't be serialized, the rows of any further groups
+are partitioned instead, and each partition is aggregated after the in-memory groups
+have been emitted.
+*/
+type SpillGroupBy struct{
+	Child      sql.Node
+	Aggregate  []sql.Expression
+	Grouping   []sql.Expression
+	MaxGroups  int
+	Partitions int
+}
+var _ sql.Node = (*SpillGroupBy)(nil)
+
+func NewSpillGroupBy(aggregate,grouping []sql.Expression,child sql.Node,maxGroups int) *SpillGroupBy {
+	if maxGroups<=0 { maxGroups = 1<<16 }
+	return &SpillGroupBy{child,aggregate,grouping,maxGroups,16}
+}
+
+func (s *SpillGroupBy) Resolved() bool { return s.Child.Resolved() }
+func (s *SpillGroupBy) String() string {
+	pr := sql.NewTreePrinter()
+	_ = pr.WriteNode("SpillGroupBy(%d)",s.MaxGroups)
+	aggr := make([]string,len(s.Aggregate))
+	for i,e := range s.Aggregate { aggr[i] = e.String() }
+	grp := make([]string,len(s.Grouping))
+	for i,e := range s.Grouping { grp[i] = e.String() }
+	_ = pr.WriteChildren(
+		"Aggregate("+strings.Join(aggr,", ")+")",
+		"Grouping("+strings.Join(grp,", ")+")",
+		s.Child.String(),
+	)
+	return pr.String()
+}
+func (s *SpillGroupBy) Schema() sql.Schema { return aggregateSchema(s.Aggregate) }
+func (s *SpillGroupBy) Children() []sql.Node { return []sql.Node{s.Child} }
+func (s *SpillGroupBy) TransformUp(f sql.TransformNodeFunc) (sql.Node, error) {
+	child,err := s.Child.TransformUp(f)
+	if err!=nil { return nil,err }
+	return f(&SpillGroupBy{child,s.Aggregate,s.Grouping,s.MaxGroups,s.Partitions})
+}
+func (s *SpillGroupBy) TransformExpressionsUp(f sql.TransformExprFunc) (sql.Node, error) {
+	child,err := s.Child.TransformExpressionsUp(f)
+	if err!=nil { return nil,err }
+	aggr,err := transformAll(s.Aggregate,f)
+	if err!=nil { return nil,err }
+	grp,err := transformAll(s.Grouping,f)
+	if err!=nil { return nil,err }
+	return &SpillGroupBy{child,aggr,grp,s.MaxGroups,s.Partitions},nil
+}
+func (s *SpillGroupBy) RowIter(ctx *sql.Context) (sql.RowIter, error) {
+	i,err := s.Child.RowIter(ctx)
+	if err!=nil { return nil,err }
+	return &spillIter{s:s,ctx:ctx,input:i,groups:newGroupSet(s.Aggregate,s.Grouping)},nil
+}
+
+/*
+A partition file and the depth of partitioning, it has been written at.
+*/
+type spillFile struct{
+	name  string
+	depth int
+}
+
+/* The partial state of a group, as written to a partition file. */
+type spillState struct{
+	Key    string
+	Values []interface{}
+}
+
+/* Reads the rows (or states) of a partition file. */
+type spillReader struct{
+	f   *os.File
+	dec *gob.Decoder
+}
+func openSpill(name string) (*spillReader,error) {
+	f,err := os.Open(name)
+	if err!=nil { return nil,err }
+	return &spillReader{f,gob.NewDecoder(bufio.NewReader(f))},nil
+}
+func (r *spillReader) Next() (row sql.Row,err error) {
+	err = r.dec.Decode(&row)
+	return
+}
+func (r *spillReader) state() (s spillState,err error) {
+	err = r.dec.Decode(&s)
+	return
+}
+func (r *spillReader) Close() error {
+	r.f.Close()
+	return os.Remove(r.f.Name())
+}
+
+type spillWriter struct{
+	f   *os.File
+	buf *bufio.Writer
+	enc *gob.Encoder
+}
+
+const (
+	spillUndecided = iota
+	spillStates
+	spillRows
+)
+
+type spillIter struct{
+	s       *SpillGroupBy
+	ctx     *sql.Context
+	input   sql.RowIter
+	depth   int
+	groups  *groupSet
+	writers []*spillWriter
+	pending []spillFile
+	out     []sql.Row
+	mode    int /* What is written to the partition files. Decided at the first overflow. */
+}
+
+func (si *spillIter) partition(key string) int {
+	/*
+	Every level uses a different seed, so that the keys of a partition are split further.
+	(A prefix byte doesn't do for FNV, whose low bits it flips alike for every key.)
+	*/
+	h := farm.Hash64WithSeed([]byte(key),uint64(si.depth))
+	return int(h%uint64(si.s.Partitions))
+}
+/* Writes the record (a row or a state) into the partition of the key. */
+func (si *spillIter) spill(key string,record interface{}) error {
+	if si.depth>=maxSpillDepth { return ErrTooManyGroups }
+	if si.writers==nil { si.writers = make([]*spillWriter,si.s.Partitions) }
+	p := si.partition(key)
+	w := si.writers[p]
+	if w==nil {
+		f,err := ioutil.TempFile("","datajoin-groupby")
+		if err!=nil { return err }
+		w = &spillWriter{f:f,buf:bufio.NewWriter(f)}
+		w.enc = gob.NewEncoder(w.buf)
+		si.writers[p] = w
+	}
+	return w.enc.Encode(record)
+}
+
+/* Moves the states of all groups held in memory into the partition files. */
+func (si *spillIter) spillStates() error {
+	for key,i := range si.groups.index {
+		err := si.spill(key,&spillState{key,si.groups.groups[i]})
+		if err!=nil { return err }
+	}
+	si.groups.reset()
+	return nil
+}
+
+/*
+Decides, whether the states of the groups in memory can be serialized. Aggregations
+with buffers, that encoding/gob doesn't know of, fall back to spilling rows.
+*/
+func (si *spillIter) decide() {
+	if si.mode!=spillUndecided { return }
+	si.mode = spillStates
+	enc := gob.NewEncoder(ioutil.Discard)
+	for key,i := range si.groups.index {
+		if enc.Encode(&spillState{key,si.groups.groups[i]})!=nil {
+			si.mode = spillRows
+			return
+		}
+	}
+}
+
+/*
+Consumes the current input, and emits the groups held in memory, unless their
+states have been partitioned.
+*/
+func (si *spillIter) consume(merging bool) error {
+	for {
+		var key string
+		var row sql.Row
+		var state spillState
+		var err error
+		if merging {
+			state,err = si.input.(*spillReader).state()
+			key = state.Key
+		} else {
+			row,err = si.input.Next()
+			if err==nil { key,err = si.groups.key(si.ctx,row) }
+		}
+		if err==io.EOF { break }
+		if err!=nil { return err }
+		i,ok := si.groups.lookup(key)
+		if !ok && si.groups.len()>=si.s.MaxGroups {
+			si.decide()
+			if si.mode==spillRows {
+				err = si.spill(key,row)
+				if err!=nil { return err }
+				continue
+			}
+			err = si.spillStates()
+			if err!=nil { return err }
+		}
+		if merging {
+			err = si.groups.merge(si.ctx,key,state.Values)
+			if err!=nil { return err }
+			continue
+		}
+		if !ok {
+			i,err = si.groups.add(si.ctx,key,row)
+			if err!=nil { return err }
+		}
+		err = si.groups.update(si.ctx,i,row)
+		if err!=nil { return err }
+	}
+	err := si.input.Close()
+	si.input = nil
+	if err!=nil { return err }
+	
+	/* Some states of the groups are on disk, so the groups in memory are incomplete. */
+	if si.writers!=nil && si.mode==spillStates {
+		err = si.spillStates()
+		if err!=nil { return err }
+	}
+	for _,w := range si.writers {
+		if w==nil { continue }
+		err = w.buf.Flush()
+		w.f.Close()
+		si.pending = append(si.pending,spillFile{w.f.Name(),si.depth+1})
+		if err!=nil { return err }
+	}
+	si.writers = nil
+	si.out,err = si.groups.flush(si.ctx,si.out)
+	return err
+}
+func (si *spillIter) Next() (sql.Row, error) {
+	for len(si.out)==0 {
+		if si.input==nil {
+			if len(si.pending)==0 { return nil,io.EOF }
+			p := si.pending[len(si.pending)-1]
+			si.pending = si.pending[:len(si.pending)-1]
+			r,err := openSpill(p.name)
+			if err!=nil { return nil,err }
+			si.input = r
+			si.depth = p.depth
+		}
+		_,merging := si.input.(*spillReader)
+		err := si.consume(merging && si.mode==spillStates)
+		if err!=nil { return nil,err }
+	}
+	row := si.out[0]
+	si.out = si.out[1:]
+	return row,nil
+}
+func (si *spillIter) Close() (err error) {
+	if si.input!=nil { err = si.input.Close() }
+	for _,w := range si.writers {
+		if w==nil { continue }
+		w.f.Close()
+		os.Remove(w.f.Name())
+	}
+	for _,p := range si.pending { os.Remove(p.name) }
+	return
+}
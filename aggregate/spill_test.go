@@ -0,0 +1,100 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package aggregate
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "reflect"
+import "sort"
+import "testing"
+
+var (
+	colK = expression.NewGetField(0,sql.Int64,"k",false)
+	colV = expression.NewGetField(1,sql.Int64,"v",false)
+)
+
+/* Every key of 0..keys-1 appears reps times. The keys are interleaved. */
+func interleaved(keys,reps int) *rowsNode {
+	n := &rowsNode{schema:sql.Schema{{Name:"k",Type:sql.Int64},{Name:"v",Type:sql.Int64}}}
+	for r := 0; r<reps; r++ {
+		for k := 0; k<keys; k++ { n.rows = append(n.rows,sql.Row{int64(k),int64(k*10+r)}) }
+	}
+	return n
+}
+
+/* Reads all rows and sorts them by the first column. */
+func drain(iter sql.RowIter) ([]sql.Row,error) {
+	var rows []sql.Row
+	for {
+		row,err := iter.Next()
+		if err==io.EOF { break }
+		if err!=nil { iter.Close(); return nil,err }
+		rows = append(rows,row)
+	}
+	if err := iter.Close(); err!=nil { return nil,err }
+	sort.Slice(rows,func(i,j int) bool { return rows[i][0].(int64)<rows[j][0].(int64) })
+	return rows,nil
+}
+
+func TestSpillGroupBy(t *testing.T) {
+	const keys,reps = 50,4
+	tests := []struct{
+		maxGroups  int
+		partitions int
+		opaque     bool
+		err        error
+	}{
+		{1000,16,false,nil}, /* No spill. */
+		{10,2,false,nil},
+		{4,4,false,nil},
+		{1,16,false,nil},
+		{10,2,true,nil},
+		{1,16,true,nil},
+
+		/* One partition never separates the groups. */
+		{1,1,false,ErrTooManyGroups},
+		{1,1,true,ErrTooManyGroups},
+	}
+	var want []sql.Row
+	for k := 0; k<keys; k++ { want = append(want,sql.Row{int64(k),int64(reps*10*k+reps*(reps-1)/2)}) }
+
+	for _,tt := range tests {
+		name := fmt.Sprintf("max=%d,partitions=%d,opaque=%v",tt.maxGroups,tt.partitions,tt.opaque)
+		dir := t.TempDir()
+		t.Setenv("TMPDIR",dir)
+
+		g := NewSpillGroupBy([]sql.Expression{colK,&total{colV,tt.opaque}},[]sql.Expression{colK},interleaved(keys,reps),tt.maxGroups)
+		g.Partitions = tt.partitions
+		iter,err := g.RowIter(sql.NewEmptyContext())
+		if err!=nil { t.Fatal(err) }
+		rows,err := drain(iter)
+		if err!=tt.err {
+			t.Errorf("%s: error %v, want %v",name,err,tt.err)
+		} else if err==nil && !reflect.DeepEqual(rows,want) {
+			t.Errorf("%s: got %v, want %v",name,rows,want)
+		}
+
+		/* The partition files are removed. */
+		left,err := ioutil.ReadDir(dir)
+		if err!=nil { t.Fatal(err) }
+		if len(left)!=0 { t.Errorf("%s: %d spill files left",name,len(left)) }
+	}
+}
@@ -0,0 +1,474 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package aggregate
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "github.com/spf13/cast"
+import "fmt"
+import "math"
+import "sort"
+import "strings"
+
+func distinctKey(v interface{}) string { return fmt.Sprintf("%#v",v) }
+
+type CountDistinct struct{
+	Expr sql.Expression
+}
+var _ sql.Aggregation = (*CountDistinct)(nil)
+func (a *CountDistinct) Resolved() (ok bool) { return a.Expr.Resolved() }
+func (a *CountDistinct) String() string { return fmt.Sprintf("count_distinct(%v)",a.Expr) }
+func (a *CountDistinct) Type() sql.Type { return sql.Int64 }
+func (a *CountDistinct) IsNullable() bool { return false }
+func (a *CountDistinct) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	n,err := a.Expr.TransformUp(st)
+	if err!=nil { return nil,err }
+	return st(&CountDistinct{n})
+}
+func (a *CountDistinct) Children() []sql.Expression { return []sql.Expression{a.Expr} }
+func (a *CountDistinct) NewBuffer() sql.Row {
+	return sql.Row{make(map[string]bool)}
+}
+func (a *CountDistinct) Update(ctx *sql.Context, buffer, row sql.Row) error {
+	val,err := a.Expr.Eval(ctx,row)
+	if err!=nil { return err }
+	if val==nil { return nil }
+	buffer[0].(map[string]bool)[distinctKey(val)] = true
+	return nil
+}
+func (a *CountDistinct) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
+	m := buffer[0].(map[string]bool)
+	for k := range partial[0].(map[string]bool) { m[k] = true }
+	return nil
+}
+func (a *CountDistinct) Eval(_ *sql.Context, buffer sql.Row) (interface{}, error) {
+	return int64(len(buffer[0].(map[string]bool))),nil
+}
+
+func NewCountDistinct(i sql.Expression) sql.Expression { return &CountDistinct{i} }
+
+type ApproxCountDistinct struct{
+	Expr sql.Expression
+}
+var _ sql.Aggregation = (*ApproxCountDistinct)(nil)
+func (a *ApproxCountDistinct) Resolved() (ok bool) { return a.Expr.Resolved() }
+func (a *ApproxCountDistinct) String() string { return fmt.Sprintf("approx_count_distinct(%v)",a.Expr) }
+func (a *ApproxCountDistinct) Type() sql.Type { return sql.Int64 }
+func (a *ApproxCountDistinct) IsNullable() bool { return false }
+func (a *ApproxCountDistinct) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	n,err := a.Expr.TransformUp(st)
+	if err!=nil { return nil,err }
+	return st(&ApproxCountDistinct{n})
+}
+func (a *ApproxCountDistinct) Children() []sql.Expression { return []sql.Expression{a.Expr} }
+func (a *ApproxCountDistinct) NewBuffer() sql.Row {
+	return sql.Row{newHyperLogLog()}
+}
+func (a *ApproxCountDistinct) Update(ctx *sql.Context, buffer, row sql.Row) error {
+	val,err := a.Expr.Eval(ctx,row)
+	if err!=nil { return err }
+	if val==nil { return nil }
+	buffer[0].(*HyperLogLog).add([]byte(distinctKey(val)))
+	return nil
+}
+func (a *ApproxCountDistinct) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
+	buffer[0].(*HyperLogLog).merge(partial[0].(*HyperLogLog))
+	return nil
+}
+func (a *ApproxCountDistinct) Eval(_ *sql.Context, buffer sql.Row) (interface{}, error) {
+	return int64(buffer[0].(*HyperLogLog).estimate()),nil
+}
+
+func NewApproxCountDistinct(i sql.Expression) sql.Expression { return &ApproxCountDistinct{i} }
+
+type Percentile struct{
+	Expr     sql.Expression
+	Fraction float64
+}
+var _ sql.Aggregation = (*Percentile)(nil)
+func (a *Percentile) Resolved() (ok bool) { return a.Expr.Resolved() }
+func (a *Percentile) String() string { return fmt.Sprintf("percentile(%v,%v)",a.Expr,a.Fraction) }
+func (a *Percentile) Type() sql.Type { return sql.Float64 }
+func (a *Percentile) IsNullable() bool { return true }
+func (a *Percentile) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	n,err := a.Expr.TransformUp(st)
+	if err!=nil { return nil,err }
+	return st(&Percentile{n,a.Fraction})
+}
+func (a *Percentile) Children() []sql.Expression { return []sql.Expression{a.Expr} }
+func (a *Percentile) NewBuffer() sql.Row {
+	return sql.Row{newTDigest()}
+}
+func (a *Percentile) Update(ctx *sql.Context, buffer, row sql.Row) error {
+	val,err := a.Expr.Eval(ctx,row)
+	if err!=nil { return err }
+	if val==nil { return nil }
+	f,err := cast.ToFloat64E(val)
+	if err!=nil { return err }
+	buffer[0].(*TDigest).add(f)
+	return nil
+}
+func (a *Percentile) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
+	buffer[0].(*TDigest).merge(partial[0].(*TDigest))
+	return nil
+}
+func (a *Percentile) Eval(_ *sql.Context, buffer sql.Row) (interface{}, error) {
+	q,ok := buffer[0].(*TDigest).quantile(a.Fraction)
+	if !ok { return nil,nil }
+	return q,nil
+}
+
+func NewPercentile(args ...sql.Expression) (sql.Expression, error) {
+	if len(args)!=2 { return nil,sql.ErrInvalidArgumentNumber.New(2, len(args)) }
+	lit,ok := args[1].(*expression.Literal)
+	if !ok { return nil,fmt.Errorf("expected numeric literal, got %v",args[1]) }
+	f,err := cast.ToFloat64E(lit.Value())
+	if err!=nil { return nil,err }
+	if f<0 || f>1 { return nil,fmt.Errorf("percentile must be between 0 and 1, got %v",f) }
+	return &Percentile{args[0],f},nil
+}
+func NewMedian(i sql.Expression) sql.Expression { return &Percentile{i,0.5} }
+
+/*
+Computes the variance and the standard deviation using Welford's algorithm.
+Partial states are combined using the formula of Chan et al.
+*/
+type Variance struct{
+	Expr sql.Expression
+	Pop  bool /* Population instead of sample variance. */
+	Sqrt bool /* Standard deviation. */
+}
+var _ sql.Aggregation = (*Variance)(nil)
+func (a *Variance) name() string {
+	n := "variance"
+	if a.Sqrt { n = "stddev" }
+	if a.Pop { n += "_pop" }
+	return n
+}
+func (a *Variance) Resolved() (ok bool) { return a.Expr.Resolved() }
+func (a *Variance) String() string { return fmt.Sprintf("%s(%v)",a.name(),a.Expr) }
+func (a *Variance) Type() sql.Type { return sql.Float64 }
+func (a *Variance) IsNullable() bool { return true }
+func (a *Variance) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	n,err := a.Expr.TransformUp(st)
+	if err!=nil { return nil,err }
+	return st(&Variance{n,a.Pop,a.Sqrt})
+}
+func (a *Variance) Children() []sql.Expression { return []sql.Expression{a.Expr} }
+
+/* count, mean, sum of squared differences from the mean. */
+func (a *Variance) NewBuffer() sql.Row {
+	return sql.Row{float64(0),float64(0),float64(0)}
+}
+func (a *Variance) Update(ctx *sql.Context, buffer, row sql.Row) error {
+	val,err := a.Expr.Eval(ctx,row)
+	if err!=nil { return err }
+	if val==nil { return nil }
+	x,err := cast.ToFloat64E(val)
+	if err!=nil { return err }
+	n,mean,m2 := buffer[0].(float64)+1,buffer[1].(float64),buffer[2].(float64)
+	d := x-mean
+	mean += d/n
+	m2 += d*(x-mean)
+	buffer[0],buffer[1],buffer[2] = n,mean,m2
+	return nil
+}
+func (a *Variance) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
+	na,ma,sa := buffer[0].(float64),buffer[1].(float64),buffer[2].(float64)
+	nb,mb,sb := partial[0].(float64),partial[1].(float64),partial[2].(float64)
+	if nb==0 { return nil }
+	n := na+nb
+	d := mb-ma
+	buffer[0] = n
+	buffer[1] = ma+d*nb/n
+	buffer[2] = sa+sb+d*d*na*nb/n
+	return nil
+}
+func (a *Variance) Eval(_ *sql.Context, buffer sql.Row) (interface{}, error) {
+	n,m2 := buffer[0].(float64),buffer[2].(float64)
+	if !a.Pop { n-- }
+	if n<=0 { return nil,nil }
+	v := m2/n
+	if a.Sqrt { v = math.Sqrt(v) }
+	return v,nil
+}
+
+func NewVariance(i sql.Expression) sql.Expression { return &Variance{i,false,false} }
+func NewVarPop(i sql.Expression) sql.Expression { return &Variance{i,true,false} }
+func NewStddev(i sql.Expression) sql.Expression { return &Variance{i,false,true} }
+func NewStddevPop(i sql.Expression) sql.Expression { return &Variance{i,true,true} }
+
+/*
+Returns the value of Expr of the row with the lowest (or highest) Key.
+*/
+type MinBy struct{
+	Expr sql.Expression
+	Key  sql.Expression
+	Max  bool
+}
+var _ sql.Aggregation = (*MinBy)(nil)
+func (a *MinBy) Resolved() (ok bool) { return a.Expr.Resolved()&&a.Key.Resolved() }
+func (a *MinBy) String() string {
+	if a.Max { return fmt.Sprintf("max_by(%v,%v)",a.Expr,a.Key) }
+	return fmt.Sprintf("min_by(%v,%v)",a.Expr,a.Key)
+}
+func (a *MinBy) Type() sql.Type { return a.Expr.Type() }
+func (a *MinBy) IsNullable() bool { return true }
+func (a *MinBy) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	e,err := a.Expr.TransformUp(st)
+	if err!=nil { return nil,err }
+	k,err := a.Key.TransformUp(st)
+	if err!=nil { return nil,err }
+	return st(&MinBy{e,k,a.Max})
+}
+func (a *MinBy) Children() []sql.Expression { return []sql.Expression{a.Expr,a.Key} }
+
+/* has-value, key, value */
+func (a *MinBy) NewBuffer() sql.Row {
+	return sql.Row{false,nil,nil}
+}
+func (a *MinBy) better(key,old interface{}) (bool,error) {
+	c,err := a.Key.Type().Compare(key,old)
+	if err!=nil { return false,err }
+	if a.Max { return c>0,nil }
+	return c<0,nil
+}
+func (a *MinBy) offer(buffer sql.Row,key,val interface{}) error {
+	if key==nil { return nil }
+	if buffer[0].(bool) {
+		ok,err := a.better(key,buffer[1])
+		if err!=nil { return err }
+		if !ok { return nil }
+	}
+	buffer[0],buffer[1],buffer[2] = true,key,val
+	return nil
+}
+func (a *MinBy) Update(ctx *sql.Context, buffer, row sql.Row) error {
+	key,err := a.Key.Eval(ctx,row)
+	if err!=nil { return err }
+	val,err := a.Expr.Eval(ctx,row)
+	if err!=nil { return err }
+	return a.offer(buffer,key,val)
+}
+func (a *MinBy) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
+	if !partial[0].(bool) { return nil }
+	return a.offer(buffer,partial[1],partial[2])
+}
+func (a *MinBy) Eval(_ *sql.Context, buffer sql.Row) (interface{}, error) { return buffer[2],nil }
+
+func NewMinBy(expr,key sql.Expression) sql.Expression { return &MinBy{expr,key,false} }
+func NewMaxBy(expr,key sql.Expression) sql.Expression { return &MinBy{expr,key,true} }
+
+type BitAnd struct{
+	Expr sql.Expression
+	Or   bool
+}
+var _ sql.Aggregation = (*BitAnd)(nil)
+func (a *BitAnd) Resolved() (ok bool) { return a.Expr.Resolved() }
+func (a *BitAnd) String() string {
+	if a.Or { return fmt.Sprintf("bit_or(%v)",a.Expr) }
+	return fmt.Sprintf("bit_and(%v)",a.Expr)
+}
+func (a *BitAnd) Type() sql.Type { return sql.Uint64 }
+func (a *BitAnd) IsNullable() bool { return false }
+func (a *BitAnd) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	n,err := a.Expr.TransformUp(st)
+	if err!=nil { return nil,err }
+	return st(&BitAnd{n,a.Or})
+}
+func (a *BitAnd) Children() []sql.Expression { return []sql.Expression{a.Expr} }
+
+/* Like in MySQL, bit_and() of no rows has all bits set. */
+func (a *BitAnd) NewBuffer() sql.Row {
+	if a.Or { return sql.Row{uint64(0)} }
+	return sql.Row{^uint64(0)}
+}
+func (a *BitAnd) combine(buffer sql.Row,v uint64) {
+	if a.Or {
+		buffer[0] = buffer[0].(uint64)|v
+	} else {
+		buffer[0] = buffer[0].(uint64)&v
+	}
+}
+func (a *BitAnd) Update(ctx *sql.Context, buffer, row sql.Row) error {
+	val,err := a.Expr.Eval(ctx,row)
+	if err!=nil { return err }
+	if val==nil { return nil }
+	u,err := cast.ToUint64E(val)
+	if err!=nil { return err }
+	a.combine(buffer,u)
+	return nil
+}
+func (a *BitAnd) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
+	a.combine(buffer,partial[0].(uint64))
+	return nil
+}
+func (a *BitAnd) Eval(_ *sql.Context, buffer sql.Row) (interface{}, error) { return buffer[0],nil }
+
+func NewBitAnd(i sql.Expression) sql.Expression { return &BitAnd{i,false} }
+func NewBitOr(i sql.Expression) sql.Expression { return &BitAnd{i,true} }
+
+type BoolAnd struct{
+	Expr sql.Expression
+	Or   bool
+}
+var _ sql.Aggregation = (*BoolAnd)(nil)
+func (a *BoolAnd) Resolved() (ok bool) { return a.Expr.Resolved() }
+func (a *BoolAnd) String() string {
+	if a.Or { return fmt.Sprintf("bool_or(%v)",a.Expr) }
+	return fmt.Sprintf("bool_and(%v)",a.Expr)
+}
+func (a *BoolAnd) Type() sql.Type { return sql.Boolean }
+func (a *BoolAnd) IsNullable() bool { return true }
+func (a *BoolAnd) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	n,err := a.Expr.TransformUp(st)
+	if err!=nil { return nil,err }
+	return st(&BoolAnd{n,a.Or})
+}
+func (a *BoolAnd) Children() []sql.Expression { return []sql.Expression{a.Expr} }
+
+/* NULL, if there are no non-NULL values. */
+func (a *BoolAnd) NewBuffer() sql.Row {
+	return sql.Row{nil}
+}
+func (a *BoolAnd) combine(buffer sql.Row,b bool) {
+	if buffer[0]==nil {
+		buffer[0] = b
+	} else if a.Or {
+		buffer[0] = buffer[0].(bool)||b
+	} else {
+		buffer[0] = buffer[0].(bool)&&b
+	}
+}
+func (a *BoolAnd) Update(ctx *sql.Context, buffer, row sql.Row) error {
+	val,err := a.Expr.Eval(ctx,row)
+	if err!=nil { return err }
+	if val==nil { return nil }
+	a.combine(buffer,cast.ToBool(val))
+	return nil
+}
+func (a *BoolAnd) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
+	if partial[0]==nil { return nil }
+	a.combine(buffer,partial[0].(bool))
+	return nil
+}
+func (a *BoolAnd) Eval(_ *sql.Context, buffer sql.Row) (interface{}, error) { return buffer[0],nil }
+
+func NewBoolAnd(i sql.Expression) sql.Expression { return &BoolAnd{i,false} }
+func NewBoolOr(i sql.Expression) sql.Expression { return &BoolAnd{i,true} }
+
+/* A value of string_agg(), with its sort key. The fields are exported for encoding/gob. */
+type StringAggElem struct{
+	Key interface{}
+	Val string
+}
+
+/*
+Concatenates the values, separated by Separator. If Order is set, the values
+are sorted by it. Otherwise, they are concatenated in arrival order.
+*/
+type StringAgg struct{
+	Expr      sql.Expression
+	Separator string
+	Order     sql.Expression
+	Desc      bool
+}
+var _ sql.Aggregation = (*StringAgg)(nil)
+func (a *StringAgg) Resolved() (ok bool) {
+	return a.Expr.Resolved() && (a.Order==nil || a.Order.Resolved())
+}
+func (a *StringAgg) String() string {
+	if a.Order==nil { return fmt.Sprintf("string_agg(%v,%q)",a.Expr,a.Separator) }
+	if a.Desc { return fmt.Sprintf("string_agg(%v,%q,%v,'desc')",a.Expr,a.Separator,a.Order) }
+	return fmt.Sprintf("string_agg(%v,%q,%v)",a.Expr,a.Separator,a.Order)
+}
+func (a *StringAgg) Type() sql.Type { return sql.Text }
+func (a *StringAgg) IsNullable() bool { return true }
+func (a *StringAgg) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	e,err := a.Expr.TransformUp(st)
+	if err!=nil { return nil,err }
+	var o sql.Expression
+	if a.Order!=nil {
+		o,err = a.Order.TransformUp(st)
+		if err!=nil { return nil,err }
+	}
+	return st(&StringAgg{e,a.Separator,o,a.Desc})
+}
+func (a *StringAgg) Children() []sql.Expression {
+	if a.Order==nil { return []sql.Expression{a.Expr} }
+	return []sql.Expression{a.Expr,a.Order}
+}
+func (a *StringAgg) NewBuffer() sql.Row {
+	return sql.Row{[]StringAggElem(nil)}
+}
+func (a *StringAgg) Update(ctx *sql.Context, buffer, row sql.Row) error {
+	val,err := a.Expr.Eval(ctx,row)
+	if err!=nil { return err }
+	if val==nil { return nil }
+	var key interface{}
+	if a.Order!=nil {
+		key,err = a.Order.Eval(ctx,row)
+		if err!=nil { return err }
+	}
+	buffer[0] = append(buffer[0].([]StringAggElem),StringAggElem{key,cast.ToString(val)})
+	return nil
+}
+func (a *StringAgg) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
+	buffer[0] = append(buffer[0].([]StringAggElem),partial[0].([]StringAggElem)...)
+	return nil
+}
+func (a *StringAgg) Eval(_ *sql.Context, buffer sql.Row) (interface{}, error) {
+	elems := buffer[0].([]StringAggElem)
+	if len(elems)==0 { return nil,nil }
+	if a.Order!=nil {
+		t := a.Order.Type()
+		sorted := make([]StringAggElem,len(elems))
+		copy(sorted,elems)
+		var err error
+		sort.SliceStable(sorted,func(i, j int) bool {
+			c,e := t.Compare(sorted[i].Key,sorted[j].Key)
+			if e!=nil && err==nil { err = e }
+			if c==0 { return sorted[i].Val<sorted[j].Val }
+			if a.Desc { return c>0 }
+			return c<0
+		})
+		if err!=nil { return nil,err }
+		elems = sorted
+	}
+	s := make([]string,len(elems))
+	for i,e := range elems { s[i] = e.Val }
+	return strings.Join(s,a.Separator),nil
+}
+
+func NewStringAgg(args ...sql.Expression) (sql.Expression, error) {
+	if len(args)<2 || len(args)>4 { return nil,sql.ErrInvalidArgumentNumber.New(2, len(args)) }
+	lit,ok := args[1].(*expression.Literal)
+	if !ok { return nil,fmt.Errorf("expected string literal, got %v",args[1]) }
+	a := &StringAgg{Expr:args[0],Separator:cast.ToString(lit.Value())}
+	if len(args)>2 { a.Order = args[2] }
+	if len(args)>3 {
+		lit,ok := args[3].(*expression.Literal)
+		if !ok { return nil,fmt.Errorf("expected 'asc' or 'desc', got %v",args[3]) }
+		switch strings.ToLower(cast.ToString(lit.Value())) {
+		case "asc":
+		case "desc": a.Desc = true
+		default: return nil,fmt.Errorf("expected 'asc' or 'desc', got %v",args[3])
+		}
+	}
+	return a,nil
+}
@@ -1,158 +1,322 @@
-/*
-   Copyright 2018 Simon Schmidt
-
-   Licensed under the Apache License, Version 2.0 (the "License");
-   you may not use this file except in compliance with the License.
-   You may obtain a copy of the License at
-
-       http://www.apache.org/licenses/LICENSE-2.0
-
-   Unless required by applicable law or agreed to in writing, software
-   distributed under the License is distributed on an "AS IS" BASIS,
-   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-   See the License for the specific language governing permissions and
-   limitations under the License.
-*/
-
-
-package aggregate
-
-//func(...sql.Expression) (sql.Expression, error)
-import "gopkg.in/src-d/go-mysql-server.v0/sql"
-import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
-import "github.com/spf13/cast"
-import "fmt"
-
-type AsList struct{
-	expr sql.Expression
-	max_count int
-	resultType sql.Type
-}
-var _ sql.Aggregation = (*AsList)(nil)
-func (a *AsList) Resolved() (ok bool) { return a.expr.Resolved() }
-func (a *AsList) String() string { return fmt.Sprintf("as_list(%v,%v)",a.expr,a.max_count) }
-func (a *AsList) Type() sql.Type { return a.resultType }
-func (a *AsList) IsNullable() bool { return false }
-func (a *AsList) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
-	n,err := a.expr.TransformUp(st)
-	if err!=nil { return nil,err }
-	return st(&AsList{n,a.max_count,sql.Array(n.Type())})
-}
-func (a *AsList) Children() []sql.Expression { return []sql.Expression{a.expr} }
-func (a *AsList) NewBuffer() sql.Row {
-	cnt := a.max_count
-	if cnt > (1<<14) { cnt = 1<<16 }
-	return sql.Row{make([]interface{},0,cnt)}
-}
-func (a *AsList) Update(ctx *sql.Context, buffer, row sql.Row) error {
-	arr := buffer[0].([]interface{})
-	if len(arr) >= a.max_count { return nil }
-	val,err := a.expr.Eval(ctx,row)
-	if err!=nil { return err }
-	arr = append(arr,val)
-	buffer[0] = arr
-	return nil
-}
-func (a *AsList) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
-	arr := buffer[0].([]interface{})
-	if len(arr) >= a.max_count { return nil }
-	arr2 := partial[0].([]interface{})
-	rest := a.max_count - len(arr)
-	if len(arr2)>rest { arr2 = arr2[:rest] }
-	arr = append(arr,arr2...)
-	buffer[0] = arr
-	return nil
-}
-
-func (a *AsList) Eval(_ *sql.Context, buffer sql.Row) (interface{}, error) { return buffer[0],nil }
-
-func NewAsList(args ...sql.Expression) (sql.Expression, error) {
-	a := new(AsList)
-	a.max_count = 1<<11
-	switch len(args) {
-	case 2:
-		lit,ok := args[1].(*expression.Literal)
-		if !ok { return nil,fmt.Errorf("expected integer literal, got %v",args[1]) }
-		var err error
-		a.max_count,err = cast.ToIntE(lit.Value())
-		if err!=nil { return nil,err }
-	case 1:
-		a.expr = args[0]
-		a.resultType = sql.Array(a.expr.Type())
-	default:
-		return nil,sql.ErrInvalidArgumentNumber.New(2, len(args))
-	}
-	return a,nil
-}
-
-type First struct{
-	Expr sql.Expression
-}
-var _ sql.Aggregation = (*First)(nil)
-func (a *First) Resolved() (ok bool) { return a.Expr.Resolved() }
-func (a *First) String() string { return fmt.Sprintf("first(%v)",a.Expr) }
-func (a *First) Type() sql.Type { return a.Expr.Type() }
-func (a *First) IsNullable() bool { return a.Expr.IsNullable() }
-func (a *First) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
-	n,err := a.Expr.TransformUp(st)
-	if err!=nil { return nil,err }
-	return st(&First{n})
-}
-func (a *First) Children() []sql.Expression { return []sql.Expression{a.Expr} }
-func (a *First) NewBuffer() sql.Row {
-	return sql.Row{false,nil}
-}
-func (a *First) Update(ctx *sql.Context, buffer, row sql.Row) error {
-	if buffer[0].(bool) { return nil }
-	val,err := a.Expr.Eval(ctx,row)
-	if err!=nil { return err }
-	buffer[0] = true
-	buffer[1] = val
-	return nil
-}
-func (a *First) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
-	if buffer[0].(bool) { return nil }
-	buffer[0] = partial[0]
-	buffer[1] = partial[1]
-	return nil
-}
-func (a *First) Eval(_ *sql.Context, buffer sql.Row) (interface{}, error) { return buffer[1],nil }
-
-func NewFirst(i sql.Expression) sql.Expression { return &First{i} }
-
-func toAggregation(i sql.Expression) sql.Aggregation {
-	if a,ok := i.(sql.Aggregation) ; ok { return a }
-	return &First{i}
-}
-
-type Last struct{
-	Expr sql.Expression
-}
-var _ sql.Aggregation = (*Last)(nil)
-func (a *Last) Resolved() (ok bool) { return a.Expr.Resolved() }
-func (a *Last) String() string { return fmt.Sprintf("last(%v)",a.Expr) }
-func (a *Last) Type() sql.Type { return a.Expr.Type() }
-func (a *Last) IsNullable() bool { return a.Expr.IsNullable() }
-func (a *Last) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
-	n,err := a.Expr.TransformUp(st)
-	if err!=nil { return nil,err }
-	return st(&Last{n})
-}
-func (a *Last) Children() []sql.Expression { return []sql.Expression{a.Expr} }
-func (a *Last) NewBuffer() sql.Row {
-	return sql.Row{nil}
-}
-func (a *Last) Update(ctx *sql.Context, buffer, row sql.Row) error {
-	val,err := a.Expr.Eval(ctx,row)
-	if err!=nil { return err }
-	buffer[0] = val
-	return nil
-}
-func (a *Last) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
-	buffer[0] = partial[0]
-	return nil
-}
-func (a *Last) Eval(_ *sql.Context, buffer sql.Row) (interface{}, error) { return buffer[0],nil }
-
-func NewLast(i sql.Expression) sql.Expression { return &Last{i} }
-
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package aggregate
+
+//func(...sql.Expression) (sql.Expression, error)
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "github.com/spf13/cast"
+import "fmt"
+import "sort"
+import "strings"
+
+type AsList struct{
+	expr sql.Expression
+	max_count int
+	resultType sql.Type
+	order sql.Expression
+	desc bool
+	distinct bool
+}
+var _ sql.Aggregation = (*AsList)(nil)
+func (a *AsList) Resolved() (ok bool) { return a.expr.Resolved() && (a.order==nil || a.order.Resolved()) }
+func (a *AsList) String() string {
+	s := fmt.Sprintf("as_list(%v,%v",a.expr,a.max_count)
+	if a.order!=nil { s += ","+(&OrderBy{a.order,a.desc}).String() }
+	if a.distinct { s += ",'distinct'" }
+	return s+")"
+}
+func (a *AsList) Type() sql.Type { return a.resultType }
+func (a *AsList) Shape() sql.Type { return ListOf(ShapeOf(a.expr)) }
+func (a *AsList) IsNullable() bool { return false }
+func (a *AsList) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	n,err := a.expr.TransformUp(st)
+	if err!=nil { return nil,err }
+	var o sql.Expression
+	if a.order!=nil {
+		o,err = a.order.TransformUp(st)
+		if err!=nil { return nil,err }
+	}
+	return st(&AsList{n,a.max_count,sql.Array(n.Type()),o,a.desc,a.distinct})
+}
+func (a *AsList) Children() []sql.Expression {
+	if a.order==nil { return []sql.Expression{a.expr} }
+	return []sql.Expression{a.expr,a.order}
+}
+
+/*
+Buffer layout:
+	unordered: the list of values, and the set of values seen (if distinct).
+	ordered:   a list of ListElem, that is truncated to the best max_count elements from time to time.
+The fields of ListElem are exported for encoding/gob.
+*/
+type ListElem struct{
+	Key interface{}
+	Val interface{}
+	Id  string
+}
+func (a *AsList) NewBuffer() sql.Row {
+	cnt := a.max_count
+	if cnt > (1<<14) { cnt = 1<<16 }
+	if a.order!=nil { return sql.Row{make([]ListElem,0,cnt)} }
+	if a.distinct { return sql.Row{make([]interface{},0,cnt),make(map[string]bool)} }
+	return sql.Row{make([]interface{},0,cnt)}
+}
+
+/*
+Sorts the list by key, then by value, so that the result does not depend on the arrival order.
+Then removes the duplicates and truncates it to max_count elements.
+*/
+func (a *AsList) truncate(arr []ListElem) ([]ListElem,error) {
+	t := a.order.Type()
+	var err error
+	sort.Slice(arr,func(i, j int) bool {
+		c,e := t.Compare(arr[i].Key,arr[j].Key)
+		if e!=nil && err==nil { err = e }
+		if a.desc { c = -c }
+		if c!=0 { return c<0 }
+		return arr[i].Id<arr[j].Id
+	})
+	if err!=nil { return nil,err }
+	if a.distinct {
+		seen := make(map[string]bool)
+		out := arr[:0]
+		for _,e := range arr {
+			if seen[e.Id] { continue }
+			seen[e.Id] = true
+			out = append(out,e)
+		}
+		arr = out
+	}
+	if len(arr)>a.max_count { arr = arr[:a.max_count] }
+	return arr,nil
+}
+func (a *AsList) updateOrdered(buffer sql.Row,elems ...ListElem) (err error) {
+	arr := append(buffer[0].([]ListElem),elems...)
+	if len(arr) >= 2*a.max_count {
+		arr,err = a.truncate(arr)
+		if err!=nil { return }
+	}
+	buffer[0] = arr
+	return
+}
+func (a *AsList) Update(ctx *sql.Context, buffer, row sql.Row) error {
+	if a.order!=nil {
+		val,err := a.expr.Eval(ctx,row)
+		if err!=nil { return err }
+		key,err := a.order.Eval(ctx,row)
+		if err!=nil { return err }
+		return a.updateOrdered(buffer,ListElem{key,val,fmt.Sprintf("%#v",val)})
+	}
+	arr := buffer[0].([]interface{})
+	if len(arr) >= a.max_count { return nil }
+	val,err := a.expr.Eval(ctx,row)
+	if err!=nil { return err }
+	if a.distinct {
+		id := fmt.Sprintf("%#v",val)
+		seen := buffer[1].(map[string]bool)
+		if seen[id] { return nil }
+		seen[id] = true
+	}
+	arr = append(arr,val)
+	buffer[0] = arr
+	return nil
+}
+func (a *AsList) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
+	if a.order!=nil {
+		return a.updateOrdered(buffer,partial[0].([]ListElem)...)
+	}
+	arr := buffer[0].([]interface{})
+	if len(arr) >= a.max_count { return nil }
+	arr2 := partial[0].([]interface{})
+	if a.distinct {
+		seen := buffer[1].(map[string]bool)
+		for _,val := range arr2 {
+			if len(arr) >= a.max_count { break }
+			id := fmt.Sprintf("%#v",val)
+			if seen[id] { continue }
+			seen[id] = true
+			arr = append(arr,val)
+		}
+		buffer[0] = arr
+		return nil
+	}
+	rest := a.max_count - len(arr)
+	if len(arr2)>rest { arr2 = arr2[:rest] }
+	arr = append(arr,arr2...)
+	buffer[0] = arr
+	return nil
+}
+
+func (a *AsList) Eval(_ *sql.Context, buffer sql.Row) (interface{}, error) {
+	if a.order==nil { return buffer[0],nil }
+	arr := buffer[0].([]ListElem)
+	cp := make([]ListElem,len(arr))
+	copy(cp,arr)
+	cp,err := a.truncate(cp)
+	if err!=nil { return nil,err }
+	r := make([]interface{},len(cp))
+	for i,e := range cp { r[i] = e.Val }
+	return r,nil
+}
+
+func NewAsList(args ...sql.Expression) (sql.Expression, error) {
+	a := new(AsList)
+	a.max_count = 1<<11
+	if len(args)==0 || len(args)>4 { return nil,sql.ErrInvalidArgumentNumber.New(2, len(args)) }
+	a.expr = args[0]
+	a.resultType = sql.Array(a.expr.Type())
+	var opts []sql.Expression
+	if len(args)>1 {
+		lit,ok := args[1].(*expression.Literal)
+		if !ok { return nil,fmt.Errorf("expected integer literal, got %v",args[1]) }
+		var err error
+		a.max_count,err = cast.ToIntE(lit.Value())
+		if err!=nil { return nil,err }
+		opts = args[2:]
+	}
+	for _,arg := range opts {
+		switch v := arg.(type) {
+		case *OrderBy:
+			if a.order!=nil { return nil,fmt.Errorf("duplicate %v",v) }
+			a.order = v.Expr
+			a.desc = v.Desc
+			continue
+		case *expression.Literal:
+			if strings.ToLower(cast.ToString(v.Value()))=="distinct" {
+				a.distinct = true
+				continue
+			}
+		}
+		return nil,fmt.Errorf("expected order_by(...) or 'distinct', got %v",arg)
+	}
+	return a,nil
+}
+
+/*
+An ordering specification, only valid as argument of an aggregation.
+*/
+type OrderBy struct{
+	Expr sql.Expression
+	Desc bool
+}
+var _ sql.Expression = (*OrderBy)(nil)
+func (o *OrderBy) Resolved() bool { return o.Expr.Resolved() }
+func (o *OrderBy) String() string {
+	if o.Desc { return fmt.Sprintf("order_by(%v,'desc')",o.Expr) }
+	return fmt.Sprintf("order_by(%v)",o.Expr)
+}
+func (o *OrderBy) Type() sql.Type { return o.Expr.Type() }
+func (o *OrderBy) IsNullable() bool { return o.Expr.IsNullable() }
+func (o *OrderBy) Eval(*sql.Context, sql.Row) (interface{}, error) { return nil,fmt.Errorf("improper use of %v",o) }
+func (o *OrderBy) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	n,err := o.Expr.TransformUp(st)
+	if err!=nil { return nil,err }
+	return st(&OrderBy{n,o.Desc})
+}
+func (o *OrderBy) Children() []sql.Expression { return []sql.Expression{o.Expr} }
+
+func NewOrderBy(args ...sql.Expression) (sql.Expression, error) {
+	switch len(args) {
+	case 1: return &OrderBy{args[0],false},nil
+	case 2:
+		lit,ok := args[1].(*expression.Literal)
+		if ok {
+			switch strings.ToLower(cast.ToString(lit.Value())) {
+			case "asc": return &OrderBy{args[0],false},nil
+			case "desc": return &OrderBy{args[0],true},nil
+			}
+		}
+		return nil,fmt.Errorf("expected 'asc' or 'desc', got %v",args[1])
+	}
+	return nil,sql.ErrInvalidArgumentNumber.New(2, len(args))
+}
+
+type First struct{
+	Expr sql.Expression
+}
+var _ sql.Aggregation = (*First)(nil)
+func (a *First) Resolved() (ok bool) { return a.Expr.Resolved() }
+func (a *First) String() string { return fmt.Sprintf("first(%v)",a.Expr) }
+func (a *First) Type() sql.Type { return a.Expr.Type() }
+func (a *First) Shape() sql.Type { return ShapeOf(a.Expr) }
+func (a *First) IsNullable() bool { return a.Expr.IsNullable() }
+func (a *First) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	n,err := a.Expr.TransformUp(st)
+	if err!=nil { return nil,err }
+	return st(&First{n})
+}
+func (a *First) Children() []sql.Expression { return []sql.Expression{a.Expr} }
+func (a *First) NewBuffer() sql.Row {
+	return sql.Row{false,nil}
+}
+func (a *First) Update(ctx *sql.Context, buffer, row sql.Row) error {
+	if buffer[0].(bool) { return nil }
+	val,err := a.Expr.Eval(ctx,row)
+	if err!=nil { return err }
+	buffer[0] = true
+	buffer[1] = val
+	return nil
+}
+func (a *First) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
+	if buffer[0].(bool) { return nil }
+	buffer[0] = partial[0]
+	buffer[1] = partial[1]
+	return nil
+}
+func (a *First) Eval(_ *sql.Context, buffer sql.Row) (interface{}, error) { return buffer[1],nil }
+
+func NewFirst(i sql.Expression) sql.Expression { return &First{i} }
+
+func toAggregation(i sql.Expression) sql.Aggregation {
+	if a,ok := i.(sql.Aggregation) ; ok { return a }
+	return &First{i}
+}
+
+type Last struct{
+	Expr sql.Expression
+}
+var _ sql.Aggregation = (*Last)(nil)
+func (a *Last) Resolved() (ok bool) { return a.Expr.Resolved() }
+func (a *Last) String() string { return fmt.Sprintf("last(%v)",a.Expr) }
+func (a *Last) Type() sql.Type { return a.Expr.Type() }
+func (a *Last) Shape() sql.Type { return ShapeOf(a.Expr) }
+func (a *Last) IsNullable() bool { return a.Expr.IsNullable() }
+func (a *Last) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	n,err := a.Expr.TransformUp(st)
+	if err!=nil { return nil,err }
+	return st(&Last{n})
+}
+func (a *Last) Children() []sql.Expression { return []sql.Expression{a.Expr} }
+func (a *Last) NewBuffer() sql.Row {
+	return sql.Row{nil}
+}
+func (a *Last) Update(ctx *sql.Context, buffer, row sql.Row) error {
+	val,err := a.Expr.Eval(ctx,row)
+	if err!=nil { return err }
+	buffer[0] = val
+	return nil
+}
+func (a *Last) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
+	buffer[0] = partial[0]
+	return nil
+}
+func (a *Last) Eval(_ *sql.Context, buffer sql.Row) (interface{}, error) { return buffer[0],nil }
+
+func NewLast(i sql.Expression) sql.Expression { return &Last{i} }
+
@@ -0,0 +1,87 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package aggregate
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "reflect"
+import "testing"
+
+func TestAsList(t *testing.T) {
+	key := expression.NewGetField(0,sql.Int64,"k",false)
+	val := expression.NewGetField(1,sql.Text,"v",false)
+	limit := func(n int64) sql.Expression { return expression.NewLiteral(n,sql.Int64) }
+	distinct := expression.NewLiteral("distinct",sql.Text)
+	rows := []sql.Row{
+		{int64(5),"e"},{int64(1),"a"},{int64(3),"c"},{int64(1),"a"},
+		{int64(4),"d"},{int64(2),"b"},{int64(2),"b"},{int64(6),"f"},
+	}
+	tests := []struct{
+		name string
+		args []sql.Expression
+		want []interface{}
+	}{
+		{"first",[]sql.Expression{val,limit(3)},[]interface{}{"e","a","c"}},
+		{"first across parts",[]sql.Expression{val,limit(6)},[]interface{}{"e","a","c","a","d","b"}},
+		{"distinct",[]sql.Expression{val,limit(4),distinct},[]interface{}{"e","a","c","d"}},
+		{"top",[]sql.Expression{val,limit(3),&OrderBy{key,false}},[]interface{}{"a","a","b"}},
+		{"top distinct",[]sql.Expression{val,limit(3),&OrderBy{key,false},distinct},[]interface{}{"a","b","c"}},
+		{"top desc distinct",[]sql.Expression{val,limit(3),distinct,&OrderBy{key,true}},[]interface{}{"f","e","d"}},
+		{"top of all",[]sql.Expression{val,limit(100),&OrderBy{key,true}},[]interface{}{"f","e","d","c","b","b","a","a"}},
+	}
+	ctx := sql.NewEmptyContext()
+	for _,tt := range tests {
+		e,err := NewAsList(tt.args...)
+		if err!=nil { t.Fatalf("%s: %v",tt.name,err) }
+		a := e.(*AsList)
+
+		/* In one pass, and in two parts, that are merged. */
+		whole,first,second := a.NewBuffer(),a.NewBuffer(),a.NewBuffer()
+		for i,row := range rows {
+			part := first
+			if i>=len(rows)/2 { part = second }
+			if err := a.Update(ctx,whole,row); err!=nil { t.Fatal(err) }
+			if err := a.Update(ctx,part,row); err!=nil { t.Fatal(err) }
+		}
+		if err := a.Merge(ctx,first,second); err!=nil { t.Fatal(err) }
+		for _,buf := range []sql.Row{whole,first} {
+			got,err := a.Eval(ctx,buf)
+			if err!=nil { t.Errorf("%s: %v",tt.name,err); continue }
+			if !reflect.DeepEqual(got,tt.want) { t.Errorf("%s: got %v, want %v",tt.name,got,tt.want) }
+		}
+	}
+}
+
+func TestAsListArgs(t *testing.T) {
+	val := expression.NewGetField(0,sql.Text,"v",false)
+	tests := []struct{
+		args []sql.Expression
+		ok   bool
+	}{
+		{[]sql.Expression{val},true},
+		{[]sql.Expression{val,expression.NewLiteral(int64(2),sql.Int64),expression.NewLiteral("DISTINCT",sql.Text)},true},
+		{nil,false},
+		{[]sql.Expression{val,val},false},
+		{[]sql.Expression{val,expression.NewLiteral(int64(2),sql.Int64),expression.NewLiteral("unique",sql.Text)},false},
+		{[]sql.Expression{val,expression.NewLiteral(int64(2),sql.Int64),&OrderBy{val,false},&OrderBy{val,true}},false},
+	}
+	for _,tt := range tests {
+		_,err := NewAsList(tt.args...)
+		if (err==nil)!=tt.ok { t.Errorf("NewAsList(%v): error %v",tt.args,err) }
+	}
+}
@@ -0,0 +1,148 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package aggregate
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "io"
+import "strings"
+
+/*
+A streaming GROUP BY. The input rows arrive clustered on the Cluster expressions,
+so every group is emitted as soon as the cluster key changes. Only the groups of
+the current cluster are held in memory.
+*/
+type ClusterGroupBy struct{
+	Child     sql.Node
+	Aggregate []sql.Expression
+	Cluster   []sql.Expression
+	Grouping  []sql.Expression /* Additional grouping expressions within a cluster. */
+}
+var _ sql.Node = (*ClusterGroupBy)(nil)
+
+func NewClusterGroupBy(aggregate,cluster,grouping []sql.Expression,child sql.Node) *ClusterGroupBy {
+	return &ClusterGroupBy{child,aggregate,cluster,grouping}
+}
+
+func (c *ClusterGroupBy) Resolved() bool { return c.Child.Resolved() }
+func (c *ClusterGroupBy) String() string {
+	pr := sql.NewTreePrinter()
+	_ = pr.WriteNode("ClusterGroupBy")
+	aggr := make([]string,len(c.Aggregate))
+	for i,e := range c.Aggregate { aggr[i] = e.String() }
+	grp := make([]string,len(c.Grouping))
+	for i,e := range c.Grouping { grp[i] = e.String() }
+	_ = pr.WriteChildren(
+		"Aggregate("+strings.Join(aggr,", ")+")",
+		"Cluster"+expression.Tuple(c.Cluster).String(),
+		"Grouping("+strings.Join(grp,", ")+")",
+		c.Child.String(),
+	)
+	return pr.String()
+}
+func (c *ClusterGroupBy) Schema() sql.Schema { return aggregateSchema(c.Aggregate) }
+func (c *ClusterGroupBy) Children() []sql.Node { return []sql.Node{c.Child} }
+func (c *ClusterGroupBy) TransformUp(f sql.TransformNodeFunc) (sql.Node, error) {
+	child,err := c.Child.TransformUp(f)
+	if err!=nil { return nil,err }
+	return f(NewClusterGroupBy(c.Aggregate,c.Cluster,c.Grouping,child))
+}
+func (c *ClusterGroupBy) TransformExpressionsUp(f sql.TransformExprFunc) (sql.Node, error) {
+	child,err := c.Child.TransformExpressionsUp(f)
+	if err!=nil { return nil,err }
+	aggr,err := transformAll(c.Aggregate,f)
+	if err!=nil { return nil,err }
+	clus,err := transformAll(c.Cluster,f)
+	if err!=nil { return nil,err }
+	grp,err := transformAll(c.Grouping,f)
+	if err!=nil { return nil,err }
+	return NewClusterGroupBy(aggr,clus,grp,child),nil
+}
+func (c *ClusterGroupBy) RowIter(ctx *sql.Context) (sql.RowIter, error) {
+	i,err := c.Child.RowIter(ctx)
+	if err!=nil { return nil,err }
+	return &clusterIter{c:c,ctx:ctx,child:i,groups:newGroupSet(c.Aggregate,c.Grouping)},nil
+}
+
+type clusterIter struct{
+	c      *ClusterGroupBy
+	ctx    *sql.Context
+	child  sql.RowIter
+	key    []interface{}
+	groups *groupSet
+	out    []sql.Row
+	eof    bool
+}
+func (ci *clusterIter) evalAll(exprs []sql.Expression,row sql.Row) (r []interface{},e error) {
+	r = make([]interface{},len(exprs))
+	for i,x := range exprs {
+		r[i],e = x.Eval(ci.ctx,row)
+		if e!=nil { return }
+	}
+	return
+}
+func (ci *clusterIter) sameCluster(key []interface{}) bool {
+	if ci.key==nil { return false }
+	for i,x := range ci.c.Cluster {
+		c,err := x.Type().Compare(ci.key[i],key[i])
+		if err!=nil || c!=0 { return false }
+	}
+	return true
+}
+
+/* Evaluates the groups of the current cluster. */
+func (ci *clusterIter) flush() (err error) {
+	ci.out,err = ci.groups.flush(ci.ctx,ci.out)
+	return
+}
+func (ci *clusterIter) update(row sql.Row) error {
+	k,err := ci.groups.key(ci.ctx,row)
+	if err!=nil { return err }
+	i,ok := ci.groups.lookup(k)
+	if !ok {
+		i,err = ci.groups.add(ci.ctx,k,row)
+		if err!=nil { return err }
+	}
+	return ci.groups.update(ci.ctx,i,row)
+}
+func (ci *clusterIter) Next() (sql.Row, error) {
+	for len(ci.out)==0 {
+		if ci.eof { return nil,io.EOF }
+		row,err := ci.child.Next()
+		if err==io.EOF {
+			ci.eof = true
+			err = ci.flush()
+			if err!=nil { return nil,err }
+			continue
+		}
+		if err!=nil { return nil,err }
+		key,err := ci.evalAll(ci.c.Cluster,row)
+		if err!=nil { return nil,err }
+		if !ci.sameCluster(key) {
+			err = ci.flush()
+			if err!=nil { return nil,err }
+			ci.key = key
+		}
+		err = ci.update(row)
+		if err!=nil { return nil,err }
+	}
+	row := ci.out[0]
+	ci.out = ci.out[1:]
+	return row,nil
+}
+func (ci *clusterIter) Close() error { return ci.child.Close() }
@@ -0,0 +1,146 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package aggregate
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "fmt"
+import "io"
+import "reflect"
+import "testing"
+
+/* A node over a fixed list of rows, that counts the rows read from it. */
+type rowsNode struct{
+	schema sql.Schema
+	rows   []sql.Row
+	read   int
+}
+func (n *rowsNode) Resolved() bool { return true }
+func (n *rowsNode) String() string { return "Rows" }
+func (n *rowsNode) Schema() sql.Schema { return n.schema }
+func (n *rowsNode) Children() []sql.Node { return nil }
+func (n *rowsNode) RowIter(ctx *sql.Context) (sql.RowIter, error) { return &rowsIter{n,0},nil }
+func (n *rowsNode) TransformUp(f sql.TransformNodeFunc) (sql.Node, error) { return f(n) }
+func (n *rowsNode) TransformExpressionsUp(f sql.TransformExprFunc) (sql.Node, error) { return n,nil }
+
+type rowsIter struct{
+	n *rowsNode
+	i int
+}
+func (r *rowsIter) Next() (sql.Row, error) {
+	if r.i>=len(r.n.rows) { return nil,io.EOF }
+	r.i++
+	r.n.read++
+	return r.n.rows[r.i-1],nil
+}
+func (r *rowsIter) Close() error { return nil }
+
+/*
+sum() over int64 values. If opaque is set, the state is a type unknown to
+encoding/gob, so that SpillGroupBy has to spill rows instead of states.
+*/
+type total struct{
+	expr   sql.Expression
+	opaque bool
+}
+type opaqueSum struct{ n int64 }
+func (a *total) Resolved() bool { return a.expr.Resolved() }
+func (a *total) String() string { return fmt.Sprintf("total(%v)",a.expr) }
+func (a *total) Type() sql.Type { return sql.Int64 }
+func (a *total) IsNullable() bool { return false }
+func (a *total) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	n,err := a.expr.TransformUp(st)
+	if err!=nil { return nil,err }
+	return st(&total{n,a.opaque})
+}
+func (a *total) Children() []sql.Expression { return []sql.Expression{a.expr} }
+func (a *total) NewBuffer() sql.Row {
+	if a.opaque { return sql.Row{&opaqueSum{}} }
+	return sql.Row{int64(0)}
+}
+func (a *total) add(buffer sql.Row,n int64) {
+	if a.opaque {
+		buffer[0].(*opaqueSum).n += n
+	} else {
+		buffer[0] = buffer[0].(int64)+n
+	}
+}
+func (a *total) value(buffer sql.Row) int64 {
+	if a.opaque { return buffer[0].(*opaqueSum).n }
+	return buffer[0].(int64)
+}
+func (a *total) Update(ctx *sql.Context, buffer, row sql.Row) error {
+	v,err := a.expr.Eval(ctx,row)
+	if err!=nil { return err }
+	a.add(buffer,v.(int64))
+	return nil
+}
+func (a *total) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
+	a.add(buffer,a.value(partial))
+	return nil
+}
+func (a *total) Eval(_ *sql.Context, buffer sql.Row) (interface{}, error) { return a.value(buffer),nil }
+
+func TestClusterGroupBy(t *testing.T) {
+	colC := expression.NewGetField(0,sql.Int64,"c",false)
+	colG := expression.NewGetField(1,sql.Int64,"g",false)
+	colX := expression.NewGetField(2,sql.Int64,"x",false)
+	schema := sql.Schema{{Name:"c",Type:sql.Int64},{Name:"g",Type:sql.Int64},{Name:"x",Type:sql.Int64}}
+	tests := []struct{
+		name  string
+		rows  []sql.Row
+		want  []sql.Row
+		first int /* The rows read, before the first group is returned. */
+	}{
+		{"empty",nil,nil,0},
+		{"one cluster",
+			[]sql.Row{{int64(0),int64(1),int64(5)},{int64(0),int64(2),int64(1)},{int64(0),int64(1),int64(2)}},
+			[]sql.Row{{int64(0),int64(1),int64(7)},{int64(0),int64(2),int64(1)}},
+			3},
+		{"clusters",
+			[]sql.Row{
+				{int64(0),int64(1),int64(5)},{int64(0),int64(2),int64(1)},{int64(0),int64(1),int64(2)},
+				{int64(1),int64(1),int64(7)},
+				{int64(2),int64(3),int64(1)},{int64(2),int64(3),int64(1)},
+			},
+			[]sql.Row{{int64(0),int64(1),int64(7)},{int64(0),int64(2),int64(1)},{int64(1),int64(1),int64(7)},{int64(2),int64(3),int64(2)}},
+			4},
+
+		/* Unclustered input yields a group per run. */
+		{"runs",
+			[]sql.Row{{int64(0),int64(1),int64(1)},{int64(1),int64(1),int64(1)},{int64(0),int64(1),int64(1)}},
+			[]sql.Row{{int64(0),int64(1),int64(1)},{int64(1),int64(1),int64(1)},{int64(0),int64(1),int64(1)}},
+			2},
+	}
+	for _,tt := range tests {
+		child := &rowsNode{schema:schema,rows:tt.rows}
+		g := NewClusterGroupBy([]sql.Expression{colC,colG,&total{expr:colX}},[]sql.Expression{colC},[]sql.Expression{colC,colG},child)
+		iter,err := g.RowIter(sql.NewEmptyContext())
+		if err!=nil { t.Fatal(err) }
+		var got []sql.Row
+		for {
+			row,err := iter.Next()
+			if err==io.EOF { break }
+			if err!=nil { t.Fatalf("%s: %v",tt.name,err) }
+			if got==nil && child.read!=tt.first { t.Errorf("%s: %d rows read before the first group, want %d",tt.name,child.read,tt.first) }
+			got = append(got,row)
+		}
+		iter.Close()
+		if !reflect.DeepEqual(got,tt.want) { t.Errorf("%s: got %v, want %v",tt.name,got,tt.want) }
+	}
+}
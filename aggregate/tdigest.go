@@ -0,0 +1,95 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package aggregate
+
+import "sort"
+
+type Centroid struct{
+	Mean  float64
+	Count float64
+}
+
+/*
+A merging t-digest, used to estimate quantiles. It is the state of percentile()
+and median(). The fields are exported for encoding/gob.
+*/
+type TDigest struct{
+	Compression float64
+	Centroids   []Centroid
+	Unmerged    int
+	Total       float64
+}
+func newTDigest() *TDigest { return &TDigest{Compression:100} }
+
+func (t *TDigest) add(x float64) {
+	t.Centroids = append(t.Centroids,Centroid{x,1})
+	t.Total++
+	t.Unmerged++
+	if t.Unmerged > int(10*t.Compression) { t.compress() }
+}
+func (t *TDigest) merge(o *TDigest) {
+	t.Centroids = append(t.Centroids,o.Centroids...)
+	t.Total += o.Total
+	t.Unmerged += len(o.Centroids)
+	t.compress()
+}
+func (t *TDigest) compress() {
+	t.Unmerged = 0
+	if len(t.Centroids)<2 { return }
+	sort.Slice(t.Centroids,func(i, j int) bool { return t.Centroids[i].Mean<t.Centroids[j].Mean })
+	out := t.Centroids[:1]
+	seen := 0.0
+	for _,c := range t.Centroids[1:] {
+		last := &out[len(out)-1]
+		q := (seen+(last.Count+c.Count)/2)/t.Total
+		limit := 4*t.Total*q*(1-q)/t.Compression
+		if last.Count+c.Count <= limit {
+			last.Mean += (c.Mean-last.Mean)*c.Count/(last.Count+c.Count)
+			last.Count += c.Count
+			continue
+		}
+		seen += last.Count
+		out = append(out,c)
+	}
+	t.Centroids = out
+}
+func (t *TDigest) quantile(q float64) (float64,bool) {
+	if t.Unmerged!=0 { t.compress() }
+	n := len(t.Centroids)
+	switch {
+	case n==0: return 0,false
+	case n==1: return t.Centroids[0].Mean,true
+	}
+	if q<=0 { return t.Centroids[0].Mean,true }
+	if q>=1 { return t.Centroids[n-1].Mean,true }
+	
+	/* Interpolate between the centers of the neighbouring centroids. */
+	target := q*t.Total
+	seen := 0.0
+	for i,c := range t.Centroids {
+		mid := seen+c.Count/2
+		if target < mid {
+			if i==0 { return c.Mean,true }
+			p := t.Centroids[i-1]
+			pmid := seen-p.Count/2
+			return p.Mean+(c.Mean-p.Mean)*(target-pmid)/(mid-pmid),true
+		}
+		seen += c.Count
+	}
+	return t.Centroids[n-1].Mean,true
+}
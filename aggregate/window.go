@@ -0,0 +1,596 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package aggregate
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "github.com/spf13/cast"
+import "fmt"
+import "io"
+import "sort"
+import "strings"
+
+/*
+The functions, that are needed to plan the OVER clause.
+The query package rewrites
+	f(...) OVER (PARTITION BY a ORDER BY b DESC ROWS BETWEEN 1 PRECEDING AND CURRENT ROW)
+into
+	window_over(f(...),partition_by(a),order_by(b,'desc'),window_frame('rows','1 preceding','current row'))
+*/
+var WindowFunctions = sql.Functions{
+	"window_over" :sql.FunctionN(NewWindowOver),
+	"partition_by":sql.FunctionN(NewPartitionBy),
+	"window_frame":sql.FunctionN(NewWindowFrame),
+	"order_by"    :Defaults["order_by"], /* The same as for as_list(...). */
+
+	// Ranking functions
+	"row_number":sql.FunctionN(NewRowNumber),
+	"rank"      :sql.FunctionN(NewRank),
+	"dense_rank":sql.FunctionN(NewDenseRank),
+	"lag"       :sql.FunctionN(NewLag),
+	"lead"      :sql.FunctionN(NewLead),
+}
+
+/*
+A partition of the input rows, sorted by the ORDER BY of the window.
+*/
+type partition struct{
+	rows  []sql.Row
+	keys  [][]interface{} /* The values of the ORDER BY expressions. */
+	peer  []int           /* Index of the first row with the same keys. */
+	end   []int           /* Index after the last row with the same keys. */
+	dense []int           /* Number of distinct keys before the row. */
+}
+
+/*
+A function, that is evaluated over a whole partition rather than over a frame.
+*/
+type windowFunc interface{
+	sql.Expression
+	evalWindow(ctx *sql.Context,p *partition,i int) (interface{}, error)
+}
+
+func exprsString(exprs []sql.Expression) string {
+	s := make([]string,len(exprs))
+	for i,e := range exprs { s[i] = e.String() }
+	return strings.Join(s,",")
+}
+
+/*
+The PARTITION BY clause, only valid as argument of window_over().
+*/
+type PartitionBy []sql.Expression
+
+var _ sql.Expression = (PartitionBy)(nil)
+
+func (p PartitionBy) Resolved() bool {
+	for _,e := range p {
+		if !e.Resolved() { return false }
+	}
+	return true
+}
+func (p PartitionBy) String() string { return "partition_by("+exprsString(p)+")" }
+func (p PartitionBy) Type() sql.Type { return sql.Null }
+func (p PartitionBy) IsNullable() bool { return true }
+func (p PartitionBy) Eval(*sql.Context, sql.Row) (interface{}, error) { return nil,fmt.Errorf("improper use of %v",p) }
+func (p PartitionBy) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	n,err := transformAll(p,st)
+	if err!=nil { return nil,err }
+	return st(PartitionBy(n))
+}
+func (p PartitionBy) Children() []sql.Expression { return p }
+
+func NewPartitionBy(args ...sql.Expression) (sql.Expression, error) { return PartitionBy(args),nil }
+
+/*
+A bound of a window frame. Negative offsets are PRECEDING, positive offsets are FOLLOWING.
+If Unbounded is set, only the sign of the offset is relevant.
+*/
+type FrameBound struct{
+	Unbounded bool
+	Offset    float64
+}
+func (b FrameBound) String() string {
+	switch {
+	case b.Unbounded && b.Offset<0: return "unbounded preceding"
+	case b.Unbounded: return "unbounded following"
+	case b.Offset<0: return fmt.Sprintf("%v preceding",-b.Offset)
+	case b.Offset>0: return fmt.Sprintf("%v following",b.Offset)
+	}
+	return "current row"
+}
+func parseFrameBound(s string) (b FrameBound,err error) {
+	f := strings.Fields(strings.ToLower(s))
+	if len(f)!=2 { return b,fmt.Errorf("invalid frame bound %q",s) }
+	switch f[1] {
+	case "preceding","following":
+	case "row":
+		if f[0]=="current" { return }
+		fallthrough
+	default: return b,fmt.Errorf("invalid frame bound %q",s)
+	}
+	if f[0]=="unbounded" {
+		b.Unbounded = true
+		b.Offset = 1
+	} else {
+		b.Offset,err = cast.ToFloat64E(f[0])
+		if err!=nil || b.Offset<0 { return b,fmt.Errorf("invalid frame bound %q",s) }
+	}
+	if f[1]=="preceding" { b.Offset = -b.Offset }
+	return
+}
+
+/*
+The ROWS or RANGE clause, only valid as argument of window_over().
+*/
+type WindowFrame struct{
+	Range bool
+	Start FrameBound
+	End   FrameBound
+}
+var _ sql.Expression = (*WindowFrame)(nil)
+func (w *WindowFrame) Resolved() bool { return true }
+func (w *WindowFrame) String() string {
+	kind := "rows"
+	if w.Range { kind = "range" }
+	return fmt.Sprintf("window_frame('%s','%v','%v')",kind,w.Start,w.End)
+}
+func (w *WindowFrame) Type() sql.Type { return sql.Null }
+func (w *WindowFrame) IsNullable() bool { return true }
+func (w *WindowFrame) Eval(*sql.Context, sql.Row) (interface{}, error) { return nil,fmt.Errorf("improper use of %v",w) }
+func (w *WindowFrame) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) { return st(w) }
+func (w *WindowFrame) Children() []sql.Expression { return nil }
+
+func NewWindowFrame(args ...sql.Expression) (sql.Expression, error) {
+	if len(args)!=3 { return nil,sql.ErrInvalidArgumentNumber.New(3, len(args)) }
+	s := make([]string,3)
+	for i,arg := range args {
+		lit,ok := arg.(*expression.Literal)
+		if !ok { return nil,fmt.Errorf("expected string literal, got %v",arg) }
+		s[i] = cast.ToString(lit.Value())
+	}
+	w := new(WindowFrame)
+	switch strings.ToLower(s[0]) {
+	case "rows":
+	case "range": w.Range = true
+	default: return nil,fmt.Errorf("expected 'rows' or 'range', got %q",s[0])
+	}
+	var err error
+	w.Start,err = parseFrameBound(s[1])
+	if err!=nil { return nil,err }
+	w.End,err = parseFrameBound(s[2])
+	if err!=nil { return nil,err }
+	if w.Start.Unbounded && w.Start.Offset>0 { return nil,fmt.Errorf("frame can't start at %v",w.Start) }
+	if w.End.Unbounded && w.End.Offset<0 { return nil,fmt.Errorf("frame can't end at %v",w.End) }
+	if !w.Range && (w.Start.Offset!=float64(int64(w.Start.Offset)) || w.End.Offset!=float64(int64(w.End.Offset))) {
+		return nil,fmt.Errorf("ROWS frame requires integer offsets")
+	}
+	return w,nil
+}
+
+/*
+A window function call: f(...) OVER (...).
+Func is either a sql.Aggregation, that is evaluated over the window frame,
+or one of the ranking functions, that is evaluated over the whole partition.
+*/
+type WindowOver struct{
+	Func      sql.Expression
+	Partition []sql.Expression
+	Order     []*OrderBy
+	Frame     *WindowFrame /* nil means the default frame. */
+}
+var _ sql.Expression = (*WindowOver)(nil)
+func (w *WindowOver) Resolved() bool {
+	if !w.Func.Resolved() { return false }
+	for _,e := range w.Partition {
+		if !e.Resolved() { return false }
+	}
+	for _,o := range w.Order {
+		if !o.Resolved() { return false }
+	}
+	return true
+}
+func (w *WindowOver) String() string {
+	s := []string{w.Func.String()}
+	if len(w.Partition)!=0 { s = append(s,PartitionBy(w.Partition).String()) }
+	for _,o := range w.Order { s = append(s,o.String()) }
+	if w.Frame!=nil { s = append(s,w.Frame.String()) }
+	return "window_over("+strings.Join(s,",")+")"
+}
+func (w *WindowOver) Type() sql.Type { return w.Func.Type() }
+func (w *WindowOver) IsNullable() bool { return true }
+func (w *WindowOver) Eval(*sql.Context, sql.Row) (interface{}, error) { return nil,fmt.Errorf("improper use of %v",w) }
+func (w *WindowOver) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	f,err := w.Func.TransformUp(st)
+	if err!=nil { return nil,err }
+	part,err := transformAll(w.Partition,st)
+	if err!=nil { return nil,err }
+	order := make([]*OrderBy,len(w.Order))
+	for i,o := range w.Order {
+		e,err := o.Expr.TransformUp(st)
+		if err!=nil { return nil,err }
+		order[i] = &OrderBy{e,o.Desc}
+	}
+	return st(&WindowOver{f,part,order,w.Frame})
+}
+func (w *WindowOver) Children() []sql.Expression {
+	c := append([]sql.Expression{w.Func},w.Partition...)
+	for _,o := range w.Order { c = append(c,o.Expr) }
+	return c
+}
+
+func NewWindowOver(args ...sql.Expression) (sql.Expression, error) {
+	if len(args)==0 { return nil,sql.ErrInvalidArgumentNumber.New(1, len(args)) }
+	w := &WindowOver{Func:args[0]}
+	for _,arg := range args[1:] {
+		switch v := arg.(type) {
+		case PartitionBy: w.Partition = append(w.Partition,v...)
+		case *OrderBy: w.Order = append(w.Order,v)
+		case *WindowFrame: w.Frame = v
+		default: return nil,fmt.Errorf("expected partition_by(...), order_by(...) or window_frame(...), got %v",arg)
+		}
+	}
+	return w,nil
+}
+
+func (w *WindowOver) check() error {
+	switch w.Func.(type) {
+	case windowFunc,sql.Aggregation:
+	default: return fmt.Errorf("%v is not a window function",w.Func)
+	}
+	if w.Frame!=nil && w.Frame.Range {
+		numeric := !(w.Frame.Start.Offset==0 || w.Frame.Start.Unbounded) || !(w.Frame.End.Offset==0 || w.Frame.End.Unbounded)
+		if numeric && len(w.Order)!=1 { return fmt.Errorf("RANGE frame with offset requires exactly one ORDER BY expression") }
+	}
+	return nil
+}
+
+/* Splits the rows into partitions, in the order of their first appearance. */
+func (w *WindowOver) partitions(ctx *sql.Context,rows []sql.Row) (parts [][]int,err error) {
+	index := make(map[string]int)
+	for i,row := range rows {
+		key := make([]interface{},len(w.Partition))
+		for j,e := range w.Partition {
+			key[j],err = e.Eval(ctx,row)
+			if err!=nil { return }
+		}
+		k := fmt.Sprintf("%#v",key)
+		p,ok := index[k]
+		if !ok {
+			p = len(parts)
+			index[k] = p
+			parts = append(parts,nil)
+		}
+		parts[p] = append(parts[p],i)
+	}
+	return
+}
+
+func (w *WindowOver) compare(x,y []interface{}) int {
+	for i,o := range w.Order {
+		c,_ := o.Expr.Type().Compare(x[i],y[i])
+		if o.Desc { c = -c }
+		if c!=0 { return c }
+	}
+	return 0
+}
+
+/* Sorts the rows of a partition. Sorts the index slice accordingly. */
+func (w *WindowOver) sortPartition(ctx *sql.Context,rows []sql.Row,idx []int) (*partition,error) {
+	keys := make([][]interface{},len(idx))
+	for i,j := range idx {
+		keys[i] = make([]interface{},len(w.Order))
+		for k,o := range w.Order {
+			v,err := o.Expr.Eval(ctx,rows[j])
+			if err!=nil { return nil,err }
+			keys[i][k] = v
+		}
+	}
+	perm := make([]int,len(idx))
+	for i := range perm { perm[i] = i }
+	sort.SliceStable(perm,func(a, b int) bool { return w.compare(keys[perm[a]],keys[perm[b]])<0 })
+
+	p := &partition{
+		rows :make([]sql.Row,len(idx)),
+		keys :make([][]interface{},len(idx)),
+		peer :make([]int,len(idx)),
+		end  :make([]int,len(idx)),
+		dense:make([]int,len(idx)),
+	}
+	sorted := make([]int,len(idx))
+	for i,j := range perm {
+		sorted[i] = idx[j]
+		p.rows[i] = rows[idx[j]]
+		p.keys[i] = keys[j]
+	}
+	copy(idx,sorted)
+
+	for i := range p.rows {
+		if i>0 && w.compare(p.keys[i-1],p.keys[i])==0 {
+			p.peer[i] = p.peer[i-1]
+			p.dense[i] = p.dense[i-1]
+		} else {
+			p.peer[i] = i
+			if i>0 { p.dense[i] = p.dense[i-1]+1 }
+		}
+	}
+	for i := len(p.rows)-1; i>=0; i-- {
+		if i+1<len(p.rows) && p.peer[i+1]==p.peer[i] {
+			p.end[i] = p.end[i+1]
+		} else {
+			p.end[i] = i+1
+		}
+	}
+	return p,nil
+}
+
+/* Computes the first index of a RANGE frame bound. */
+func (w *WindowOver) rangeBound(p *partition,i int,b FrameBound,after bool) (int,error) {
+	if b.Offset==0 {
+		if after { return p.end[i],nil }
+		return p.peer[i],nil
+	}
+	ref,err := cast.ToFloat64E(p.keys[i][0])
+	if err!=nil { return 0,fmt.Errorf("RANGE frame with offset requires a numeric ORDER BY: %v",err) }
+	var ferr error
+	n := sort.Search(len(p.rows),func(j int) bool {
+		v,err := cast.ToFloat64E(p.keys[j][0])
+		if err!=nil { ferr = err }
+		d := v-ref
+		if w.Order[0].Desc { d = -d }
+		if after { return d>b.Offset }
+		return d>=b.Offset
+	})
+	if ferr!=nil { return 0,fmt.Errorf("RANGE frame with offset requires a numeric ORDER BY: %v",ferr) }
+	return n,nil
+}
+
+/* Computes the window frame [lo,hi) of the i-th row. */
+func (w *WindowOver) bounds(p *partition,i int) (lo,hi int,err error) {
+	n := len(p.rows)
+	f := w.Frame
+	if f==nil {
+		if len(w.Order)==0 { return 0,n,nil }
+		return 0,p.end[i],nil
+	}
+	switch {
+	case f.Start.Unbounded: lo = 0
+	case f.Range: lo,err = w.rangeBound(p,i,f.Start,false)
+	default: lo = i+int(f.Start.Offset)
+	}
+	if err!=nil { return }
+	switch {
+	case f.End.Unbounded: hi = n
+	case f.Range: hi,err = w.rangeBound(p,i,f.End,true)
+	default: hi = i+int(f.End.Offset)+1
+	}
+	if lo<0 { lo = 0 }
+	if hi>n { hi = n }
+	if hi<lo { hi = lo }
+	return
+}
+
+/*
+Evaluates the aggregation over the frame of every row. As long as the frames
+share the same start, the aggregation buffer is updated incrementally.
+*/
+func (w *WindowOver) aggregate(ctx *sql.Context,p *partition,res []interface{}) error {
+	a := w.Func.(sql.Aggregation)
+	var buf sql.Row
+	var blo,bhi int
+	for i := range p.rows {
+		lo,hi,err := w.bounds(p,i)
+		if err!=nil { return err }
+		if buf==nil || lo!=blo || hi<bhi {
+			buf = a.NewBuffer()
+			blo,bhi = lo,lo
+		}
+		for ; bhi<hi; bhi++ {
+			err = a.Update(ctx,buf,p.rows[bhi])
+			if err!=nil { return err }
+		}
+		res[i],err = a.Eval(ctx,buf)
+		if err!=nil { return err }
+	}
+	return nil
+}
+
+/* Computes the value of the window function for every row. */
+func (w *WindowOver) compute(ctx *sql.Context,rows []sql.Row) ([]interface{}, error) {
+	err := w.check()
+	if err!=nil { return nil,err }
+	parts,err := w.partitions(ctx,rows)
+	if err!=nil { return nil,err }
+	res := make([]interface{},len(rows))
+	for _,idx := range parts {
+		p,err := w.sortPartition(ctx,rows,idx)
+		if err!=nil { return nil,err }
+		vals := make([]interface{},len(idx))
+		if wf,ok := w.Func.(windowFunc); ok {
+			for i := range vals {
+				vals[i],err = wf.evalWindow(ctx,p,i)
+				if err!=nil { return nil,err }
+			}
+		} else {
+			err = w.aggregate(ctx,p,vals)
+			if err!=nil { return nil,err }
+		}
+		for i,j := range idx { res[j] = vals[i] }
+	}
+	return res,nil
+}
+
+/*
+row_number(), rank() and dense_rank().
+*/
+type RowNumber struct{
+	Name string
+}
+var _ windowFunc = (*RowNumber)(nil)
+func (r *RowNumber) Resolved() bool { return true }
+func (r *RowNumber) String() string { return r.Name+"()" }
+func (r *RowNumber) Type() sql.Type { return sql.Int64 }
+func (r *RowNumber) IsNullable() bool { return false }
+func (r *RowNumber) Eval(*sql.Context, sql.Row) (interface{}, error) { return nil,fmt.Errorf("%v requires an OVER clause",r) }
+func (r *RowNumber) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) { return st(r) }
+func (r *RowNumber) Children() []sql.Expression { return nil }
+func (r *RowNumber) evalWindow(ctx *sql.Context,p *partition,i int) (interface{}, error) {
+	switch r.Name {
+	case "rank": return int64(p.peer[i]+1),nil
+	case "dense_rank": return int64(p.dense[i]+1),nil
+	}
+	return int64(i+1),nil
+}
+
+func newRowNumber(name string,args []sql.Expression) (sql.Expression, error) {
+	if len(args)!=0 { return nil,sql.ErrInvalidArgumentNumber.New(0, len(args)) }
+	return &RowNumber{name},nil
+}
+func NewRowNumber(args ...sql.Expression) (sql.Expression, error) { return newRowNumber("row_number",args) }
+func NewRank(args ...sql.Expression) (sql.Expression, error) { return newRowNumber("rank",args) }
+func NewDenseRank(args ...sql.Expression) (sql.Expression, error) { return newRowNumber("dense_rank",args) }
+
+/*
+lag(expr[,offset[,default]]) and lead(expr[,offset[,default]]).
+*/
+type Lag struct{
+	Expr    sql.Expression
+	Offset  int
+	Default sql.Expression
+	Lead    bool
+}
+var _ windowFunc = (*Lag)(nil)
+func (l *Lag) Resolved() bool { return l.Expr.Resolved() && l.Default.Resolved() }
+func (l *Lag) String() string {
+	name := "lag"
+	if l.Lead { name = "lead" }
+	return fmt.Sprintf("%s(%v,%d,%v)",name,l.Expr,l.Offset,l.Default)
+}
+func (l *Lag) Type() sql.Type { return l.Expr.Type() }
+func (l *Lag) IsNullable() bool { return true }
+func (l *Lag) Eval(*sql.Context, sql.Row) (interface{}, error) { return nil,fmt.Errorf("%v requires an OVER clause",l) }
+func (l *Lag) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	e,err := l.Expr.TransformUp(st)
+	if err!=nil { return nil,err }
+	d,err := l.Default.TransformUp(st)
+	if err!=nil { return nil,err }
+	return st(&Lag{e,l.Offset,d,l.Lead})
+}
+func (l *Lag) Children() []sql.Expression { return []sql.Expression{l.Expr,l.Default} }
+func (l *Lag) evalWindow(ctx *sql.Context,p *partition,i int) (interface{}, error) {
+	j := i-l.Offset
+	if l.Lead { j = i+l.Offset }
+	if j<0 || j>=len(p.rows) { return l.Default.Eval(ctx,p.rows[i]) }
+	return l.Expr.Eval(ctx,p.rows[j])
+}
+
+func newLag(lead bool,args []sql.Expression) (sql.Expression, error) {
+	if len(args)==0 || len(args)>3 { return nil,sql.ErrInvalidArgumentNumber.New(3, len(args)) }
+	l := &Lag{args[0],1,expression.NewLiteral(nil,sql.Null),lead}
+	if len(args)>1 {
+		lit,ok := args[1].(*expression.Literal)
+		if !ok { return nil,fmt.Errorf("expected integer literal, got %v",args[1]) }
+		var err error
+		l.Offset,err = cast.ToIntE(lit.Value())
+		if err!=nil { return nil,err }
+	}
+	if len(args)>2 { l.Default = args[2] }
+	return l,nil
+}
+func NewLag(args ...sql.Expression) (sql.Expression, error) { return newLag(false,args) }
+func NewLead(args ...sql.Expression) (sql.Expression, error) { return newLag(true,args) }
+
+/*
+Evaluates window functions over the rows of its child. Each window function
+adds one column to the end of the child's schema. The rows are emitted in the
+order of the child.
+
+The operator has to see all rows before emitting the first one, so the whole
+input is held in memory.
+*/
+type Window struct{
+	Child   sql.Node
+	Windows []sql.Expression /* Every element is a *WindowOver. */
+}
+var _ sql.Node = (*Window)(nil)
+
+func NewWindow(windows []sql.Expression,child sql.Node) *Window {
+	return &Window{child,windows}
+}
+
+func (w *Window) Resolved() bool { return w.Child.Resolved() }
+func (w *Window) String() string {
+	pr := sql.NewTreePrinter()
+	_ = pr.WriteNode("Window(%s)",exprsString(w.Windows))
+	_ = pr.WriteChildren(w.Child.String())
+	return pr.String()
+}
+func (w *Window) Schema() sql.Schema {
+	s := append(sql.Schema(nil),w.Child.Schema()...)
+	return append(s,aggregateSchema(w.Windows)...)
+}
+func (w *Window) Children() []sql.Node { return []sql.Node{w.Child} }
+func (w *Window) TransformUp(f sql.TransformNodeFunc) (sql.Node, error) {
+	child,err := w.Child.TransformUp(f)
+	if err!=nil { return nil,err }
+	return f(NewWindow(w.Windows,child))
+}
+func (w *Window) TransformExpressionsUp(f sql.TransformExprFunc) (sql.Node, error) {
+	child,err := w.Child.TransformExpressionsUp(f)
+	if err!=nil { return nil,err }
+	windows,err := transformAll(w.Windows,f)
+	if err!=nil { return nil,err }
+	return NewWindow(windows,child),nil
+}
+func (w *Window) RowIter(ctx *sql.Context) (sql.RowIter, error) {
+	i,err := w.Child.RowIter(ctx)
+	if err!=nil { return nil,err }
+	var rows []sql.Row
+	for {
+		row,err := i.Next()
+		if err==io.EOF { break }
+		if err!=nil { i.Close(); return nil,err }
+		rows = append(rows,row)
+	}
+	err = i.Close()
+	if err!=nil { return nil,err }
+
+	out := make([]sql.Row,len(rows))
+	for j,row := range rows {
+		out[j] = append(make(sql.Row,0,len(row)+len(w.Windows)),row...)
+	}
+	for _,e := range w.Windows {
+		wo,ok := e.(*WindowOver)
+		if !ok { return nil,fmt.Errorf("not a window function: %v",e) }
+		vals,err := wo.compute(ctx,rows)
+		if err!=nil { return nil,err }
+		for j,v := range vals { out[j] = append(out[j],v) }
+	}
+	return &windowIter{out},nil
+}
+
+type windowIter struct{
+	rows []sql.Row
+}
+func (wi *windowIter) Next() (sql.Row, error) {
+	if len(wi.rows)==0 { return nil,io.EOF }
+	row := wi.rows[0]
+	wi.rows = wi.rows[1:]
+	return row,nil
+}
+func (wi *windowIter) Close() error { return nil }
@@ -20,6 +20,8 @@ package api
 import "io"
 import "reflect"
 import "fmt"
+import "sort"
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
 
 type Row []interface{}
 type RowIter interface{
@@ -33,10 +35,188 @@ type RowSource interface{
 	Lookup(i ... interface{}) (RowIter,error)
 }
 
+/*
+Optional interface for RowSources, that can restrict the set of columns being transferred.
+Project returns a RowSource containing only the given columns, in the given order.
+It returns an error, if one of the names isn't a column of the RowSource.
+*/
+type ProjectableSource interface{
+	RowSource
+	Project(names []string) (RowSource,error)
+}
+
+/*
+Optional interface for RowSources, that can evaluate filter expressions themselves.
+CanPush reports whether the source is able to evaluate the given expression.
+Accepted expressions are passed to Lookup as SpecExpr.
+
+Column references are *expression.GetField values, that are identified by their Name().
+Sub-expressions without any column references are turned into *expression.Literal
+before being passed to Lookup.
+*/
+type FilterableSource interface{
+	RowSource
+	CanPush(expr sql.Expression) bool
+}
+
+/*
+Optional interface for RowSources, that can return their rows in a given order.
+CanOrder reports whether the source is able to sort by the given columns.
+If so, the ordering is passed to Lookup as a sequence of SpecOrder values.
+*/
+type OrderedSource interface{
+	RowSource
+	CanOrder(order []SpecOrder) bool
+}
+
+/*
+Optional interface for RowSources, whose schema can change over time.
+SchemaVersion returns a different value after every change of Names() or Types(),
+so that cached query plans, that were built against the old schema, are discarded.
+*/
+type VersionedSource interface{
+	RowSource
+	SchemaVersion() uint64
+}
+
+/*
+Optional interface for RowSources, that can compute grouped aggregates.
+Aggregate returns one row per group (or multiple partial rows per group, which are
+merged by the caller using AggrFunc.Merge). Each row consists of the group columns,
+followed by the aggregates. The specs are the same as for Lookup.
+*/
+type AggregatingSource interface{
+	RowSource
+	CanAggregate(groups []string,aggrs []AggrFunc) bool
+	Aggregate(groups []string,aggrs []AggrFunc,specs ...interface{}) (RowIter,error)
+}
+
 type DataSource interface{
 	GetSource(name string) RowSource
 }
 
+/*
+Optional interface for DataSources, that can list their tables.
+ListTables returns the names of the tables, sorted.
+*/
+type ListableSource interface{
+	DataSource
+	ListTables() []string
+}
+
+/*
+Optional interface for NamespacedSources, that can list their namespaces.
+ListNamespaces returns the names of the namespaces, sorted.
+*/
+type ListableNamespaces interface{
+	NamespacedSource
+	ListNamespaces() []string
+}
+
+/*
+Optional interface for DataSources, that define views. GetView returns the SELECT
+statement of the view with the given name, or "" if there is no such view.
+Views take precedence over tables of the same name.
+*/
+type ViewSource interface{
+	DataSource
+	GetView(name string) string
+}
+
+/*
+Extended metadata of a column. DatabaseType is the type, as declared by the
+underlying database, if any.
+*/
+type ColumnInfo struct{
+	Name         string
+	Type         reflect.Type
+	Nullable     bool
+	DatabaseType string
+}
+
+/*
+Optional interface for RowSources, that know more about their columns than
+Names() and Types() tell. Columns returns one entry per column, in the same order.
+*/
+type DescribedSource interface{
+	RowSource
+	Columns() []ColumnInfo
+}
+
+/*
+Returns the metadata of the columns of the RowSource. Columns are nullable,
+unless the RowSource is a DescribedSource, that says otherwise.
+*/
+func Describe(src RowSource) []ColumnInfo {
+	if ds,ok := src.(DescribedSource); ok { return ds.Columns() }
+	names := src.Names()
+	types := src.Types()
+	cols := make([]ColumnInfo,len(names))
+	for i,name := range names {
+		cols[i] = ColumnInfo{Name:name,Type:types[i],Nullable:true}
+	}
+	return cols
+}
+
+/*
+Optional interface for DataSources, that contain nested namespaces, such as the
+catalogs and schemas of a federation of databases. GetNamespace returns the
+namespace with the given name, or nil.
+
+A table named catalog.schema.table in a query is resolved as
+ds.GetNamespace("catalog").GetNamespace("schema").GetSource("table").
+*/
+type NamespacedSource interface{
+	DataSource
+	GetNamespace(name string) DataSource
+}
+
+/*
+Resolves a qualified table name. The last element of the path is the table name,
+the others name the namespaces. Returns nil, if there is no such table.
+*/
+func Resolve(ds DataSource,path ...string) RowSource {
+	if len(path)==0 { return nil }
+	for _,name := range path[:len(path)-1] {
+		ns,ok := ds.(NamespacedSource)
+		if !ok { return nil }
+		ds = ns.GetNamespace(name)
+		if ds==nil { return nil }
+	}
+	return ds.GetSource(path[len(path)-1])
+}
+
+/*
+A DataSource consisting of named namespaces. The unqualified table names are
+resolved by Default, if not nil.
+*/
+type Namespaces struct{
+	Default DataSource
+	Spaces  map[string]DataSource
+}
+var _ ListableNamespaces = (*Namespaces)(nil)
+var _ ListableSource = (*Namespaces)(nil)
+func (n *Namespaces) GetSource(name string) RowSource {
+	if n.Default==nil { return nil }
+	return n.Default.GetSource(name)
+}
+func (n *Namespaces) GetNamespace(name string) DataSource {
+	ds,ok := n.Spaces[name]
+	if !ok { return nil }
+	return ds
+}
+func (n *Namespaces) ListTables() []string {
+	ls,ok := n.Default.(ListableSource)
+	if !ok { return nil }
+	return ls.ListTables()
+}
+func (n *Namespaces) ListNamespaces() []string {
+	names := make([]string,0,len(n.Spaces))
+	for name := range n.Spaces { names = append(names,name) }
+	sort.Strings(names)
+	return names
+}
+
 /*
 Array-spec.
 ${Column} = any(${Values}).
@@ -51,8 +231,56 @@ type SpecSingle struct{
 	Value  interface{}
 }
 
+/*
+Filter-spec.
+The expression must evaluate to true.
+*/
+type SpecExpr struct{
+	Expr sql.Expression
+}
+
+/*
+Limit-spec.
+The caller needs no more than N rows. Sources may ignore this hint.
+*/
+type SpecLimit struct{
+	N int64
+}
+
+/*
+Order-spec.
+Multiple SpecOrder values are applied in the order of their appearance.
+*/
+type SpecOrder struct{
+	Column string
+	Desc   bool
+}
+
+/*
+Aggregate function.
+Func is one of "count", "sum", "min" or "max". Column is empty for count(*).
+*/
+type AggrFunc struct{
+	Func   string
+	Column string
+}
+
+/*
+Returns the function, that merges two partial states of this aggregate.
+*/
+func (a AggrFunc) Merge() string {
+	if a.Func=="count" { return "sum" }
+	return a.Func
+}
+
 type DataSourceImpl map[string]RowSource
 func (dsi DataSourceImpl) GetSource(name string) RowSource { return dsi[name] }
+func (dsi DataSourceImpl) ListTables() []string {
+	names := make([]string,0,len(dsi))
+	for name := range dsi { names = append(names,name) }
+	sort.Strings(names)
+	return names
+}
 
 type MockTable struct{
 	ItsNames []string
@@ -0,0 +1,46 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package api
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+
+/*
+Reports whether the expression references any column.
+*/
+func HasFields(expr sql.Expression) bool {
+	if _,ok := expr.(*expression.GetField); ok { return true }
+	for _,subex := range expr.Children() {
+		if HasFields(subex) { return true }
+	}
+	return false
+}
+
+/*
+Replaces every column-free sub-expression by its value. This is done before an
+expression is passed to a RowSource as SpecExpr.
+*/
+func BindLiterals(ctx *sql.Context,expr sql.Expression) (sql.Expression, error) {
+	return expr.TransformUp(func(e sql.Expression) (sql.Expression, error) {
+		if _,ok := e.(*expression.Literal); ok { return e,nil }
+		if HasFields(e) { return e,nil }
+		val,err := e.Eval(ctx,nil)
+		if err!=nil { return nil,err }
+		return expression.NewLiteral(val,e.Type()),nil
+	})
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package memsrc
+
+import "github.com/mad-day/datajoin/api"
+import "encoding/csv"
+import "fmt"
+import "io"
+import "os"
+import "reflect"
+import "strconv"
+
+/*
+Guesses the type of a CSV column: int64, float64, bool or string.
+Empty fields are ignored.
+*/
+func inferType(records [][]string,col int) reflect.Type {
+	isInt,isFloat,isBool := true,true,true
+	for _,rec := range records {
+		s := rec[col]
+		if s=="" { continue }
+		if isInt {
+			if _,err := strconv.ParseInt(s,10,64); err!=nil { isInt = false }
+		}
+		if isFloat {
+			if _,err := strconv.ParseFloat(s,64); err!=nil { isFloat = false }
+		}
+		if isBool {
+			if _,err := strconv.ParseBool(s); err!=nil { isBool = false }
+		}
+	}
+	switch {
+	case isInt: return tInt64
+	case isFloat: return tFloat64
+	case isBool: return tBool
+	}
+	return tString
+}
+
+/*
+Reads a CSV document, whose first record contains the column names.
+The types of the columns are taken from types, if present, or else guessed
+from the values. Empty fields of non-string columns become NULL.
+*/
+func ReadCSV(r io.Reader,types map[string]reflect.Type) (*Table,error) {
+	cr := csv.NewReader(r)
+	header,err := cr.Read()
+	if err==io.EOF { return nil,fmt.Errorf("memsrc: missing CSV header") }
+	if err!=nil { return nil,err }
+	records,err := cr.ReadAll()
+	if err!=nil { return nil,err }
+	
+	tps := make([]reflect.Type,len(header))
+	for i,name := range header {
+		t,ok := types[name]
+		if !ok { t = inferType(records,i) }
+		tps[i] = t
+	}
+	t := NewTable(header,tps)
+	t.rows = make([]api.Row,0,len(records))
+	for n,rec := range records {
+		row := make(api.Row,len(rec))
+		for i,s := range rec {
+			if s=="" && tps[i]!=tString { continue }
+			v,err := Convert(tps[i],s)
+			if err!=nil { return nil,fmt.Errorf("memsrc: line %d, column %q: %v",n+2,header[i],err) }
+			row[i] = v
+		}
+		t.rows = append(t.rows,row)
+	}
+	return t,nil
+}
+
+/* Loads a CSV file. See ReadCSV. */
+func LoadCSV(path string,types map[string]reflect.Type) (*Table,error) {
+	f,err := os.Open(path)
+	if err!=nil { return nil,err }
+	defer f.Close()
+	return ReadCSV(f,types)
+}
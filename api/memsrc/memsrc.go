@@ -0,0 +1,191 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+/*
+In-memory RowSources, and a loader for CSV files.
+*/
+package memsrc
+
+import "github.com/mad-day/datajoin/api"
+import "github.com/spf13/cast"
+import "fmt"
+import "reflect"
+import "sync"
+import "time"
+
+var (
+	tInt64   = reflect.TypeOf(int64(0))
+	tFloat64 = reflect.TypeOf(float64(0))
+	tString  = reflect.TypeOf("")
+	tBool    = reflect.TypeOf(false)
+	tTime    = reflect.TypeOf(time.Time{})
+	tBytes   = reflect.TypeOf([]byte(nil))
+)
+
+/*
+A table, that keeps its rows in memory. It is safe for concurrent use.
+Lookups scan the whole table.
+*/
+type Table struct{
+	ColNames []string
+	ColTypes []reflect.Type
+
+	lock sync.RWMutex
+	rows []api.Row
+}
+var _ api.RowSource = (*Table)(nil)
+
+func NewTable(names []string,types []reflect.Type) *Table {
+	return &Table{ColNames:names,ColTypes:types}
+}
+
+func (t *Table) Names() []string { return t.ColNames }
+func (t *Table) Types() []reflect.Type { return t.ColTypes }
+
+/* Appends a row. The values are converted into the types of the columns. */
+func (t *Table) Insert(values ...interface{}) error {
+	if len(values)!=len(t.ColNames) { return fmt.Errorf("memsrc: expected %d values, got %d",len(t.ColNames),len(values)) }
+	row := make(api.Row,len(values))
+	for i,v := range values {
+		c,err := Convert(t.ColTypes[i],v)
+		if err!=nil { return fmt.Errorf("memsrc: column %q: %v",t.ColNames[i],err) }
+		row[i] = c
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.rows = append(t.rows,row)
+	return nil
+}
+
+/* Returns the number of rows. */
+func (t *Table) Len() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return len(t.rows)
+}
+
+/*
+Converts a value into the given column type: int64, float64, string, bool,
+time.Time or []byte. Values of other types are returned as they are.
+*/
+func Convert(t reflect.Type,v interface{}) (interface{},error) {
+	if v==nil { return nil,nil }
+	switch t {
+	case tInt64: return cast.ToInt64E(v)
+	case tFloat64: return cast.ToFloat64E(v)
+	case tString: return cast.ToStringE(v)
+	case tBool: return cast.ToBoolE(v)
+	case tTime: return cast.ToTimeE(v)
+	case tBytes:
+		if b,ok := v.([]byte); ok { return b,nil }
+		s,err := cast.ToStringE(v)
+		return []byte(s),err
+	}
+	return v,nil
+}
+
+/*
+Returns the map key for a value of the given column type. NULL never matches.
+*/
+func key(t reflect.Type,v interface{}) (interface{},bool) {
+	c,err := Convert(t,v)
+	if err!=nil || c==nil { return nil,false }
+	switch x := c.(type) {
+	case []byte: return string(x),true
+	case time.Time: return x.UnixNano(),true
+	}
+	if !reflect.TypeOf(c).Comparable() { return nil,false }
+	return c,true
+}
+
+type filter struct{
+	col int
+	set map[interface{}]bool
+}
+
+func (t *Table) column(name string) int {
+	for i,n := range t.ColNames {
+		if n==name { return i }
+	}
+	return -1
+}
+
+func (t *Table) Lookup(specs ... interface{}) (api.RowIter,error) {
+	var filters []filter
+	var limit int64
+	add := func(col string,values []interface{}) error {
+		i := t.column(col)
+		if i<0 { return fmt.Errorf("memsrc: unknown column %q",col) }
+		f := filter{i,make(map[interface{}]bool,len(values))}
+		for _,v := range values {
+			if k,ok := key(t.ColTypes[i],v); ok { f.set[k] = true }
+		}
+		filters = append(filters,f)
+		return nil
+	}
+	for _,spec := range specs {
+		var err error
+		switch v := spec.(type) {
+		case api.Spec:
+			var values []interface{}
+			if rv := reflect.ValueOf(v.Values); rv.Kind()==reflect.Slice {
+				values = make([]interface{},rv.Len())
+				for i := range values { values[i] = rv.Index(i).Interface() }
+			}
+			err = add(v.Column,values)
+		case api.SpecSingle:
+			err = add(v.Column,[]interface{}{v.Value})
+		case api.SpecLimit:
+			limit = v.N
+		}
+		if err!=nil { return nil,err }
+	}
+	t.lock.RLock()
+	rows := t.rows
+	t.lock.RUnlock()
+	return &rowIter{t:t,rows:rows,filters:filters,limit:limit,pos:-1},nil
+}
+
+type rowIter struct{
+	t       *Table
+	rows    []api.Row
+	filters []filter
+	limit   int64
+	count   int64
+	pos     int
+}
+func (r *rowIter) Close() error { return nil }
+func (r *rowIter) match(row api.Row) bool {
+	for _,f := range r.filters {
+		k,ok := key(r.t.ColTypes[f.col],row[f.col])
+		if !ok || !f.set[k] { return false }
+	}
+	return true
+}
+func (r *rowIter) Next() bool {
+	if r.limit>0 && r.count>=r.limit { return false }
+	for r.pos++; r.pos<len(r.rows); r.pos++ {
+		if r.match(r.rows[r.pos]) {
+			r.count++
+			return true
+		}
+	}
+	return false
+}
+func (r *rowIter) Fetch() (api.Row,error) {
+	return append(api.Row(nil),r.rows[r.pos]...),nil
+}
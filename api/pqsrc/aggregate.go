@@ -0,0 +1,93 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package pqsrc
+
+import "github.com/mad-day/datajoin/api"
+import "database/sql"
+import "bytes"
+import "fmt"
+
+var _ api.AggregatingSource = (*PqRowSource)(nil)
+
+func (p *PqRowSource) column(name string) int {
+	for i,col := range p.ColNames {
+		if col==name { return i }
+	}
+	return -1
+}
+
+func (p *PqRowSource) CanAggregate(groups []string,aggrs []api.AggrFunc) bool {
+	for _,g := range groups {
+		if p.column(g)<0 { return false }
+	}
+	for _,a := range aggrs {
+		switch a.Func {
+		case "count":
+			if a.Column=="" { continue }
+		case "sum","min","max":
+		default: return false
+		}
+		if p.column(a.Column)<0 { return false }
+	}
+	return true
+}
+
+func (p *PqRowSource) Aggregate(groups []string,aggrs []api.AggrFunc,specs ...interface{}) (api.RowIter,error) {
+	if !p.CanAggregate(groups,aggrs) { return nil,fmt.Errorf("pqsrc: unsupported aggregation") }
+	b := new(bytes.Buffer)
+	scanit := make([]interface{},0,len(groups)+len(aggrs))
+	sel := "select"
+	for _,g := range groups {
+		fmt.Fprintf(b,"%s %q",sel,g)
+		sel = ","
+		scanit = append(scanit,p.Scanit[p.column(g)])
+	}
+	for _,a := range aggrs {
+		switch {
+		case a.Column=="":
+			fmt.Fprintf(b,"%s count(*)",sel)
+			scanit = append(scanit,new(int64))
+		case a.Func=="count":
+			fmt.Fprintf(b,"%s count(%q)",sel,a.Column)
+			scanit = append(scanit,new(int64))
+		case a.Func=="sum":
+			/* The sum of no non-NULL values is NULL. */
+			fmt.Fprintf(b,"%s sum(%q)::float8",sel,a.Column)
+			scanit = append(scanit,new(sql.NullFloat64))
+		default:
+			/* min() and max() are NULL, if there are no non-NULL values. */
+			fmt.Fprintf(b,"%s %s(%q)",sel,a.Func,a.Column)
+			switch p.Scanit[p.column(a.Column)].(type) {
+			case *float64,*sql.NullFloat64: b.WriteString("::float8")
+			}
+			scanit = append(scanit,new(interface{}))
+		}
+		sel = ","
+	}
+	fmt.Fprintf(b," from %s",p.From)
+	res,err := writeWhere(b,specs)
+	if err!=nil { return nil,err }
+	sel = " group by"
+	for _,g := range groups {
+		fmt.Fprintf(b,"%s %q",sel,g)
+		sel = ","
+	}
+	rows,err := p.Src.Query(b.String(),res...)
+	if err!=nil { return nil,err }
+	return &PqRowIter{rows,clonearray(scanit)},nil
+}
@@ -0,0 +1,132 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package pqsrc
+
+import "github.com/mad-day/datajoin/api"
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "bytes"
+import "fmt"
+
+var _ api.FilterableSource = (*PqRowSource)(nil)
+
+/*
+Translates sql.Expression trees into PostgreSQL expressions with bind parameters.
+*/
+type translator struct{
+	b    *bytes.Buffer
+	args []interface{}
+}
+func (t *translator) bind(v interface{}) {
+	t.args = append(t.args,convertArray(v))
+	fmt.Fprintf(t.b,"$%d",len(t.args))
+}
+func (t *translator) binary(op string,l,r sql.Expression) error {
+	t.b.WriteString("(")
+	if err := t.expr(l); err!=nil { return err }
+	fmt.Fprintf(t.b," %s ",op)
+	if err := t.expr(r); err!=nil { return err }
+	t.b.WriteString(")")
+	return nil
+}
+
+/*
+Like binary, but compares text byte-wise (as the join does), regardless of the
+collation of the column.
+*/
+func (t *translator) compare(op string,l,r sql.Expression) error {
+	if l.Type()!=sql.Text && r.Type()!=sql.Text { return t.binary(op,l,r) }
+	
+	/* The collation goes to the column side. The parameters have no type yet. */
+	_,llit := l.(*expression.Literal)
+	t.b.WriteString("(")
+	if err := t.expr(l); err!=nil { return err }
+	if !llit { t.b.WriteString(` collate "C"`) }
+	fmt.Fprintf(t.b," %s ",op)
+	if err := t.expr(r); err!=nil { return err }
+	if llit { t.b.WriteString(` collate "C"`) }
+	t.b.WriteString(")")
+	return nil
+}
+func (t *translator) expr(e sql.Expression) error {
+	switch v := e.(type) {
+	case *expression.GetField:
+		fmt.Fprintf(t.b,"%q",v.Name())
+		return nil
+	case *expression.Literal:
+		t.bind(v.Value())
+		return nil
+	case *expression.Equals: return t.binary("=",v.Left(),v.Right())
+	case *expression.LessThan: return t.compare("<",v.Left(),v.Right())
+	case *expression.LessThanOrEqual: return t.compare("<=",v.Left(),v.Right())
+	case *expression.GreaterThan: return t.compare(">",v.Left(),v.Right())
+	case *expression.GreaterThanOrEqual: return t.compare(">=",v.Left(),v.Right())
+	case *expression.And: return t.binary("and",v.Left,v.Right)
+	case *expression.Or: return t.binary("or",v.Left,v.Right)
+	case *expression.Not:
+		t.b.WriteString("(not ")
+		if err := t.expr(v.Child); err!=nil { return err }
+		t.b.WriteString(")")
+		return nil
+	case *expression.IsNull:
+		t.b.WriteString("(")
+		if err := t.expr(v.Child); err!=nil { return err }
+		t.b.WriteString(" is null)")
+		return nil
+	case *expression.In:
+		tup,ok := v.Right().(expression.Tuple)
+		if !ok { break }
+		t.b.WriteString("(")
+		if err := t.expr(v.Left()); err!=nil { return err }
+		t.b.WriteString(" in (")
+		for i,elem := range tup {
+			if i!=0 { t.b.WriteString(",") }
+			if err := t.expr(elem); err!=nil { return err }
+		}
+		t.b.WriteString("))")
+		return nil
+	}
+	
+	/*
+	Column-free expressions are evaluated by the join before the Lookup.
+	This is just a fallback.
+	*/
+	if !api.HasFields(e) {
+		val,err := e.Eval(sql.NewEmptyContext(),nil)
+		if err!=nil { return err }
+		t.bind(val)
+		return nil
+	}
+	return fmt.Errorf("pqsrc: can't translate %v",e)
+}
+
+func (p *PqRowSource) CanPush(expr sql.Expression) bool {
+	t := &translator{b:new(bytes.Buffer)}
+	
+	/*
+	Only check the structure. The column-free parts can always be bound,
+	except for the tuples of IN, which are translated element by element.
+	*/
+	chk,err := expr.TransformUp(func(e sql.Expression) (sql.Expression,error) {
+		if api.HasFields(e) { return e,nil }
+		if _,ok := e.(expression.Tuple); ok { return e,nil }
+		return expression.NewLiteral(nil,e.Type()),nil
+	})
+	if err!=nil { return false }
+	return t.expr(chk)==nil
+}
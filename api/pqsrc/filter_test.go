@@ -0,0 +1,83 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package pqsrc
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "bytes"
+import "reflect"
+import "testing"
+
+func lit(v interface{},t sql.Type) sql.Expression { return expression.NewLiteral(v,t) }
+
+func TestTranslate(t *testing.T) {
+	tests := []struct{
+		expr sql.Expression
+		sql  string
+		args []interface{}
+	}{
+		{expression.NewEquals(fId,lit(int64(5),sql.Int64)),`("id" = $1)`,[]interface{}{int64(5)}},
+
+		/* Text is compared byte-wise. The collation goes to the column side. */
+		{expression.NewLessThan(fName,lit("b",sql.Text)),`("name" collate "C" < $1)`,[]interface{}{"b"}},
+		{expression.NewGreaterThanOrEqual(lit("b",sql.Text),fName),`($1 >= "name" collate "C")`,[]interface{}{"b"}},
+		{expression.NewLessThanOrEqual(fPrice,lit(2.5,sql.Float64)),`("price" <= $1)`,[]interface{}{2.5}},
+
+		/* NULL is bound as a parameter. "= NULL" matches no row, in PostgreSQL as in the join. */
+		{expression.NewEquals(fName,lit(nil,sql.Text)),`("name" = $1)`,[]interface{}{nil}},
+		{expression.NewIsNull(fName),`("name" is null)`,nil},
+		{expression.NewNot(expression.NewIsNull(fPrice)),`(not ("price" is null))`,nil},
+
+		{expression.NewAnd(expression.NewIsNull(fName),expression.NewOr(expression.NewEquals(fId,lit(int64(1),sql.Int64)),expression.NewEquals(fId,lit(int64(2),sql.Int64)))),
+			`(("name" is null) and (("id" = $1) or ("id" = $2)))`,[]interface{}{int64(1),int64(2)}},
+		{expression.NewIn(fId,expression.NewTuple(lit(int64(1),sql.Int64),lit(int64(2),sql.Int64),lit(int64(3),sql.Int64))),
+			`("id" in ($1,$2,$3))`,[]interface{}{int64(1),int64(2),int64(3)}},
+		{expression.NewEquals(fId,lit([]int64{1,2},sql.Array(sql.Int64))),`("id" = $1)`,[]interface{}{convertArray([]int64{1,2})}},
+	}
+	for _,tt := range tests {
+		tr := &translator{b:new(bytes.Buffer)}
+		if err := tr.expr(tt.expr); err!=nil { t.Errorf("%v: %v",tt.expr,err); continue }
+		if got := tr.b.String(); got!=tt.sql { t.Errorf("%v: got %s, want %s",tt.expr,got,tt.sql) }
+		if !reflect.DeepEqual(tr.args,tt.args) { t.Errorf("%v: args %#v, want %#v",tt.expr,tr.args,tt.args) }
+	}
+}
+
+func TestCanPush(t *testing.T) {
+	tests := []struct{
+		expr sql.Expression
+		can  bool
+	}{
+		{expression.NewEquals(fId,lit(int64(5),sql.Int64)),true},
+		{expression.NewIsNull(fName),true},
+		{expression.NewIn(fId,expression.NewTuple(lit(int64(1),sql.Int64))),true},
+
+		/* Column-free parts are bound by the join before the Lookup. */
+		{expression.NewLessThan(fId,expression.NewNot(lit(true,sql.Boolean))),true},
+
+		/* Patterns differ in syntax and case folding, so they stay in the join. */
+		{expression.NewRegexp(fName,lit("^a",sql.Text)),false},
+		{expression.NewAnd(expression.NewIsNull(fName),expression.NewRegexp(fName,lit("^a",sql.Text))),false},
+
+		/* IN over a column can't be pushed. */
+		{expression.NewIn(fId,fPrice),false},
+	}
+	_,src := testSource()
+	for _,tt := range tests {
+		if can := src.CanPush(tt.expr); can!=tt.can { t.Errorf("CanPush(%v) = %v, want %v",tt.expr,can,tt.can) }
+	}
+}
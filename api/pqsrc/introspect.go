@@ -0,0 +1,226 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package pqsrc
+
+import "github.com/mad-day/datajoin/api"
+import "database/sql"
+import "encoding/json"
+import "fmt"
+import "github.com/lib/pq"
+import "reflect"
+import "sort"
+import "sync"
+import "time"
+
+/*
+Scan target for json and jsonb columns. The value is decoded using encoding/json.
+*/
+type JsonValue struct{
+	Value interface{}
+}
+func (j *JsonValue) Scan(src interface{}) error {
+	j.Value = nil
+	var b []byte
+	switch v := src.(type) {
+	case nil: return nil
+	case []byte: b = v
+	case string: b = []byte(v)
+	default: return fmt.Errorf("pqsrc: can't scan %T into JsonValue",src)
+	}
+	return json.Unmarshal(b,&j.Value)
+}
+
+var (
+	tInt64Array   = reflect.TypeOf(pq.Int64Array(nil))
+	tFloat64Array = reflect.TypeOf(pq.Float64Array(nil))
+	tBoolArray    = reflect.TypeOf(pq.BoolArray(nil))
+	tByteaArray   = reflect.TypeOf(pq.ByteaArray(nil))
+	tStringArray  = reflect.TypeOf(pq.StringArray(nil))
+	tJsonValue    = reflect.TypeOf(JsonValue{})
+	tInterface    = reflect.TypeOf([]interface{}{}).Elem()
+	tString       = reflect.TypeOf("")
+	tNullInt64    = reflect.TypeOf(sql.NullInt64{})
+	tNullFloat64  = reflect.TypeOf(sql.NullFloat64{})
+	tNullBool     = reflect.TypeOf(sql.NullBool{})
+	tNullString   = reflect.TypeOf(sql.NullString{})
+	tNullTime     = reflect.TypeOf(pq.NullTime{})
+)
+
+/* Maps the type of a scan target to the type, PqRowIter.Fetch() returns. */
+func fetchType(t reflect.Type) reflect.Type {
+	switch t {
+	case tInt64Array: return reflect.TypeOf([]int64(nil))
+	case tFloat64Array: return reflect.TypeOf([]float64(nil))
+	case tBoolArray: return reflect.TypeOf([]bool(nil))
+	case tByteaArray: return reflect.TypeOf([][]byte(nil))
+	case tStringArray: return reflect.TypeOf([]string(nil))
+	case tJsonValue: return tInterface
+	case tNullInt64: return reflect.TypeOf(int64(0))
+	case tNullFloat64: return reflect.TypeOf(float64(0))
+	case tNullBool: return reflect.TypeOf(false)
+	case tNullString: return tString
+	case tNullTime: return reflect.TypeOf(time.Time{})
+	}
+	return t
+}
+
+/*
+Returns a new scan target for the given PostgreSQL type name (as in pg_type.typname
+or information_schema.columns.udt_name). Array types are prefixed with an underscore.
+Money is returned as text (such as "$1,234.00"), as PostgreSQL formats it.
+*/
+func ScanTarget(udt string) interface{} {
+	switch udt {
+	case "int2","int4","int8","oid": return new(int64)
+	case "float4","float8","numeric": return new(float64)
+	case "bool": return new(bool)
+	case "text","varchar","bpchar","char","name","uuid","citext","inet","cidr","interval","money": return new(string)
+	case "bytea": return new([]byte)
+	case "timestamp","timestamptz","date","time","timetz": return new(time.Time)
+	case "json","jsonb": return new(JsonValue)
+	case "_int2","_int4","_int8","_oid": return new(pq.Int64Array)
+	case "_float4","_float8","_numeric": return new(pq.Float64Array)
+	case "_bool": return new(pq.BoolArray)
+	case "_bytea": return new(pq.ByteaArray)
+	case "_text","_varchar","_bpchar","_char","_name","_uuid","_citext": return new(pq.StringArray)
+	}
+	return new(interface{})
+}
+
+/*
+Like ScanTarget, but returns a scan target, that accepts NULL, for the scalar types.
+PqRowIter.Fetch() returns nil for NULL.
+*/
+func NullScanTarget(udt string) interface{} {
+	switch t := ScanTarget(udt).(type) {
+	case *int64: return new(sql.NullInt64)
+	case *float64: return new(sql.NullFloat64)
+	case *bool: return new(sql.NullBool)
+	case *string: return new(sql.NullString)
+	case *time.Time: return new(pq.NullTime)
+	default: return t
+	}
+}
+
+/*
+Creates a PqRowSource for the table or view "schema"."table" by querying information_schema.
+*/
+func Introspect(src *sql.DB,schema,table string) (*PqRowSource,error) {
+	p,err := introspect(src,schema,table)
+	if err!=nil { return nil,err }
+	if p==nil { return nil,fmt.Errorf("pqsrc: no such table %q.%q",schema,table) }
+	return p,nil
+}
+func introspect(src *sql.DB,schema,table string) (*PqRowSource,error) {
+	rows,err := src.Query(`select column_name, udt_name, is_nullable = 'YES' from information_schema.columns where table_schema = $1 and table_name = $2 order by ordinal_position`,schema,table)
+	if err!=nil { return nil,err }
+	defer rows.Close()
+	var cols []string
+	var scanit []interface{}
+	var info []api.ColumnInfo
+	for rows.Next() {
+		var col,udt string
+		var nullable bool
+		err = rows.Scan(&col,&udt,&nullable)
+		if err!=nil { return nil,err }
+		cols = append(cols,col)
+		if nullable {
+			scanit = append(scanit,NullScanTarget(udt))
+		} else {
+			scanit = append(scanit,ScanTarget(udt))
+		}
+		info = append(info,api.ColumnInfo{Name:col,Nullable:nullable,DatabaseType:udt})
+	}
+	err = rows.Err()
+	if err!=nil { return nil,err }
+	if len(cols)==0 { return nil,nil }
+	p := newRowSource(src,fmt.Sprintf("%q.%q",schema,table),cols,scanit)
+	for i := range info { info[i].Type = p.ColTypes[i] }
+	p.ColInfo = info
+	return p,nil
+}
+
+/*
+A api.DataSource, that contains every table and view of a PostgreSQL schema.
+*/
+type PqDataSource struct{
+	Src    *sql.DB
+	Schema string
+	lock   sync.RWMutex
+	tables map[string]*PqRowSource
+}
+var _ api.ListableSource = (*PqDataSource)(nil)
+
+/*
+Creates a PqDataSource and loads the tables of the schema.
+*/
+func NewDataSource(src *sql.DB,schema string) (*PqDataSource,error) {
+	p := &PqDataSource{Src:src,Schema:schema}
+	err := p.Refresh()
+	if err!=nil { return nil,err }
+	return p,nil
+}
+
+/*
+Re-reads the table list and the column definitions from the database.
+*/
+func (p *PqDataSource) Refresh() error {
+	rows,err := p.Src.Query(`select table_name from information_schema.tables where table_schema = $1`,p.Schema)
+	if err!=nil { return err }
+	var names []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err!=nil { rows.Close(); return err }
+		names = append(names,name)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err!=nil { return err }
+	
+	tables := make(map[string]*PqRowSource,len(names))
+	for _,name := range names {
+		t,err := introspect(p.Src,p.Schema,name)
+		if err!=nil { return err }
+		
+		/* The table has been dropped in the meantime. */
+		if t==nil { continue }
+		tables[name] = t
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.tables = tables
+	return nil
+}
+
+func (p *PqDataSource) ListTables() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	names := make([]string,0,len(p.tables))
+	for name := range p.tables { names = append(names,name) }
+	sort.Strings(names)
+	return names
+}
+
+func (p *PqDataSource) GetSource(name string) api.RowSource {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	t,ok := p.tables[name]
+	if !ok { return nil }
+	return t
+}
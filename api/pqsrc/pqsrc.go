@@ -23,6 +23,7 @@ import "bytes"
 import "fmt"
 import "github.com/lib/pq"
 import "reflect"
+import "time"
 
 type PqRowIter struct{
 	Rows *sql.Rows
@@ -41,7 +42,19 @@ func (p *PqRowIter) Fetch() (api.Row,error) {
 		case *bool:        r[i] = *v
 		case *string:      r[i] = *v
 		case *[]byte:      r[i] = *v
+		case *time.Time:   r[i] = *v
 		case *interface{}: r[i] = *v
+		case *JsonValue:   r[i] = v.Value
+		case *pq.Int64Array:   r[i] = []int64(*v)
+		case *pq.Float64Array: r[i] = []float64(*v)
+		case *pq.BoolArray:    r[i] = []bool(*v)
+		case *pq.ByteaArray:   r[i] = [][]byte(*v)
+		case *pq.StringArray:  r[i] = []string(*v)
+		case *sql.NullInt64:   if v.Valid { r[i] = v.Int64 }
+		case *sql.NullFloat64: if v.Valid { r[i] = v.Float64 }
+		case *sql.NullBool:    if v.Valid { r[i] = v.Bool }
+		case *sql.NullString:  if v.Valid { r[i] = v.String }
+		case *pq.NullTime:     if v.Valid { r[i] = v.Time }
 		}
 	}
 	return r,nil
@@ -71,24 +84,67 @@ type PqRowSource struct{
 	Scanit    []interface{}
 	ColNames  []string
 	ColTypes  []reflect.Type
+	From      string
+	ColInfo   []api.ColumnInfo /* Column metadata. Only set by Introspect. */
 }
+var _ api.ProjectableSource = (*PqRowSource)(nil)
+var _ api.OrderedSource = (*PqRowSource)(nil)
+var _ api.DescribedSource = (*PqRowSource)(nil)
 func NewRowSource(src *sql.DB,name string,cols []string,scanit []interface{}) *PqRowSource {
+	return newRowSource(src,fmt.Sprintf("%q",name),cols,scanit)
+}
+func newRowSource(src *sql.DB,from string,cols []string,scanit []interface{}) *PqRowSource {
 	b := new(bytes.Buffer)
 	sel := "select"
 	for _,col := range cols { fmt.Fprintf(b,"%s %q",sel,col); sel = "," }
 	cts := make([]reflect.Type,len(scanit))
-	for i,v := range scanit { cts[i] = reflect.TypeOf(v).Elem() }
-	fmt.Fprintf(b," from %q",name)
-	return &PqRowSource {src, b.String(), scanit, cols, cts}
+	for i,v := range scanit { cts[i] = fetchType(reflect.TypeOf(v).Elem()) }
+	fmt.Fprintf(b," from %s",from)
+	return &PqRowSource {src, b.String(), scanit, cols, cts, from, nil}
 }
 
 func (p *PqRowSource) Names() []string { return p.ColNames }
 func (p *PqRowSource) Types() []reflect.Type { return p.ColTypes }
-func (p *PqRowSource) Lookup(specs ... interface{}) (api.RowIter,error) {
-	b := new(bytes.Buffer)
-	b.WriteString(p.BaseQuery)
+func (p *PqRowSource) Columns() []api.ColumnInfo {
+	if p.ColInfo!=nil { return p.ColInfo }
+	cols := make([]api.ColumnInfo,len(p.ColNames))
+	for i,name := range p.ColNames { cols[i] = api.ColumnInfo{Name:name,Type:p.ColTypes[i],Nullable:true} }
+	return cols
+}
+func (p *PqRowSource) Project(names []string) (api.RowSource,error) {
+	scanit := make([]interface{},len(names))
+	var info []api.ColumnInfo
+	if p.ColInfo!=nil { info = make([]api.ColumnInfo,len(names)) }
+	for i,name := range names {
+		for j,col := range p.ColNames {
+			if col!=name { continue }
+			scanit[i] = p.Scanit[j]
+			if info!=nil { info[i] = p.ColInfo[j] }
+			break
+		}
+		if scanit[i]==nil { return nil,fmt.Errorf("pqsrc: no such column %q",name) }
+	}
+	r := newRowSource(p.Src,p.From,names,scanit)
+	if info!=nil {
+		for i := range info { info[i].Name,info[i].Type = names[i],r.ColTypes[i] }
+		r.ColInfo = info
+	}
+	return r,nil
+}
+func (p *PqRowSource) CanOrder(order []api.SpecOrder) bool {
+	grand: for _,o := range order {
+		for _,col := range p.ColNames {
+			if col==o.Column { continue grand }
+		}
+		return false
+	}
+	return true
+}
+/*
+Appends the where-clause for the given specs to b.
+*/
+func writeWhere(b *bytes.Buffer,specs []interface{}) (res []interface{},err error) {
 	wher := "where"
-	var res []interface{}
 	for _,spec := range specs {
 		switch v := spec.(type) {
 		case api.Spec:
@@ -99,11 +155,53 @@ func (p *PqRowSource) Lookup(specs ... interface{}) (api.RowIter,error) {
 			res = append(res,v.Value)
 			fmt.Fprintf(b," %s %q = $%d",wher,v.Column,len(res))
 			wher = "and"
+		case api.SpecExpr:
+			fmt.Fprintf(b," %s ",wher)
+			t := &translator{b,res}
+			err = t.expr(v.Expr)
+			if err!=nil { return }
+			res = t.args
+			wher = "and"
 		}
 	}
+	return
+}
+func (p *PqRowSource) Lookup(specs ... interface{}) (api.RowIter,error) {
+	b := new(bytes.Buffer)
+	b.WriteString(p.BaseQuery)
+	res,err := writeWhere(b,specs)
+	if err!=nil { return nil,err }
+	var limit int64
+	var order []api.SpecOrder
+	for _,spec := range specs {
+		switch v := spec.(type) {
+		case api.SpecLimit:
+			limit = v.N
+		case api.SpecOrder:
+			order = append(order,v)
+		}
+	}
+	
+	/*
+	The join sorts NULL before any other value and compares strings byte-wise,
+	so the same is requested from PostgreSQL.
+	*/
+	sep := " order by"
+	for _,o := range order {
+		fmt.Fprintf(b,"%s %q",sep,o.Column)
+		for j,col := range p.ColNames {
+			if col==o.Column && p.ColTypes[j]==tString { b.WriteString(` collate "C"`) }
+		}
+		if o.Desc {
+			b.WriteString(" desc nulls last")
+		} else {
+			b.WriteString(" asc nulls first")
+		}
+		sep = ","
+	}
+	if limit>0 { fmt.Fprintf(b," limit %d",limit) }
 	rows,err := p.Src.Query(b.String(),res...)
 	if err!=nil { return nil,err }
 	return &PqRowIter{rows,clonearray(p.Scanit)},nil
 }
 
-
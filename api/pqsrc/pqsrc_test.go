@@ -0,0 +1,160 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package pqsrc
+
+import "github.com/mad-day/datajoin/api"
+import gsql "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "context"
+import "database/sql"
+import "database/sql/driver"
+import "io"
+import "reflect"
+import "testing"
+
+/*
+A database/sql driver, that records the last query instead of running it.
+*/
+type recorder struct{
+	query string
+	args  []driver.Value
+}
+func (r *recorder) Connect(ctx context.Context) (driver.Conn,error) { return r,nil }
+func (r *recorder) Driver() driver.Driver { return nil }
+func (r *recorder) Prepare(query string) (driver.Stmt,error) { return &recStmt{r,query},nil }
+func (r *recorder) Close() error { return nil }
+func (r *recorder) Begin() (driver.Tx,error) { return nil,driver.ErrSkip }
+
+type recStmt struct{
+	r     *recorder
+	query string
+}
+func (s *recStmt) Close() error { return nil }
+func (s *recStmt) NumInput() int { return -1 }
+func (s *recStmt) Exec(args []driver.Value) (driver.Result,error) { return nil,driver.ErrSkip }
+func (s *recStmt) Query(args []driver.Value) (driver.Rows,error) {
+	s.r.query = s.query
+	if len(args)!=0 { s.r.args = args }
+	return emptyRows{},nil
+}
+
+type emptyRows struct{}
+func (emptyRows) Columns() []string { return nil }
+func (emptyRows) Close() error { return nil }
+func (emptyRows) Next(dest []driver.Value) error { return io.EOF }
+
+func testSource() (*recorder,*PqRowSource) {
+	r := new(recorder)
+	db := sql.OpenDB(r)
+	return r,NewRowSource(db,"users",[]string{"id","name","price"},[]interface{}{new(int64),new(sql.NullString),new(sql.NullFloat64)})
+}
+
+var (
+	fId    = expression.NewGetField(0,gsql.Int64,"id",false)
+	fName  = expression.NewGetField(1,gsql.Text,"name",true)
+	fPrice = expression.NewGetField(2,gsql.Float64,"price",true)
+)
+
+func TestLookup(t *testing.T) {
+	const base = `select "id", "name", "price" from "users"`
+	tests := []struct{
+		name  string
+		specs []interface{}
+		query string
+		args  []driver.Value
+	}{
+		{"all",nil,base,nil},
+		{"spec",[]interface{}{api.Spec{Column:"id",Values:[]int64{1,2}}},base+` where "id" = any($1)`,[]driver.Value{"{1,2}"}},
+		{"single",[]interface{}{api.SpecSingle{Column:"id",Value:int64(3)}},base+` where "id" = $1`,[]driver.Value{int64(3)}},
+		{"expr after spec",
+			[]interface{}{api.Spec{Column:"id",Values:[]int64{1}},api.SpecExpr{Expr:expression.NewLessThan(fName,expression.NewLiteral("m",gsql.Text))}},
+			base+` where "id" = any($1) and ("name" collate "C" < $2)`,
+			[]driver.Value{"{1}","m"}},
+		{"is null",
+			[]interface{}{api.SpecExpr{Expr:expression.NewIsNull(fName)},api.SpecLimit{N:10}},
+			base+` where ("name" is null) limit 10`,nil},
+		{"order",
+			[]interface{}{api.SpecOrder{Column:"name",Desc:false},api.SpecOrder{Column:"id",Desc:true},api.SpecLimit{N:5}},
+			base+` order by "name" collate "C" asc nulls first, "id" desc nulls last limit 5`,nil},
+		{"order with filter",
+			[]interface{}{api.SpecLimit{N:1},api.SpecOrder{Column:"price",Desc:true},api.SpecSingle{Column:"name",Value:"x"}},
+			base+` where "name" = $1 order by "price" desc nulls last limit 1`,
+			[]driver.Value{"x"}},
+	}
+	for _,tt := range tests {
+		r,src := testSource()
+		iter,err := src.Lookup(tt.specs...)
+		if err!=nil { t.Errorf("%s: %v",tt.name,err); continue }
+		iter.Close()
+		if r.query!=tt.query { t.Errorf("%s: query\n got %s\nwant %s",tt.name,r.query,tt.query) }
+		if !reflect.DeepEqual(r.args,tt.args) { t.Errorf("%s: args %#v, want %#v",tt.name,r.args,tt.args) }
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	tests := []struct{
+		name   string
+		groups []string
+		aggrs  []api.AggrFunc
+		specs  []interface{}
+		query  string
+		args   []driver.Value
+	}{
+		{"count",nil,[]api.AggrFunc{{Func:"count",Column:""}},nil,`select count(*) from "users"`,nil},
+		{"grouped",
+			[]string{"name"},
+			[]api.AggrFunc{{Func:"count",Column:"price"},{Func:"sum",Column:"price"},{Func:"max",Column:"price"},{Func:"min",Column:"id"}},
+			nil,
+			`select "name", count("price"), sum("price")::float8, max("price")::float8, min("id") from "users" group by "name"`,nil},
+		{"filtered",
+			[]string{"id","name"},
+			[]api.AggrFunc{{Func:"sum",Column:"price"}},
+			[]interface{}{api.SpecExpr{Expr:expression.NewGreaterThan(fPrice,expression.NewLiteral(1.5,gsql.Float64))}},
+			`select "id", "name", sum("price")::float8 from "users" where ("price" > $1) group by "id", "name"`,
+			[]driver.Value{1.5}},
+	}
+	for _,tt := range tests {
+		r,src := testSource()
+		iter,err := src.Aggregate(tt.groups,tt.aggrs,tt.specs...)
+		if err!=nil { t.Errorf("%s: %v",tt.name,err); continue }
+		iter.Close()
+		if r.query!=tt.query { t.Errorf("%s: query\n got %s\nwant %s",tt.name,r.query,tt.query) }
+		if !reflect.DeepEqual(r.args,tt.args) { t.Errorf("%s: args %#v, want %#v",tt.name,r.args,tt.args) }
+	}
+}
+
+func TestCanAggregate(t *testing.T) {
+	tests := []struct{
+		groups []string
+		aggrs  []api.AggrFunc
+		can    bool
+	}{
+		{[]string{"name"},[]api.AggrFunc{{Func:"sum",Column:"price"}},true},
+		{nil,[]api.AggrFunc{{Func:"count",Column:""}},true},
+		{[]string{"nope"},[]api.AggrFunc{{Func:"count",Column:""}},false},
+		{nil,[]api.AggrFunc{{Func:"avg",Column:"price"}},false},
+		{nil,[]api.AggrFunc{{Func:"sum",Column:""}},false},
+		{nil,[]api.AggrFunc{{Func:"max",Column:"nope"}},false},
+	}
+	_,src := testSource()
+	for _,tt := range tests {
+		if can := src.CanAggregate(tt.groups,tt.aggrs); can!=tt.can {
+			t.Errorf("CanAggregate(%v,%v) = %v, want %v",tt.groups,tt.aggrs,can,tt.can)
+		}
+	}
+}
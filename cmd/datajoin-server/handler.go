@@ -0,0 +1,149 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package main
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-vitess.v1/mysql"
+import "gopkg.in/src-d/go-vitess.v1/sqltypes"
+import "gopkg.in/src-d/go-vitess.v1/vt/proto/query"
+import dquery "github.com/mad-day/datajoin/query"
+import "github.com/mad-day/datajoin/aggregate"
+import "github.com/mad-day/datajoin/api"
+import "github.com/mad-day/datajoin/join"
+import "context"
+import "io"
+import "log"
+import "strings"
+import "sync"
+
+const rowsPerPacket = 128
+
+/*
+Implements mysql.Handler. Every query is planned by the Engine,
+made executable by join.MakeExecutable and streamed back to the client.
+*/
+type handler struct{
+	engine *dquery.Engine
+	views  *dquery.Views
+
+	lock    sync.Mutex
+	cancels map[uint32]context.CancelFunc
+}
+var _ mysql.Handler = (*handler)(nil)
+
+/* Serves the DataSource. Views, that clients create, are shared by all connections. */
+func newHandler(ds api.DataSource) *handler {
+	views := dquery.NewViews(ds)
+	engine := dquery.NewEngine(views)
+	engine.Compile = join.MakeExecutable
+	return &handler{engine:engine,views:views,cancels:make(map[uint32]context.CancelFunc)}
+}
+
+func (h *handler) NewConnection(c *mysql.Conn) {
+	log.Printf("connection %d from %v",c.ConnectionID,c.RemoteAddr())
+}
+func (h *handler) ConnectionClosed(c *mysql.Conn) {
+	h.lock.Lock()
+	cancel := h.cancels[c.ConnectionID]
+	delete(h.cancels,c.ConnectionID)
+	h.lock.Unlock()
+	if cancel!=nil { cancel() }
+	log.Printf("connection %d closed",c.ConnectionID)
+}
+
+/*
+Answers the statements, that clients send on their own, such as
+SET NAMES utf8 or SELECT @@version_comment, without planning them.
+*/
+func (h *handler) builtin(q string) (*sqltypes.Result,bool) {
+	l := strings.ToLower(strings.TrimSpace(q))
+	switch {
+	case strings.HasPrefix(l,"set "):
+		return &sqltypes.Result{},true
+	case strings.HasPrefix(l,"select @@version_comment"):
+		return &sqltypes.Result{
+			Fields:[]*query.Field{{Name:"@@version_comment",Type:sqltypes.VarChar}},
+			Rows:[][]sqltypes.Value{{sqltypes.NewVarChar("datajoin")}},
+		},true
+	}
+	return nil,false
+}
+
+func (h *handler) ComQuery(c *mysql.Conn, q string, callback func(*sqltypes.Result) error) error {
+	if r,ok := h.builtin(q); ok { return callback(r) }
+	if ok,err := h.views.Exec(q); ok {
+		if err!=nil { return err }
+		return callback(&sqltypes.Result{})
+	}
+
+	tree,err := h.engine.Parse(q)
+	if err!=nil { return err }
+
+	nctx,cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h.lock.Lock()
+	h.cancels[c.ConnectionID] = cancel
+	h.lock.Unlock()
+	defer func() {
+		h.lock.Lock()
+		delete(h.cancels,c.ConnectionID)
+		h.lock.Unlock()
+	}()
+
+	ctx := sql.NewContext(nctx)
+	iter,err := tree.RowIter(ctx)
+	if err!=nil { return err }
+	defer iter.Close()
+
+	schema := tree.Schema()
+	shapes := aggregate.SchemaShapes(tree)
+	fields := make([]*query.Field,len(schema))
+	for i,col := range schema {
+		fields[i] = &query.Field{Name:col.Name,Type:col.Type.Type()}
+	}
+
+	r := &sqltypes.Result{Fields:fields}
+	for {
+		row,err := iter.Next()
+		if err==io.EOF { break }
+		if err!=nil { return err }
+		out := make([]sqltypes.Value,len(row))
+		for i,v := range row {
+			if v==nil {
+				out[i] = sqltypes.NULL
+				continue
+			}
+			switch shapes[i].(type) {
+			case *aggregate.DictType,*aggregate.ArrayType:
+				data,err := aggregate.MarshalJSON(shapes[i],v)
+				if err!=nil { return err }
+				out[i] = sqltypes.MakeTrusted(sqltypes.TypeJSON,data)
+				continue
+			}
+			out[i] = schema[i].Type.SQL(v)
+		}
+		r.Rows = append(r.Rows,out)
+		r.RowsAffected++
+		if len(r.Rows)>=rowsPerPacket {
+			err = callback(r)
+			if err!=nil { return err }
+			r = &sqltypes.Result{Fields:fields}
+		}
+	}
+	return callback(r)
+}
@@ -0,0 +1,230 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+/*
+An interactive shell for exploring joins over the tables of a configuration file.
+See package github.com/mad-day/datajoin/config for the format of the file.
+
+	datajoin -config shop.yaml
+	datajoin> SELECT c.name, o.total FROM customers c, orders o WHERE c.id = o.customer;
+	datajoin> \plan SELECT ...
+	datajoin> \stats
+
+Statements end with a semicolon. Type \help for the list of meta-commands.
+*/
+package main
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "github.com/mad-day/datajoin/config"
+import "github.com/mad-day/datajoin/join"
+import "github.com/mad-day/datajoin/query"
+import "github.com/chzyer/readline"
+import "context"
+import "flag"
+import "fmt"
+import "io"
+import "log"
+import "os"
+import "path/filepath"
+import "strings"
+import "time"
+
+var (
+	configFile = flag.String("config","datajoin.yaml","configuration file: YAML, JSON or TOML")
+	format     = flag.String("format","table","output format: table, csv or json")
+	execute    = flag.String("e","","run the given statement and exit")
+)
+
+/* Statistics of the last executed statement. */
+type lastRun struct{
+	query   string
+	rows    int64
+	planned time.Duration
+	elapsed time.Duration
+	stats   *join.Stats
+}
+
+type session struct{
+	engine *query.Engine
+	views  *query.Views
+	out    io.Writer
+	format string
+	last   *lastRun
+}
+
+func (s *session) plan(q string) (sql.Node,error) {
+	return s.engine.Parse(q)
+}
+
+/* Returns the RealJoins of the executable plan. */
+func realJoins(node sql.Node) (rjs []*join.RealJoin) {
+	if rj,ok := node.(*join.RealJoin); ok {
+		rjs = append(rjs,rj)
+		for _,t := range rj.Tables { rjs = append(rjs,realJoins(t)...) }
+		return
+	}
+	for _,c := range node.Children() { rjs = append(rjs,realJoins(c)...) }
+	return
+}
+
+func (s *session) run(q string) error {
+	if ok,err := s.views.Exec(q); ok {
+		if err==nil { fmt.Fprintln(os.Stderr,"OK") }
+		return err
+	}
+	start := time.Now()
+	tree,err := s.plan(q)
+	if err!=nil { return err }
+	planned := time.Since(start)
+	
+	ctx,stats := join.WithStats(sql.NewContext(context.Background()))
+	iter,err := tree.RowIter(ctx)
+	if err!=nil { return err }
+	defer iter.Close()
+	
+	p := formats[s.format](s.out)
+	err = p.Begin(shapedSchema(tree))
+	if err!=nil { return err }
+	var n int64
+	for {
+		row,err := iter.Next()
+		if err==io.EOF { break }
+		if err!=nil { return err }
+		err = p.Row(row)
+		if err!=nil { return err }
+		n++
+	}
+	err = p.End()
+	if err!=nil { return err }
+	s.last = &lastRun{q,n,planned,time.Since(start),stats}
+	fmt.Fprintf(os.Stderr,"%d rows (%v)\n",n,s.last.elapsed.Round(time.Microsecond))
+	return nil
+}
+
+const help = `Statements end with a semicolon. Besides SELECT, SHOW and DESCRIBE,
+CREATE [OR REPLACE] VIEW name AS SELECT ... and DROP VIEW name are supported.
+Meta-commands:
+  \plan <query>       show the executable plan, including the RealJoins
+  \specs <query>      show the index-scan hints (FieldSpecs) chosen per table
+  \stats              show the runtime statistics of the last statement
+  \format [name]      show or set the output format: table, csv or json
+  \help               show this text
+  \quit               leave the shell
+`
+
+/* Runs a meta-command. Returns false, if the shell should terminate. */
+func (s *session) meta(line string) (bool,error) {
+	cmd,arg := line,""
+	if i := strings.IndexAny(line," \t"); i>=0 { cmd,arg = line[:i],strings.TrimSpace(line[i+1:]) }
+	arg = strings.TrimSpace(strings.TrimSuffix(arg,";"))
+	switch cmd {
+	case `\q`,`\quit`,`\exit`:
+		return false,nil
+	case `\?`,`\h`,`\help`:
+		fmt.Fprint(s.out,help)
+	case `\format`:
+		if arg=="" {
+			fmt.Fprintln(s.out,s.format)
+			break
+		}
+		if _,ok := formats[arg]; !ok { return true,fmt.Errorf("unknown format %q",arg) }
+		s.format = arg
+	case `\plan`:
+		tree,err := s.plan(arg)
+		if err!=nil { return true,err }
+		fmt.Fprintln(s.out,tree)
+	case `\specs`:
+		tree,err := s.plan(arg)
+		if err!=nil { return true,err }
+		for i,rj := range realJoins(tree) {
+			fmt.Fprintf(s.out,"RealJoin #%d\n",i+1)
+			for j,t := range rj.Tables {
+				fmt.Fprintf(s.out,"  %s:\n%v\n",t.Name(),rj.Indexer[j])
+			}
+		}
+	case `\stats`:
+		if s.last==nil { return true,fmt.Errorf("no statement has been run yet") }
+		fmt.Fprintf(s.out,"%s\n%d rows, planned in %v, total %v\n",s.last.query,s.last.rows,s.last.planned,s.last.elapsed)
+		fmt.Fprint(s.out,s.last.stats)
+	default:
+		return true,fmt.Errorf("unknown command %s, try \\help",cmd)
+	}
+	return true,nil
+}
+
+func (s *session) repl() error {
+	rl,err := readline.NewEx(&readline.Config{
+		Prompt:      "datajoin> ",
+		HistoryFile: filepath.Join(os.Getenv("HOME"),".datajoin_history"),
+	})
+	if err!=nil { return err }
+	defer rl.Close()
+	
+	var stmt []string
+	for {
+		if len(stmt)==0 {
+			rl.SetPrompt("datajoin> ")
+		} else {
+			rl.SetPrompt("       -> ")
+		}
+		line,err := rl.Readline()
+		if err==readline.ErrInterrupt {
+			stmt = nil
+			continue
+		}
+		if err==io.EOF { return nil }
+		if err!=nil { return err }
+		
+		line = strings.TrimSpace(line)
+		if len(stmt)==0 && strings.HasPrefix(line,`\`) {
+			more,err := s.meta(line)
+			if err!=nil { fmt.Fprintln(os.Stderr,"error:",err) }
+			if !more { return nil }
+			continue
+		}
+		if line=="" { continue }
+		stmt = append(stmt,line)
+		if !strings.HasSuffix(line,";") { continue }
+		q := strings.TrimSuffix(strings.Join(stmt,"\n"),";")
+		stmt = nil
+		err = s.run(q)
+		if err!=nil { fmt.Fprintln(os.Stderr,"error:",err) }
+	}
+}
+
+func main() {
+	flag.Parse()
+	if _,ok := formats[*format]; !ok { log.Fatalf("unknown format %q",*format) }
+	
+	ds,err := config.LoadDataSource(*configFile)
+	if err!=nil { log.Fatal(err) }
+	defer ds.Close()
+	
+	views := query.NewViews(ds)
+	engine := query.NewEngine(views)
+	engine.Compile = join.MakeExecutable
+	s := &session{engine:engine,views:views,out:os.Stdout,format:*format}
+	if *execute!="" {
+		err = s.run(strings.TrimSuffix(strings.TrimSpace(*execute),";"))
+	} else {
+		err = s.repl()
+	}
+	if err!=nil {
+		ds.Close()
+		log.Fatal(err)
+	}
+}
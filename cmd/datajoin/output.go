@@ -0,0 +1,178 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package main
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "github.com/mad-day/datajoin/aggregate"
+import "bufio"
+import "encoding/csv"
+import "fmt"
+import "io"
+import "strings"
+import "time"
+import "unicode/utf8"
+
+/*
+Writes the rows of a result. Begin is called once, before the first row,
+End after the last row.
+*/
+type printer interface{
+	Begin(schema sql.Schema) error
+	Row(row sql.Row) error
+	End() error
+}
+
+var formats = map[string]func(w io.Writer) printer{
+	"table": func(w io.Writer) printer { return &tablePrinter{w:w} },
+	"csv":   func(w io.Writer) printer { return &csvPrinter{w:csv.NewWriter(w)} },
+	"json":  func(w io.Writer) printer { return &jsonPrinter{w:bufio.NewWriter(w)} },
+}
+
+/*
+The schema of the node, with the types of the columns replaced by their shapes,
+so that dict and array values are printed with their fields in order.
+See aggregate.SchemaShapes().
+*/
+func shapedSchema(node sql.Node) sql.Schema {
+	schema := node.Schema()
+	shapes := aggregate.SchemaShapes(node)
+	out := make(sql.Schema,len(schema))
+	for i,col := range schema {
+		c := *col
+		c.Type = shapes[i]
+		out[i] = &c
+	}
+	return out
+}
+
+/* Formats a value for the table and the csv output. */
+func formatValue(t sql.Type,v interface{}) (string,error) {
+	switch x := v.(type) {
+	case nil: return "NULL",nil
+	case string: return x,nil
+	case []byte: return string(x),nil
+	case time.Time: return x.Format("2006-01-02 15:04:05.999999999"),nil
+	case int64,int32,int,float64,float32,bool: return fmt.Sprint(x),nil
+	}
+	data,err := aggregate.MarshalJSON(t,v)
+	return string(data),err
+}
+
+/*
+A table, as printed by the mysql client. The rows are buffered,
+in order to compute the widths of the columns.
+*/
+type tablePrinter struct{
+	w      io.Writer
+	schema sql.Schema
+	rows   [][]string
+}
+func (p *tablePrinter) Begin(schema sql.Schema) error {
+	p.schema = schema
+	p.rows = nil
+	return nil
+}
+func (p *tablePrinter) Row(row sql.Row) error {
+	cells := make([]string,len(row))
+	for i,v := range row {
+		s,err := formatValue(p.schema[i].Type,v)
+		if err!=nil { return err }
+		cells[i] = s
+	}
+	p.rows = append(p.rows,cells)
+	return nil
+}
+func (p *tablePrinter) End() error {
+	widths := make([]int,len(p.schema))
+	for i,col := range p.schema { widths[i] = utf8.RuneCountInString(col.Name) }
+	for _,cells := range p.rows {
+		for i,c := range cells {
+			if n := utf8.RuneCountInString(c); n>widths[i] { widths[i] = n }
+		}
+	}
+	bw := bufio.NewWriter(p.w)
+	line := func() {
+		for _,w := range widths { fmt.Fprintf(bw,"+%s",strings.Repeat("-",w+2)) }
+		bw.WriteString("+\n")
+	}
+	cells := func(cs []string) {
+		for i,c := range cs { fmt.Fprintf(bw,"| %s%s ",c,strings.Repeat(" ",widths[i]-utf8.RuneCountInString(c))) }
+		bw.WriteString("|\n")
+	}
+	names := make([]string,len(p.schema))
+	for i,col := range p.schema { names[i] = col.Name }
+	line()
+	cells(names)
+	line()
+	for _,cs := range p.rows { cells(cs) }
+	if len(p.rows)!=0 { line() }
+	p.rows = nil
+	return bw.Flush()
+}
+
+type csvPrinter struct{
+	w      *csv.Writer
+	schema sql.Schema
+}
+func (p *csvPrinter) Begin(schema sql.Schema) error {
+	p.schema = schema
+	names := make([]string,len(schema))
+	for i,col := range schema { names[i] = col.Name }
+	return p.w.Write(names)
+}
+func (p *csvPrinter) Row(row sql.Row) error {
+	cells := make([]string,len(row))
+	for i,v := range row {
+		if v==nil { continue }
+		s,err := formatValue(p.schema[i].Type,v)
+		if err!=nil { return err }
+		cells[i] = s
+	}
+	return p.w.Write(cells)
+}
+func (p *csvPrinter) End() error {
+	p.w.Flush()
+	return p.w.Error()
+}
+
+/* One JSON object per row. */
+type jsonPrinter struct{
+	w    *bufio.Writer
+	doc  *aggregate.DictType
+	cols []string
+}
+func (p *jsonPrinter) Begin(schema sql.Schema) error {
+	fields := make([]aggregate.DictField,len(schema))
+	p.cols = make([]string,len(schema))
+	for i,col := range schema {
+		fields[i] = aggregate.DictField{Name:col.Name,Type:col.Type}
+		p.cols[i] = col.Name
+	}
+	p.doc = aggregate.NewDictType(fields...)
+	return nil
+}
+func (p *jsonPrinter) Row(row sql.Row) error {
+	m := make(map[string]interface{},len(row))
+	for i,v := range row { m[p.cols[i]] = v }
+	data,err := aggregate.MarshalJSON(p.doc,m)
+	if err!=nil { return err }
+	p.w.Write(data)
+	p.w.WriteString("\n")
+	return nil
+}
+func (p *jsonPrinter) End() error { return p.w.Flush() }
@@ -0,0 +1,200 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package config
+
+import "github.com/mad-day/datajoin/api"
+import "github.com/mad-day/datajoin/api/memsrc"
+import "github.com/mad-day/datajoin/api/pqsrc"
+import "database/sql"
+import _ "github.com/lib/pq"
+import "encoding/json"
+import "fmt"
+import "io"
+import "net/http"
+import "reflect"
+import "strings"
+import "time"
+
+func init() {
+	Register("postgres",postgresBackend{})
+	Register("csv",csvBackend{})
+	Register("memory",memoryBackend{})
+	Register("http",httpBackend{})
+}
+
+/*
+A table or view of a PostgreSQL database.
+
+	params: { dsn: "postgres://...", schema: public, table: customers }
+
+The schema defaults to "public", the table to the (unqualified) name of the table.
+Tables with the same dsn share the connection pool.
+*/
+type postgresBackend struct{}
+func (postgresBackend) Validate(t *Table) error {
+	_,err := t.RequireParam("dsn")
+	if err!=nil { return err }
+	_,err = t.Param("schema","")
+	if err!=nil { return err }
+	_,err = t.Param("table","")
+	return err
+}
+func (postgresBackend) Open(env *Env,t *Table) (api.RowSource,error) {
+	dsn,_ := t.RequireParam("dsn")
+	schema,_ := t.Param("schema","public")
+	table,_ := t.Param("table",t.Name[strings.LastIndex(t.Name,".")+1:])
+	c,err := env.Shared("postgres "+dsn,func() (io.Closer,error) { return sql.Open("postgres",dsn) })
+	if err!=nil { return nil,t.Errorf("params.dsn","%v",err) }
+	src,err := pqsrc.Introspect(c.(*sql.DB),schema,table)
+	if err!=nil { return nil,t.Errorf("params.table","%v",err) }
+	return src,nil
+}
+
+/*
+A CSV file, whose first record contains the column names. It is loaded into memory.
+
+	params: { path: rates.csv }
+
+The types of the columns are guessed, unless they are given in the column overrides.
+*/
+type csvBackend struct{}
+func (csvBackend) Validate(t *Table) error {
+	_,err := t.RequireParam("path")
+	return err
+}
+func (csvBackend) Open(env *Env,t *Table) (api.RowSource,error) {
+	path,_ := t.RequireParam("path")
+	src,err := memsrc.LoadCSV(env.Path(path),t.ColumnTypes())
+	if err!=nil { return nil,t.Errorf("params.path","%v",err) }
+	return src,nil
+}
+
+/* Returns the names and the types of the columns, which all need a type. */
+func declaredColumns(t *Table) ([]string,[]reflect.Type,error) {
+	if len(t.Columns)==0 { return nil,nil,t.Errorf("columns","missing") }
+	names := make([]string,len(t.Columns))
+	types := make([]reflect.Type,len(t.Columns))
+	for i,col := range t.Columns {
+		tp,ok := TypeNames[col.Type]
+		if !ok { return nil,nil,t.Errorf(fmt.Sprintf("columns[%d].type",i),"missing") }
+		names[i] = col.Name
+		types[i] = tp
+	}
+	return names,types,nil
+}
+
+/*
+A table, whose rows are part of the configuration. The columns must be declared with their types.
+
+	columns: [ { name: code, type: string }, { name: label, type: string } ]
+	params:
+	  rows: [ [de, Germany], [fr, France] ]
+*/
+type memoryBackend struct{}
+func (memoryBackend) rows(t *Table) ([]interface{},error) {
+	v,ok := t.Params["rows"]
+	if !ok || v==nil { return nil,nil }
+	rows,ok := v.([]interface{})
+	if !ok { return nil,t.Errorf("params.rows","expected a list of rows, got %T",v) }
+	for i,row := range rows {
+		r,ok := row.([]interface{})
+		if !ok { return nil,t.Errorf(fmt.Sprintf("params.rows[%d]",i),"expected a list of values, got %T",row) }
+		if len(r)!=len(t.Columns) { return nil,t.Errorf(fmt.Sprintf("params.rows[%d]",i),"expected %d values, got %d",len(t.Columns),len(r)) }
+	}
+	return rows,nil
+}
+func (b memoryBackend) Validate(t *Table) error {
+	_,_,err := declaredColumns(t)
+	if err!=nil { return err }
+	_,err = b.rows(t)
+	return err
+}
+func (b memoryBackend) Open(env *Env,t *Table) (api.RowSource,error) {
+	names,types,err := declaredColumns(t)
+	if err!=nil { return nil,err }
+	rows,err := b.rows(t)
+	if err!=nil { return nil,err }
+	src := memsrc.NewTable(names,types)
+	for i,row := range rows {
+		err = src.Insert(row.([]interface{})...)
+		if err!=nil { return nil,t.Errorf(fmt.Sprintf("params.rows[%d]",i),"%v",err) }
+	}
+	return src,nil
+}
+
+/*
+A document fetched over HTTP, once the configuration is opened. It is kept in memory.
+
+	params: { url: "https://example.com/rates.csv", format: csv }
+
+The format is "csv" (the default), or "json": an array of objects. JSON tables
+need their columns declared with their types. The request is aborted after
+params.timeout (a duration such as "10s", default "30s").
+*/
+type httpBackend struct{}
+func (httpBackend) timeout(t *Table) (time.Duration,error) {
+	s,err := t.Param("timeout","30s")
+	if err!=nil { return 0,err }
+	d,err := time.ParseDuration(s)
+	if err!=nil || d<=0 { return 0,t.Errorf("params.timeout","invalid duration %q",s) }
+	return d,nil
+}
+func (b httpBackend) Validate(t *Table) error {
+	_,err := t.RequireParam("url")
+	if err!=nil { return err }
+	_,err = b.timeout(t)
+	if err!=nil { return err }
+	f,err := t.Param("format","csv")
+	if err!=nil { return err }
+	switch f {
+	case "csv": return nil
+	case "json":
+		_,_,err = declaredColumns(t)
+		return err
+	}
+	return t.Errorf("params.format","unknown format %q, expected csv or json",f)
+}
+func (b httpBackend) Open(env *Env,t *Table) (api.RowSource,error) {
+	url,_ := t.RequireParam("url")
+	f,_ := t.Param("format","csv")
+	timeout,err := b.timeout(t)
+	if err!=nil { return nil,err }
+	client := &http.Client{Timeout:timeout}
+	resp,err := client.Get(url)
+	if err!=nil { return nil,t.Errorf("params.url","%v",err) }
+	defer resp.Body.Close()
+	if resp.StatusCode!=http.StatusOK { return nil,t.Errorf("params.url","%s",resp.Status) }
+	if f=="csv" {
+		src,err := memsrc.ReadCSV(resp.Body,t.ColumnTypes())
+		if err!=nil { return nil,t.Errorf("params.url","%v",err) }
+		return src,nil
+	}
+	names,types,err := declaredColumns(t)
+	if err!=nil { return nil,err }
+	var docs []map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&docs)
+	if err!=nil { return nil,t.Errorf("params.url","%v",err) }
+	src := memsrc.NewTable(names,types)
+	values := make([]interface{},len(names))
+	for i,doc := range docs {
+		for j,name := range names { values[j] = doc[name] }
+		err = src.Insert(values...)
+		if err!=nil { return nil,t.Errorf("params.url","object %d: %v",i,err) }
+	}
+	return src,nil
+}
@@ -0,0 +1,275 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package config
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "github.com/mad-day/datajoin/api"
+import "github.com/mad-day/datajoin/api/memsrc"
+import "fmt"
+import "reflect"
+
+/*
+Applies the column overrides of a table to its RowSource. Renamed columns are
+translated back in the specs passed to Lookup. Filters and orderings on columns
+with a different type are not pushed into the RowSource.
+*/
+type columnSource struct{
+	src   api.RowSource
+	idx   []int          /* Position of each column within the rows of src. */
+	names []string
+	orig  []string       /* The names within src. */
+	types []reflect.Type
+	conv  []bool         /* The values need to be converted. */
+}
+var _ api.ProjectableSource = (*columnSource)(nil)
+var _ api.FilterableSource = (*columnSource)(nil)
+var _ api.OrderedSource = (*columnSource)(nil)
+var _ api.DescribedSource = (*columnSource)(nil)
+var _ api.AggregatingSource = (*columnSource)(nil)
+var _ api.VersionedSource = (*columnSource)(nil)
+
+func newColumnSource(t *Table,src api.RowSource) (*columnSource,error) {
+	names := src.Names()
+	types := src.Types()
+	c := &columnSource{src:src}
+	c.idx = make([]int,len(names))
+	c.names = append([]string(nil),names...)
+	c.orig = append([]string(nil),names...)
+	c.types = append([]reflect.Type(nil),types...)
+	c.conv = make([]bool,len(names))
+	for i := range c.idx { c.idx[i] = i }
+	
+	grand: for j,col := range t.Columns {
+		for i,name := range names {
+			if name!=col.Name { continue }
+			c.names[i] = col.Exposed()
+			if tp,ok := TypeNames[col.Type]; ok && tp!=types[i] {
+				c.types[i] = tp
+				c.conv[i] = true
+			}
+			continue grand
+		}
+		return nil,t.Errorf(fmt.Sprintf("columns[%d].name",j),"no such column %q",col.Name)
+	}
+	return c,nil
+}
+
+func (c *columnSource) Names() []string { return c.names }
+func (c *columnSource) Types() []reflect.Type { return c.types }
+
+func (c *columnSource) Columns() []api.ColumnInfo {
+	base := api.Describe(c.src)
+	cols := make([]api.ColumnInfo,len(c.idx))
+	for i,j := range c.idx {
+		if j>=0 && j<len(base) {
+			cols[i] = base[j]
+		} else {
+			cols[i].Nullable = true
+		}
+		cols[i].Name,cols[i].Type = c.names[i],c.types[i]
+	}
+	return cols
+}
+
+func (c *columnSource) column(name string) int {
+	for i,n := range c.names {
+		if n==name { return i }
+	}
+	return -1
+}
+
+/* Returns the name of the column within src, and whether its values are passed unchanged. */
+func (c *columnSource) original(name string) (string,bool) {
+	i := c.column(name)
+	if i<0 { return name,false }
+	return c.orig[i],!c.conv[i]
+}
+
+func (c *columnSource) Project(names []string) (api.RowSource,error) {
+	p := &columnSource{src:c.src}
+	for _,n := range names {
+		i := c.column(n)
+		if i<0 { return nil,fmt.Errorf("unknown column %q",n) }
+		p.idx = append(p.idx,c.idx[i])
+		p.orig = append(p.orig,c.orig[i])
+		p.types = append(p.types,c.types[i])
+		p.conv = append(p.conv,c.conv[i])
+		p.names = append(p.names,n)
+	}
+	if ps,ok := c.src.(api.ProjectableSource); ok {
+		src,err := ps.Project(p.orig)
+		if err!=nil { return nil,err }
+		p.src = src
+		for i := range p.idx { p.idx[i] = i }
+	}
+	return p,nil
+}
+
+/* Renames the column references of the expression. Fails on converted columns. */
+func (c *columnSource) rename(expr sql.Expression) (sql.Expression,bool) {
+	ok := true
+	res,err := expr.TransformUp(func(e sql.Expression) (sql.Expression,error) {
+		gf,isgf := e.(*expression.GetField)
+		if !isgf { return e,nil }
+		name,same := c.original(gf.Name())
+		if !same { ok = false }
+		return expression.NewGetFieldWithTable(gf.Index(),gf.Type(),gf.Table(),name,gf.IsNullable()),nil
+	})
+	if err!=nil { return nil,false }
+	return res,ok
+}
+
+func (c *columnSource) CanPush(expr sql.Expression) bool {
+	fs,ok := c.src.(api.FilterableSource)
+	if !ok { return false }
+	re,ok := c.rename(expr)
+	return ok && fs.CanPush(re)
+}
+
+func (c *columnSource) CanOrder(order []api.SpecOrder) bool {
+	os,ok := c.src.(api.OrderedSource)
+	if !ok { return false }
+	ro := make([]api.SpecOrder,len(order))
+	for i,o := range order {
+		name,same := c.original(o.Column)
+		if !same { return false }
+		ro[i] = api.SpecOrder{Column:name,Desc:o.Desc}
+	}
+	return os.CanOrder(ro)
+}
+
+/* Converts a value back into the type of the column within src. */
+func (c *columnSource) back(i int,v interface{}) (interface{},bool) {
+	if !c.conv[i] { return v,true }
+	st := c.src.Types()[c.idx[i]]
+	r,err := memsrc.Convert(st,v)
+	return r,err==nil
+}
+
+/* The schema version of src, or 0, if src doesn't report one. */
+func (c *columnSource) SchemaVersion() uint64 {
+	if vs,ok := c.src.(api.VersionedSource); ok { return vs.SchemaVersion() }
+	return 0
+}
+
+/* Translates the groups and aggregates into the names within src. Fails on converted columns. */
+func (c *columnSource) aggregates(groups []string,aggrs []api.AggrFunc) ([]string,[]api.AggrFunc,bool) {
+	rg := make([]string,len(groups))
+	for i,g := range groups {
+		name,same := c.original(g)
+		if !same { return nil,nil,false }
+		rg[i] = name
+	}
+	ra := make([]api.AggrFunc,len(aggrs))
+	for i,a := range aggrs {
+		ra[i] = a
+		if a.Column=="" { continue }
+		name,same := c.original(a.Column)
+		if !same { return nil,nil,false }
+		ra[i].Column = name
+	}
+	return rg,ra,true
+}
+
+func (c *columnSource) CanAggregate(groups []string,aggrs []api.AggrFunc) bool {
+	as,ok := c.src.(api.AggregatingSource)
+	if !ok { return false }
+	rg,ra,ok := c.aggregates(groups,aggrs)
+	return ok && as.CanAggregate(rg,ra)
+}
+
+func (c *columnSource) Aggregate(groups []string,aggrs []api.AggrFunc,specs ...interface{}) (api.RowIter,error) {
+	as,ok := c.src.(api.AggregatingSource)
+	if !ok { return nil,fmt.Errorf("source can't aggregate") }
+	rg,ra,ok := c.aggregates(groups,aggrs)
+	if !ok { return nil,fmt.Errorf("can't aggregate converted columns") }
+	rs,ok := c.specs(specs)
+	if !ok { return emptyIter{},nil }
+	return as.Aggregate(rg,ra,rs...)
+}
+
+/* Translates the specs into the names and types within src. Returns false, if no row can match. */
+func (c *columnSource) specs(specs []interface{}) ([]interface{},bool) {
+	rs := make([]interface{},0,len(specs))
+	for _,spec := range specs {
+		switch v := spec.(type) {
+		case api.Spec:
+			i := c.column(v.Column)
+			if i<0 { break }
+			rv := reflect.ValueOf(v.Values)
+			values := v.Values
+			if c.conv[i] && rv.Kind()==reflect.Slice {
+				vals := make([]interface{},0,rv.Len())
+				for j := 0; j<rv.Len(); j++ {
+					if x,ok := c.back(i,rv.Index(j).Interface()); ok { vals = append(vals,x) }
+				}
+				values = vals
+			}
+			spec = api.Spec{Column:c.orig[i],Values:values}
+		case api.SpecSingle:
+			i := c.column(v.Column)
+			if i<0 { break }
+			x,ok := c.back(i,v.Value)
+			if !ok { return nil,false }
+			spec = api.SpecSingle{Column:c.orig[i],Value:x}
+		case api.SpecOrder:
+			name,_ := c.original(v.Column)
+			spec = api.SpecOrder{Column:name,Desc:v.Desc}
+		case api.SpecExpr:
+			re,_ := c.rename(v.Expr)
+			if re!=nil { spec = api.SpecExpr{Expr:re} }
+		}
+		rs = append(rs,spec)
+	}
+	return rs,true
+}
+
+func (c *columnSource) Lookup(specs ... interface{}) (api.RowIter,error) {
+	rs,ok := c.specs(specs)
+	if !ok { return emptyIter{},nil }
+	it,err := c.src.Lookup(rs...)
+	if err!=nil { return nil,err }
+	return &columnIter{it,c},nil
+}
+
+type columnIter struct{
+	api.RowIter
+	c *columnSource
+}
+func (ci *columnIter) Fetch() (api.Row,error) {
+	row,err := ci.RowIter.Fetch()
+	if err!=nil { return nil,err }
+	c := ci.c
+	out := make(api.Row,len(c.idx))
+	for i,j := range c.idx {
+		if j>=len(row) { continue }
+		v := row[j]
+		if c.conv[i] {
+			v,err = memsrc.Convert(c.types[i],v)
+			if err!=nil { return nil,err }
+		}
+		out[i] = v
+	}
+	return out,nil
+}
+
+type emptyIter struct{}
+func (emptyIter) Close() error { return nil }
+func (emptyIter) Next() bool { return false }
+func (emptyIter) Fetch() (api.Row,error) { return nil,nil }
@@ -0,0 +1,345 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+/*
+Builds DataSources from configuration files.
+
+A configuration lists named tables. Each table has a backend, which reads its
+rows, the parameters of the backend, and optionally a list of columns, that
+overrides the names (aliases) and the types of the backend's columns.
+Qualified names, such as crm.users, place the tables into namespaces,
+see api.NamespacedSource.
+
+	tables:
+	  - name: customers
+	    backend: postgres
+	    params: { dsn: "postgres://localhost/crm?sslmode=disable", table: clients }
+	    columns:
+	      - { name: client_id, alias: id }
+	  - name: rates
+	    backend: csv
+	    params: { path: rates.csv }
+	    columns:
+	      - { name: day, type: timestamp }
+
+The same document can be written in YAML, JSON or TOML. The built-in backends are
+postgres, csv, memory and http. Other backends can be added using Register().
+*/
+package config
+
+import "github.com/mad-day/datajoin/api"
+import "github.com/BurntSushi/toml"
+import "gopkg.in/yaml.v2"
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "path/filepath"
+import "reflect"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+type Config struct{
+	Tables []*Table `yaml:"tables" json:"tables" toml:"tables"`
+}
+
+type Table struct{
+	Name    string                 `yaml:"name" json:"name" toml:"name"`
+	Backend string                 `yaml:"backend" json:"backend" toml:"backend"`
+	Params  map[string]interface{} `yaml:"params" json:"params" toml:"params"`
+	Columns []*Column              `yaml:"columns" json:"columns" toml:"columns"`
+	
+	index int
+}
+
+/*
+Overrides a column of the backend. Name is the name of the column within the backend,
+Alias the name, under which it is exposed, and Type the type, it is converted into.
+*/
+type Column struct{
+	Name  string `yaml:"name" json:"name" toml:"name"`
+	Alias string `yaml:"alias" json:"alias" toml:"alias"`
+	Type  string `yaml:"type" json:"type" toml:"type"`
+}
+
+/* Returns the exposed name of the column. */
+func (c *Column) Exposed() string {
+	if c.Alias!="" { return c.Alias }
+	return c.Name
+}
+
+/*
+A configuration error. Table names the table, Field the offending field,
+such as "params.dsn" or "columns[2].type".
+*/
+type Error struct{
+	Table string
+	Field string
+	Err   error
+}
+func (e *Error) Error() string {
+	if e.Field=="" { return fmt.Sprintf("table %s: %v",e.Table,e.Err) }
+	return fmt.Sprintf("table %s: %s: %v",e.Table,e.Field,e.Err)
+}
+
+/* A list of configuration errors. */
+type Errors []*Error
+func (e Errors) Error() string {
+	s := make([]string,len(e))
+	for i,err := range e { s[i] = err.Error() }
+	return strings.Join(s,"\n")
+}
+
+/* Returns the name of the table for error messages. */
+func (t *Table) ref() string {
+	if t.Name!="" { return fmt.Sprintf("%q",t.Name) }
+	return fmt.Sprintf("#%d",t.index+1)
+}
+
+/* Returns an *Error for the given field of the table. */
+func (t *Table) Errorf(field string,format string,args ...interface{}) error {
+	return &Error{t.ref(),field,fmt.Errorf(format,args...)}
+}
+
+/* Returns a string parameter, or def, if it is missing. */
+func (t *Table) Param(key string,def string) (string,error) {
+	v,ok := t.Params[key]
+	if !ok || v==nil { return def,nil }
+	s,ok := v.(string)
+	if !ok { return "",t.Errorf("params."+key,"expected a string, got %T",v) }
+	return s,nil
+}
+
+/* Returns a string parameter, that must be present. */
+func (t *Table) RequireParam(key string) (string,error) {
+	s,err := t.Param(key,"")
+	if err!=nil { return "",err }
+	if s=="" { return "",t.Errorf("params."+key,"missing") }
+	return s,nil
+}
+
+/* Returns the type of each overridden column by its name within the backend. */
+func (t *Table) ColumnTypes() map[string]reflect.Type {
+	m := make(map[string]reflect.Type)
+	for _,c := range t.Columns {
+		if tp,ok := TypeNames[c.Type]; ok { m[c.Name] = tp }
+	}
+	return m
+}
+
+/* The column types, that can be used in configuration files. */
+var TypeNames = map[string]reflect.Type{
+	"int64":     reflect.TypeOf(int64(0)),
+	"float64":   reflect.TypeOf(float64(0)),
+	"string":    reflect.TypeOf(""),
+	"bool":      reflect.TypeOf(false),
+	"timestamp": reflect.TypeOf(time.Time{}),
+	"blob":      reflect.TypeOf([]byte(nil)),
+}
+
+/*
+A kind of table. Validate checks the parameters of the table and Open creates its RowSource.
+Errors should be created using Table.Errorf, so that they name the table and the field.
+*/
+type Backend interface{
+	Validate(t *Table) error
+	Open(env *Env,t *Table) (api.RowSource,error)
+}
+
+var (
+	backendsLock sync.RWMutex
+	backends = make(map[string]Backend)
+)
+
+/* Registers a backend. Registering the same name twice replaces the backend. */
+func Register(name string,b Backend) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	backends[name] = b
+}
+
+func getBackend(name string) Backend {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+	return backends[name]
+}
+
+/* Returns the names of the registered backends. */
+func Backends() []string {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+	names := make([]string,0,len(backends))
+	for name := range backends { names = append(names,name) }
+	sort.Strings(names)
+	return names
+}
+
+/*
+Parses a configuration document. The format is "yaml", "json" or "toml".
+*/
+func Parse(data []byte,format string) (*Config,error) {
+	c := new(Config)
+	var err error
+	switch format {
+	case "yaml","yml":
+		err = yaml.UnmarshalStrict(data,c)
+	case "json":
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.DisallowUnknownFields()
+		err = d.Decode(c)
+	case "toml":
+		err = toml.Unmarshal(data,c)
+	default:
+		return nil,fmt.Errorf("config: unknown format %q",format)
+	}
+	if err!=nil { return nil,err }
+	for i,t := range c.Tables {
+		if t!=nil { t.index = i }
+	}
+	return c,nil
+}
+
+/*
+Reads a configuration file. The format is determined by the extension of the file name.
+*/
+func Load(path string) (*Config,error) {
+	data,err := ioutil.ReadFile(path)
+	if err!=nil { return nil,err }
+	c,err := Parse(data,strings.TrimPrefix(filepath.Ext(path),"."))
+	if err!=nil { return nil,fmt.Errorf("%s: %v",path,err) }
+	return c,nil
+}
+
+/*
+Checks the configuration without opening any table. Returns Errors, if the
+configuration is invalid.
+*/
+func (c *Config) Validate() error {
+	var errs Errors
+	add := func(err error) {
+		if err==nil { return }
+		if e,ok := err.(*Error); ok {
+			errs = append(errs,e)
+		} else {
+			errs = append(errs,&Error{"?","",err})
+		}
+	}
+	names := make(map[string]bool,len(c.Tables))
+	for i,t := range c.Tables {
+		if t==nil {
+			add(&Error{fmt.Sprintf("#%d",i+1),"",fmt.Errorf("empty entry")})
+			continue
+		}
+		if t.Name=="" {
+			add(t.Errorf("name","missing"))
+		} else if strings.HasPrefix(t.Name,".") || strings.HasSuffix(t.Name,".") || strings.Contains(t.Name,"..") {
+			add(t.Errorf("name","empty namespace in qualified name"))
+		} else if names[t.Name] {
+			add(t.Errorf("name","duplicate table"))
+		}
+		names[t.Name] = true
+		
+		exposed := make(map[string]bool,len(t.Columns))
+		for j,col := range t.Columns {
+			field := fmt.Sprintf("columns[%d]",j)
+			if col==nil {
+				add(t.Errorf(field,"empty entry"))
+				continue
+			}
+			if col.Name=="" { add(t.Errorf(field+".name","missing")) }
+			if col.Type!="" {
+				if _,ok := TypeNames[col.Type]; !ok { add(t.Errorf(field+".type","unknown type %q",col.Type)) }
+			}
+			if exposed[col.Exposed()] { add(t.Errorf(field,"duplicate column %q",col.Exposed())) }
+			exposed[col.Exposed()] = true
+		}
+		
+		if t.Backend=="" {
+			add(t.Errorf("backend","missing"))
+			continue
+		}
+		b := getBackend(t.Backend)
+		if b==nil {
+			add(t.Errorf("backend","unknown backend %q, expected one of %s",t.Backend,strings.Join(Backends(),", ")))
+			continue
+		}
+		add(b.Validate(t))
+	}
+	if len(errs)!=0 { return errs }
+	return nil
+}
+
+/*
+A DataSource built from a configuration. Close releases the resources,
+such as database connections, held by the backends.
+*/
+type DataSource struct{
+	api.Namespaces
+	Env *Env
+}
+func (d *DataSource) Close() error { return d.Env.Close() }
+
+/*
+Adds a table. A qualified name, such as crm.public.users, places the table into
+nested namespaces.
+*/
+func (d *DataSource) add(name string,src api.RowSource) {
+	path := strings.Split(name,".")
+	n := &d.Namespaces
+	for _,p := range path[:len(path)-1] {
+		if n.Spaces==nil { n.Spaces = make(map[string]api.DataSource) }
+		child,ok := n.Spaces[p].(*api.Namespaces)
+		if !ok {
+			child = new(api.Namespaces)
+			n.Spaces[p] = child
+		}
+		n = child
+	}
+	if n.Default==nil { n.Default = make(api.DataSourceImpl) }
+	n.Default.(api.DataSourceImpl)[path[len(path)-1]] = src
+}
+
+/*
+Validates the configuration and opens the tables. Relative file names are
+resolved against dir.
+*/
+func (c *Config) Open(dir string) (*DataSource,error) {
+	err := c.Validate()
+	if err!=nil { return nil,err }
+	env := NewEnv(dir)
+	ds := &DataSource{Env:env}
+	for _,t := range c.Tables {
+		src,err := getBackend(t.Backend).Open(env,t)
+		if err==nil && len(t.Columns)!=0 { src,err = newColumnSource(t,src) }
+		if err!=nil {
+			env.Close()
+			if _,ok := err.(*Error); !ok { err = &Error{t.ref(),"",err} }
+			return nil,err
+		}
+		ds.add(t.Name,src)
+	}
+	return ds,nil
+}
+
+/* Loads the configuration file and opens its tables. */
+func LoadDataSource(path string) (*DataSource,error) {
+	c,err := Load(path)
+	if err!=nil { return nil,err }
+	return c.Open(filepath.Dir(path))
+}
@@ -0,0 +1,71 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package config
+
+import "io"
+import "path/filepath"
+import "sync"
+
+/*
+The environment, the backends open their tables in. It holds the resources,
+that are shared by multiple tables, such as database connections.
+*/
+type Env struct{
+	Dir string /* Relative file names are resolved against Dir. */
+	
+	lock    sync.Mutex
+	shared  map[string]io.Closer
+	closers []io.Closer
+}
+
+func NewEnv(dir string) *Env {
+	return &Env{Dir:dir,shared:make(map[string]io.Closer)}
+}
+
+/* Resolves a file name against Dir. */
+func (e *Env) Path(name string) string {
+	if filepath.IsAbs(name) || e.Dir=="" { return name }
+	return filepath.Join(e.Dir,name)
+}
+
+/*
+Returns the resource registered under key, or calls open to create it.
+The resource is closed, once the Env is closed.
+*/
+func (e *Env) Shared(key string,open func() (io.Closer,error)) (io.Closer,error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if c,ok := e.shared[key]; ok { return c,nil }
+	c,err := open()
+	if err!=nil { return nil,err }
+	e.shared[key] = c
+	e.closers = append(e.closers,c)
+	return c,nil
+}
+
+/* Closes the shared resources, in reverse order. Returns the first error. */
+func (e *Env) Close() (err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for i := len(e.closers)-1; i>=0; i-- {
+		if cerr := e.closers[i].Close(); err==nil { err = cerr }
+	}
+	e.closers = nil
+	e.shared = make(map[string]io.Closer)
+	return
+}
@@ -0,0 +1,236 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+/*
+Joins over two or more tables (or other datasources, potentially).
+
+The simplest way to run a query is Query:
+
+	rows,err := datajoin.Query(ctx,ds,"SELECT c.name, o.total FROM customers c, orders o WHERE c.id = o.customer AND c.id = ?",42)
+	if err!=nil { ... }
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var total float64
+		if err := rows.Scan(&name,&total); err!=nil { ... }
+	}
+	if err := rows.Err(); err!=nil { ... }
+*/
+package datajoin
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "github.com/mad-day/datajoin/aggregate"
+import "github.com/mad-day/datajoin/api"
+import "github.com/mad-day/datajoin/query"
+import "github.com/mad-day/datajoin/join"
+import "github.com/spf13/cast"
+import "context"
+import "fmt"
+import "io"
+import "reflect"
+import "strings"
+import "time"
+
+/*
+Runs the query against the DataSource. The placeholders (? or $n) of the query
+are bound to args.
+*/
+func Query(ctx context.Context,ds api.DataSource,q string,args ...interface{}) (*Rows,error) {
+	return QueryWith(ctx,query.DataContext{DS:ds},q,args...)
+}
+
+/*
+Runs the query using the given planner, such as a query.DataContext with a plan
+cache, or a *query.Engine with custom functions.
+*/
+func QueryWith(ctx context.Context,p join.Planner,q string,args ...interface{}) (*Rows,error) {
+	stmt,err := join.Prepare(p,q)
+	if err!=nil { return nil,err }
+	return Exec(ctx,stmt,args...)
+}
+
+/*
+Executes a prepared statement.
+*/
+func Exec(ctx context.Context,stmt *join.Stmt,args ...interface{}) (*Rows,error) {
+	nctx,cancel := context.WithCancel(ctx)
+	iter,err := stmt.Execute(sql.NewContext(nctx),args...)
+	if err!=nil {
+		cancel()
+		return nil,err
+	}
+	s := stmt.Schema()
+	shapes := aggregate.SchemaShapes(stmt.Tree)
+	cols := make([]Column,len(s))
+	for i,c := range s { cols[i] = Column{c.Name,c.Type,shapes[i],c.Nullable} }
+	return &Rows{cols:cols,iter:iter,cancel:cancel},nil
+}
+
+type Column struct{
+	Name     string
+	Type     sql.Type
+	Shape    sql.Type /* The structure of dict and array values, see aggregate.SchemaShapes(). */
+	Nullable bool
+}
+
+/*
+A cursor over the result of a query.
+*/
+type Rows struct{
+	cols   []Column
+	iter   sql.RowIter
+	cancel func()
+	row    sql.Row
+	err    error
+	closed bool
+}
+
+func (r *Rows) Columns() []Column { return r.cols }
+
+/*
+Advances to the next row. Returns false at the end of the result, or on error.
+The cursor is closed automatically, once Next returns false.
+*/
+func (r *Rows) Next() bool {
+	if r.closed { return false }
+	row,err := r.iter.Next()
+	if err!=nil {
+		if err!=io.EOF { r.err = err }
+		r.Close()
+		return false
+	}
+	r.row = row
+	return true
+}
+
+/* Returns the error, that occurred during the iteration, if any. */
+func (r *Rows) Err() error { return r.err }
+
+func (r *Rows) Close() error {
+	if r.closed { return nil }
+	r.closed = true
+	err := r.iter.Close()
+	r.cancel()
+	if r.err==nil && err!=nil { r.err = err }
+	return err
+}
+
+/* Returns the values of the current row. */
+func (r *Rows) Values() []interface{} {
+	return append([]interface{}(nil),r.row...)
+}
+
+/*
+Copies the values of the current row into the values pointed at by dest.
+The values are converted into the type of the destination, if necessary.
+*/
+func (r *Rows) Scan(dest ...interface{}) error {
+	if r.row==nil { return fmt.Errorf("Scan called without calling Next") }
+	if len(dest)!=len(r.row) { return fmt.Errorf("expected %d destinations, got %d",len(r.row),len(dest)) }
+	for i,d := range dest {
+		dv := reflect.ValueOf(d)
+		if dv.Kind()!=reflect.Ptr || dv.IsNil() { return fmt.Errorf("destination %d is not a non-nil pointer",i+1) }
+		err := setValue(dv.Elem(),r.row[i])
+		if err!=nil { return fmt.Errorf("column %q: %v",r.cols[i].Name,err) }
+	}
+	return nil
+}
+
+/*
+Copies the values of the current row into the fields of the struct pointed at by dest.
+A field receives the column named by its `datajoin:"name"` tag, or else the column,
+whose name equals the field name, ignoring case. Fields tagged with "-" are skipped,
+as are columns without a matching field.
+*/
+func (r *Rows) ScanStruct(dest interface{}) error {
+	if r.row==nil { return fmt.Errorf("ScanStruct called without calling Next") }
+	dv := reflect.ValueOf(dest)
+	if dv.Kind()!=reflect.Ptr || dv.Elem().Kind()!=reflect.Struct { return fmt.Errorf("destination is not a pointer to a struct") }
+	sv := dv.Elem()
+	st := sv.Type()
+	for i,c := range r.cols {
+		for j := 0; j<st.NumField(); j++ {
+			f := st.Field(j)
+			if f.PkgPath!="" { continue }
+			name := f.Tag.Get("datajoin")
+			if name=="-" { continue }
+			if name=="" && !strings.EqualFold(f.Name,c.Name) { continue }
+			if name!="" && name!=c.Name { continue }
+			err := setValue(sv.Field(j),r.row[i])
+			if err!=nil { return fmt.Errorf("column %q: %v",c.Name,err) }
+			break
+		}
+	}
+	return nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func setValue(e reflect.Value,v interface{}) (err error) {
+	if v==nil {
+		e.Set(reflect.Zero(e.Type()))
+		return nil
+	}
+	vv := reflect.ValueOf(v)
+	if vv.Type().AssignableTo(e.Type()) {
+		e.Set(vv)
+		return nil
+	}
+	switch e.Kind() {
+	case reflect.Ptr:
+		p := reflect.New(e.Type().Elem())
+		err = setValue(p.Elem(),v)
+		if err==nil { e.Set(p) }
+		return
+	case reflect.String:
+		var s string
+		s,err = cast.ToStringE(v)
+		if err==nil { e.SetString(s) }
+		return
+	case reflect.Int,reflect.Int8,reflect.Int16,reflect.Int32,reflect.Int64:
+		var i int64
+		i,err = cast.ToInt64E(v)
+		if err==nil { e.SetInt(i) }
+		return
+	case reflect.Uint,reflect.Uint8,reflect.Uint16,reflect.Uint32,reflect.Uint64:
+		var u uint64
+		u,err = cast.ToUint64E(v)
+		if err==nil { e.SetUint(u) }
+		return
+	case reflect.Float32,reflect.Float64:
+		var f float64
+		f,err = cast.ToFloat64E(v)
+		if err==nil { e.SetFloat(f) }
+		return
+	case reflect.Bool:
+		var b bool
+		b,err = cast.ToBoolE(v)
+		if err==nil { e.SetBool(b) }
+		return
+	}
+	if e.Type()==timeType {
+		var t time.Time
+		t,err = cast.ToTimeE(v)
+		if err==nil { e.Set(reflect.ValueOf(t)) }
+		return
+	}
+	if vv.Type().ConvertibleTo(e.Type()) {
+		e.Set(vv.Convert(e.Type()))
+		return nil
+	}
+	return fmt.Errorf("can't convert %T into %v",v,e.Type())
+}
@@ -0,0 +1,30 @@
+module github.com/mad-day/datajoin
+
+go 1.17
+
+require (
+	github.com/BurntSushi/toml v0.3.1
+	github.com/chzyer/readline v0.0.0-20180603132655-2972be24d48e
+	github.com/dgryski/go-farm v0.0.0-20190423205320-6a90982ecee2
+	github.com/emirpasic/gods v1.12.0
+	github.com/lib/pq v1.0.0
+	github.com/spf13/cast v1.3.0
+	golang.org/x/crypto v0.0.0-20181203042331-505ab145d0a9
+	gopkg.in/src-d/go-mysql-server.v0 v0.1.0
+	gopkg.in/src-d/go-vitess.v1 v1.1.0
+	gopkg.in/yaml.v2 v2.2.2
+)
+
+require (
+	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
+	github.com/golang/protobuf v1.2.0 // indirect
+	github.com/mitchellh/hashstructure v1.0.0 // indirect
+	github.com/opentracing/opentracing-go v1.0.2 // indirect
+	github.com/pkg/errors v0.8.0 // indirect
+	github.com/sirupsen/logrus v1.1.0 // indirect
+	golang.org/x/net v0.0.0-20180926154720-4dfa2610cdf3 // indirect
+	golang.org/x/sys v0.0.0-20180905080454-ebe1bf3edb33 // indirect
+	google.golang.org/genproto v0.0.0-20180817151627-c66870c02cf8 // indirect
+	google.golang.org/grpc v1.15.0 // indirect
+	gopkg.in/src-d/go-errors.v1 v1.0.0 // indirect
+)
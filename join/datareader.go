@@ -22,6 +22,8 @@ import "github.com/mad-day/datajoin/api"
 import "github.com/mad-day/datajoin/join/apis"
 import "github.com/mad-day/datajoin/join/matcher"
 import "github.com/mad-day/datajoin/query"
+import "io"
+import "sync/atomic"
 import "time"
 import "github.com/spf13/cast"
 
@@ -129,7 +131,7 @@ type SpecBuilder struct{
 	Base []TargetedExpressions
 	PerTable [][]TargetedExpressions
 }
-func NewSpecBuilder(tables []*query.AdHocTable, specs matcher.FieldSpecs) (sb *SpecBuilder) {
+func NewSpecBuilder(tables []query.Leg, specs matcher.FieldSpecs) (sb *SpecBuilder) {
 	sb = new(SpecBuilder)
 	col := 0
 	cm := make(map[string]int)
@@ -203,11 +205,12 @@ func (s *SpecBuilder) SpecsSetRows(ctx *sql.Context,tab int,rows []sql.Row,specs
 	}
 	return nil
 }
-func (s *SpecBuilder) Lookup(src api.RowSource,specs []interface{}) (api.RowIter, error) {
-	ts := make([]interface{},len(specs))
+func (s *SpecBuilder) Lookup(src api.RowSource,specs []interface{},extra ...interface{}) (api.RowIter, error) {
+	ts := make([]interface{},len(specs),len(specs)+len(extra))
 	for i,spec := range specs {
-		ts[i] = api.Spec{s.Names[i],s.Specs[i].Conv(spec)}
+		ts[i] = api.Spec{Column:s.Names[i],Values:s.Specs[i].Conv(spec)}
 	}
+	ts = append(ts,extra...)
 	return src.Lookup(ts...)
 }
 
@@ -218,20 +221,57 @@ type iteration struct{
 	chunk int
 	endpt apis.BlockEndpoint
 	onErrorDrop bool
+	stats *JoinStats
+	derived [][]sql.Row /* Materialised rows of the legs, that aren't AdHocTables. */
+	nested bool /* Nested-document output mode. See NestedRowIter(). */
+}
+
+/*
+Reports, whether the rows of the table tab may be split into multiple chunks.
+If the driving table is read in order, or the rows are grouped into nested documents,
+the other tables must not be split, otherwise the rows belonging to one row of the
+driving table would no longer be emitted consecutively.
+*/
+func (r *iteration) split(tab int) bool {
+	return tab==0 || (r.SrcOrder==nil && !r.nested)
 }
 func (r *iteration) recurse(tab int) error {
 	if tab>=len(r.Tables) {
 		return r.endpt.PassTabBlockRow(r.blocks)
 	}
+	table,ok := r.Tables[tab].(*query.AdHocTable)
+	if !ok { return r.recurseDerived(tab) }
 	specs,err := r.Indexer2[tab].BaseSpecs(r.ctx)
 	if err!=nil { return err }
 	for i,block := range r.blocks[:tab] {
 		err := r.Indexer2[tab].SpecsSetRows(r.ctx,i,block,specs)
 		if err!=nil { return err }
 	}
-	ri,err := r.Indexer2[tab].Lookup(r.Tables[tab].ItsSrc,specs)
+	var extra []interface{}
+	if r.Pushdown[tab]!=nil {
+		pd,err := api.BindLiterals(r.ctx,r.Pushdown[tab])
+		if err!=nil { return err }
+		extra = append(extra,api.SpecExpr{Expr:pd})
+	}
+	if tab==0 {
+		for _,o := range r.SrcOrder { extra = append(extra,o) }
+	}
+	if r.Limit!=0 && len(r.Tables)==1 && r.Prefilter[tab]==nil && (len(r.Order)==0 || r.SrcOrder!=nil) {
+		/*
+		The source evaluates all filters of a single-table join,
+		so every row it returns will be part of the result. Unless the
+		source delivers the required order, the top-N heap needs all rows.
+		*/
+		extra = append(extra,api.SpecLimit{N:r.Limit})
+	}
+	ri,err := r.Indexer2[tab].Lookup(table.ItsSrc,specs,extra...)
 	if err!=nil { return err }
 	defer ri.Close()
+	var ts *TableStats
+	if r.stats!=nil {
+		ts = &r.stats.Tables[tab]
+		atomic.AddInt64(&ts.Lookups,1)
+	}
 	rows := r.blocks[tab][:0]
 	for ri.Next() {
 		row,err := ri.Fetch()
@@ -239,12 +279,15 @@ func (r *iteration) recurse(tab int) error {
 			if r.onErrorDrop { continue }
 			return err
 		}
+		if ts!=nil { atomic.AddInt64(&ts.Fetched,1) }
 		if r.Prefilter[tab]!=nil {
 			bol,_ := r.Prefilter[tab].Eval(r.ctx,sql.Row(row))
 			if !cast.ToBool(bol) { continue }
 		}
+		if ts!=nil { atomic.AddInt64(&ts.Passed,1) }
 		rows = append(rows,sql.Row(row))
-		if len(rows)>=r.chunk {
+		
+		if len(rows)>=r.chunk && r.split(tab) {
 			r.blocks[tab] = rows
 			rows = rows[:0]
 			err = r.recurse(tab+1)
@@ -261,8 +304,67 @@ func (r *iteration) recurse(tab int) error {
 }
 
 
+/*
+Reads a leg, that isn't an AdHocTable, such as a subquery. It can't receive Lookup
+specs, so it is read as a whole. The driving leg is streamed in chunks, any other
+leg is materialised once and then joined to every chunk of the legs before it.
+Its rows still provide the Lookup specs for the legs after it.
+*/
+func (r *iteration) recurseDerived(tab int) error {
+	rows := r.derived[tab]
+	if rows==nil {
+		var ts *TableStats
+		if r.stats!=nil {
+			ts = &r.stats.Tables[tab]
+			atomic.AddInt64(&ts.Lookups,1)
+		}
+		iter,err := r.Tables[tab].RowIter(r.ctx)
+		if err!=nil { return err }
+		defer iter.Close()
+		rows = []sql.Row{}
+		for {
+			row,err := iter.Next()
+			if err==io.EOF { break }
+			if err!=nil { return err }
+			if ts!=nil { atomic.AddInt64(&ts.Fetched,1) }
+			if r.Prefilter[tab]!=nil {
+				bol,_ := r.Prefilter[tab].Eval(r.ctx,row)
+				if !cast.ToBool(bol) { continue }
+			}
+			if ts!=nil { atomic.AddInt64(&ts.Passed,1) }
+			rows = append(rows,row)
+			if tab==0 && len(rows)>=r.chunk {
+				r.blocks[tab] = rows
+				err = r.recurse(tab+1)
+				if err!=nil { return err }
+				if err := r.ctx.Err(); err!=nil { return err }
+				rows = rows[:0]
+			}
+		}
+		if tab==0 {
+			if len(rows)==0 { return nil }
+			r.blocks[tab] = rows
+			return r.recurse(tab+1)
+		}
+		r.derived[tab] = rows
+	}
+	for len(rows)!=0 {
+		n := len(rows)
+		if n>r.chunk && r.split(tab) { n = r.chunk }
+		r.blocks[tab] = rows[:n]
+		rows = rows[n:]
+		err := r.recurse(tab+1)
+		if err!=nil { return err }
+		if err := r.ctx.Err(); err!=nil { return err }
+	}
+	return nil
+}
+
 func (r *RealJoin) IterateOver(ctx *sql.Context,endpt apis.BlockEndpoint,chunk int) error {
-	iter := &iteration{r,make([][]sql.Row,len(r.Tables)),ctx,chunk,endpt,false}
+	return r.iterateOver(ctx,endpt,chunk,false)
+}
+func (r *RealJoin) iterateOver(ctx *sql.Context,endpt apis.BlockEndpoint,chunk int,nested bool) error {
+	iter := &iteration{r,make([][]sql.Row,len(r.Tables)),ctx,chunk,endpt,false,statsFor(ctx,r),make([][]sql.Row,len(r.Tables)),nested}
 	return iter.recurse(0)
 }
 
@@ -94,4 +94,12 @@ func (tht *TrueHashTable) LookupDirect(h [2]uint64) []sql.Row {
 	return tht.Rows[pair[0]:pair[1]]
 }
 
+/*
+Like LookupDirect, but also returns the index of the first row in Rows.
+*/
+func (tht *TrueHashTable) LookupIndex(h [2]uint64) (uint,[]sql.Row) {
+	pair := tht.Map[h]
+	return pair[0],tht.Rows[pair[0]:pair[1]]
+}
+
 
@@ -24,6 +24,12 @@ import farm "github.com/dgryski/go-farm"
 import "hash"
 import "github.com/mad-day/datajoin/join/matcher"
 import "github.com/spf13/cast"
+import "errors"
+
+/*
+Returned by PassingIterator, once Limit rows have been passed to the Endpoint.
+*/
+var ELimitReached = errors.New("limit reached")
 
 
 type MergeTableHash struct{
@@ -38,6 +44,21 @@ type PassingIterator struct{
 	Tables []*TrueHashTable
 	Postfilters []sql.Expression
 	Chunk  int
+	
+	/* If Limit>0, stop after Limit rows satisfying Finalfilter. */
+	Limit       int64
+	Finalfilter sql.Expression
+	count       int64
+	
+	/*
+	If true, one int64 per table is appended to every result row, that identifies the
+	row of that table, it was joined from. Rows of different blocks never share a position.
+	*/
+	Positions   bool
+	seen        int64
+	pos         []int64
+	base        []int64
+	
 	fu  hash.Hash
 	buf []byte
 	result []sql.Row
@@ -86,8 +107,18 @@ func (pi *PassingIterator) PassTabBlockRow(tabs [][]sql.Row) error {
 		pi.result = pi.result[:0]
 	}
 	
+	if pi.Positions {
+		pi.pos = make([]int64,len(tabs))
+		pi.base = make([]int64,len(tabs))
+		for i,block := range tabs {
+			pi.base[i] = pi.seen
+			pi.seen += int64(len(block))
+		}
+	}
+	
 	wblk := make(sql.Row,0,width)
-	for _,row := range tabs[0] {
+	for k,row := range tabs[0] {
+		if pi.Positions { pi.pos[0] = pi.base[0]+int64(k) }
 		err := pi.perform(1,append(wblk,row...))
 		if err!=nil { return err }
 	}
@@ -101,27 +132,41 @@ func (pi *PassingIterator) PassTabBlockRow(tabs [][]sql.Row) error {
 }
 func (pi *PassingIterator) perform(i int,row sql.Row) (e error) {
 	if len(pi.Tables)<=i {
+		if pi.Limit>0 {
+			if pi.Finalfilter!=nil {
+				res,_ := pi.Finalfilter.Eval(pi.Ctx,row)
+				if !cast.ToBool(res) { return nil }
+			}
+			pi.count++
+		}
+		
 		/* Make a copy of this row. */
-		coro := make(sql.Row,len(row))
+		coro := make(sql.Row,len(row),len(row)+len(pi.pos))
 		copy(coro,row)
+		if pi.Positions {
+			for _,p := range pi.pos { coro = append(coro,p) }
+		}
 		
 		/* Append this copy to the result-set. */
 		pi.result = append(pi.result,coro)
 		
-		/* If the resultset reaches a certain size, flush it. */
-		if len(pi.result)>=pi.Chunk {
+		/* If the resultset reaches a certain size, or the limit is reached, flush it. */
+		done := pi.Limit>0 && pi.count>=pi.Limit
+		if len(pi.result)>=pi.Chunk || done {
 			rs := pi.result
 			pi.result = pi.result[:0]
-			return pi.Endpt.PassResults(rs)
+			e = pi.Endpt.PassResults(rs)
+			if e==nil && done { e = ELimitReached }
 		}
-		return nil
+		return
 	}
 	pi.buf,e = Hash(pi.buf,pi.Ctx,row,pi.fu,pi.Hashes[i].Left...)
 	h1,h2 := farm.Hash128(pi.buf)
 	if e!=nil { return }
 	
-	ret := pi.Tables[i].LookupDirect([2]uint64{h1,h2})
-	for _,right := range ret {
+	start,ret := pi.Tables[i].LookupIndex([2]uint64{h1,h2})
+	for j,right := range ret {
+		if pi.Positions { pi.pos[i] = pi.base[i]+int64(start)+int64(j) }
 		nr := append(row,right...)
 		res,_ := pi.Postfilters[i].Eval(pi.Ctx,nr)
 		if !cast.ToBool(res) { continue }
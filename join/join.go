@@ -19,9 +19,11 @@ package join
 
 import "gopkg.in/src-d/go-mysql-server.v0/sql"
 import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "github.com/mad-day/datajoin/api"
 import "github.com/mad-day/datajoin/query"
 import "github.com/mad-day/datajoin/join/matcher"
 import "fmt"
+import "strings"
 
 func GetAll(node sql.Node) (mjs []*query.MultiJoin) {
 	var f func(node sql.Node)
@@ -36,36 +38,49 @@ func GetAll(node sql.Node) (mjs []*query.MultiJoin) {
 	f(node)
 	return
 }
-func GetTables(mj *query.MultiJoin) (aht []*query.AdHocTable) {
-	aht = make([]*query.AdHocTable,0,len(mj.Tables))
+func GetTables(mj *query.MultiJoin) (legs []query.Leg) {
+	legs = make([]query.Leg,0,len(mj.Tables))
 	for _,tab := range mj.Tables {
-		t,ok := tab.(*query.AdHocTable)
+		t,ok := tab.(query.Leg)
 		if !ok { panic("invalid table") }
-		aht = append(aht,t)
+		legs = append(legs,t)
 	}
 	return
 }
 
+/* Returns the RowSource of the leg, or nil, if the leg isn't an AdHocTable. */
+func legSource(leg query.Leg) api.RowSource {
+	if t,ok := leg.(*query.AdHocTable); ok { return t.ItsSrc }
+	return nil
+}
+
 
 type RealJoin struct{
 	*query.Cookie
-	Tables     []*query.AdHocTable
+	Tables     []query.Leg /* AdHocTables and other nodes (subqueries), that can't receive Lookup specs. */
 	Offsets    []int
 	Dominated  []sql.Expression /* Dominated specifiers. */
 	Equals     []sql.Expression /* Straight equals. Suitable for Hash Join. */
 	Filters    []sql.Expression /* Other filters. */
 	
 	Prefilter  []sql.Expression /* Per-Table input filters. */
+	Pushdown   []sql.Expression /* Per-Table input filters, evaluated by the RowSource. */
 	Indexer    []matcher.FieldSpecs /* Index-Scan hints. */
 	Indexer2   []*SpecBuilder /* Preprocessed version of .Indexer */
 	Postfilter []sql.Expression
 	Chunk     int
+	
+	Limit      int64 /* Maximum number of rows needed. 0 means unlimited. */
+	Fullfilter sql.Expression /* All filters. Evaluated before the rows are counted against Limit. */
+	
+	Order      []query.OrderField /* Required ordering of the first Limit rows. */
+	SrcOrder   []api.SpecOrder /* Ordering of the driving table, if its RowSource provides it. */
 }
 func (r *RealJoin) String() string {
 	tp := sql.NewTreePrinter()
 	tp.WriteNode("RealJoin")
 	
-	var ch1,ch2,ch3 string
+	var ch1,ch2,ch3,ch4 string
 	
 	{
 		filt := make([]string,len(r.Prefilter))
@@ -81,6 +96,20 @@ func (r *RealJoin) String() string {
 		exprs.WriteChildren(filt...)
 		ch1 = exprs.String()
 	}
+	{
+		filt := make([]string,len(r.Pushdown))
+		for i,e := range r.Pushdown {
+			if e==nil {
+				filt[i] = fmt.Sprintf("%s : TRUE",r.Tables[i].Name())
+			} else {
+				filt[i] = fmt.Sprintf("%s : %v",r.Tables[i].Name(),e)
+			}
+		}
+		exprs := sql.NewTreePrinter()
+		exprs.WriteNode("Pushdown")
+		exprs.WriteChildren(filt...)
+		ch4 = exprs.String()
+	}
 	{
 		filt := make([]string,len(r.Indexer))
 		for i,e := range r.Indexer {
@@ -105,21 +134,90 @@ func (r *RealJoin) String() string {
 		exprs.WriteChildren(filt...)
 		ch3 = exprs.String()
 	}
-	tp.WriteChildren(
+	chs := []string{
 		//fmt.Sprintf("Hash-Rules%s",expression.Tuple(r.Equals)),
 		ch1,
+		ch4,
 		ch2,
 		ch3,
-	)
+	}
+	if len(r.Order)!=0 {
+		o := make([]string,len(r.Order))
+		for i,e := range r.Order { o[i] = e.String() }
+		if r.SrcOrder!=nil {
+			chs = append(chs,fmt.Sprintf("Order(%s) by %s",strings.Join(o,", "),r.Tables[0].Name()))
+		} else if r.Limit>0 {
+			chs = append(chs,fmt.Sprintf("Top-N(%s)",strings.Join(o,", ")))
+		}
+	}
+	if r.Limit!=0 { chs = append(chs,fmt.Sprintf("Limit(%d)",r.Limit)) }
+	for _,t := range r.Tables {
+		if _,ok := t.(*query.AdHocTable); !ok { chs = append(chs,t.String()) }
+	}
+	tp.WriteChildren(chs...)
 	
 	return tp.String()
 }
+func splitAnd(expr sql.Expression,exprs []sql.Expression) []sql.Expression {
+	if v,ok := expr.(*expression.And); ok {
+		return splitAnd(v.Right,splitAnd(v.Left,exprs))
+	}
+	return append(exprs,expr)
+}
+
+/*
+Splits the input filters of a table into the residual part, that is evaluated
+by the join, and the part, that is evaluated by the RowSource. If src is nil,
+all filters are evaluated by the join.
+*/
+func splitPushdown(src api.RowSource,filters []sql.Expression) (residual,pushed sql.Expression) {
+	fs,ok := src.(api.FilterableSource)
+	if !ok { return expression.JoinAnd(filters...),nil }
+	var res,push []sql.Expression
+	for _,f := range filters {
+		for _,c := range splitAnd(f,nil) {
+			/*
+			Equal compares NULL with NULL as being equal, which the RowSource
+			can't know of. Keep it in the join.
+			*/
+			_,isEqual := c.(query.Equal)
+			if !isEqual && fs.CanPush(c) {
+				push = append(push,c)
+			} else {
+				res = append(res,c)
+			}
+		}
+	}
+	return expression.JoinAnd(res...),expression.JoinAnd(push...)
+}
+
+/*
+Returns the ordering, the driving table's RowSource has to provide in order to
+satisfy the ordering requirement, or nil if it can't.
+*/
+func sourceOrder(tab query.Leg,order []query.OrderField) (so []api.SpecOrder) {
+	if len(order)==0 { return nil }
+	os,ok := legSource(tab).(api.OrderedSource)
+	if !ok { return nil }
+	so = make([]api.SpecOrder,len(order))
+	for i,o := range order {
+		f,ok := matcher.IsFieldOf(o.Expr,tab.Name())
+		if !ok { return nil }
+		so[i] = api.SpecOrder{Column:f,Desc:o.Desc}
+	}
+	if !os.CanOrder(so) { return nil }
+	return
+}
+
 func NewRealJoin(mj *query.MultiJoin) (r *RealJoin) {
 	r = new(RealJoin)
 	r.Cookie = mj.Cookie
 	r.Tables = GetTables(mj)
+	r.Limit = mj.Limit
+	if r.Limit!=0 { r.Fullfilter = expression.JoinAnd(mj.Filters...) }
+	r.Order = mj.Order
+	r.SrcOrder = sourceOrder(r.Tables[0],r.Order)
 	for _,e := range mj.Filters {
-		fmt.Println(matcher.MinimumTables(r.Tables,e),":",e)
 		if matcher.IsDominated(e) {
 			r.Dominated = append(r.Dominated,e)
 		} else if matcher.IsEqual(e) {
@@ -134,13 +232,9 @@ func NewRealJoin(mj *query.MultiJoin) (r *RealJoin) {
 	} else {
 		flt,_ = matcher.Predict(true).TransformUp(matcher.Wrap)
 	}
-	if len(mj.Filters)!=0 {
-		a := expression.JoinAnd(mj.Filters...)
-		fmt.Println(a)
-		fmt.Println(matcher.Predict(true).TransformUp(matcher.Wrap))
-	}
 	
 	r.Prefilter  = make([]sql.Expression,len(r.Tables))
+	r.Pushdown   = make([]sql.Expression,len(r.Tables))
 	r.Indexer    = make([]matcher.FieldSpecs,len(r.Tables))
 	r.Indexer2   = make([]*SpecBuilder,len(r.Tables))
 	r.Offsets    = make([]int,len(r.Tables))
@@ -162,7 +256,12 @@ func NewRealJoin(mj *query.MultiJoin) (r *RealJoin) {
 		
 		r.Postfilter[i],_ = matcher.Inspect(tsm,flt).TransformUp(matcher.Unwrap)
 		
-		r.Prefilter[i] = expression.JoinAnd(filters...)		
+		r.Prefilter[i],r.Pushdown[i] = splitPushdown(legSource(table),filters)
+		if t,ok := table.(*query.AdHocTable); ok && len(t.Filters)!=0 {
+			pushed := append([]sql.Expression(nil),t.Filters...)
+			if r.Pushdown[i]!=nil { pushed = append(pushed,r.Pushdown[i]) }
+			r.Pushdown[i] = expression.JoinAnd(pushed...)
+		}
 		r.Indexer[i] = matcher.GetIndex(r.Tables[:i+1],mj.Filters)
 		r.Indexer2[i] = NewSpecBuilder(r.Tables,r.Indexer[i])
 		r.Offsets[i] = pos-tsl
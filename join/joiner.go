@@ -43,19 +43,45 @@ func (r *RealJoin) Schema() (s sql.Schema) {
 }
 func (r *RealJoin) Children() []sql.Node { return nil }
 func (r *RealJoin) RowIter(ctx *sql.Context) (sql.RowIter, error) {
+	return r.rowIter(ctx,false),nil
+}
+
+/*
+Starts the join. If nested is true, the rows belonging to one row of the driving
+table are emitted consecutively and Limit is left to the caller, as it counts documents.
+*/
+func (r *RealJoin) rowIter(ctx *sql.Context,nested bool) *rowIter {
 	var cancel func()
 	nctx := new(sql.Context)
 	*nctx = *ctx
 	nctx.Context,cancel = context.WithCancel(nctx.Context)
-	ri := &rowIter{nctx,make(chan sql.Row,r.getPreferedBufferSize()),cancel}
+	ri := &rowIter{ctx:nctx,buffer:make(chan sql.Row,r.getPreferedBufferSize()),cancel:cancel}
 	
 	pi := &hashjoin.PassingIterator{Ctx:nctx,Endpt:ri,Hashes:r.MergeHashes(),Postfilters:r.Postfilter,Chunk:r.getPreferedChunkSize_One()}
+	pi.Limit = r.Limit
+	pi.Finalfilter = r.Fullfilter
+	if nested {
+		pi.Limit = 0
+		pi.Positions = true
+	}
+	
+	var tn *topN
+	if len(r.Order)!=0 && r.SrcOrder==nil && r.Limit>0 && !nested {
+		/* Keep the best rows in a heap, instead of stopping early. */
+		tn = newTopN(nctx,ri,r.Order,r.Fullfilter,r.Limit)
+		pi.Endpt = tn
+		pi.Limit = 0
+	}
 	go func() {
 		defer close(ri.buffer)
-		r.IterateOver(nctx,pi,r.getPreferedChunkSize_Two())
+		err := r.iterateOver(nctx,pi,r.getPreferedChunkSize_Two(),nested)
+		if err==hashjoin.ELimitReached { err = nil }
+		if err==nil && tn!=nil { err = tn.Flush() }
+		/* Stored before close(), so Next() sees it, once the buffer is drained. */
+		ri.err = err
 	}()
 	
-	return ri,nil
+	return ri
 	//return nil,fmt.Errorf("not implemented!")
 }
 var _ sql.Node = (*RealJoin)(nil)
@@ -65,6 +91,7 @@ type rowIter struct{
 	ctx *sql.Context
 	buffer chan sql.Row
 	cancel func()
+	err error
 }
 func (ri *rowIter) PassResults(rs []sql.Row) error {
 	done := ri.ctx.Done()
@@ -87,12 +114,14 @@ func (ri *rowIter) Close() error {
 func (ri *rowIter) Next() (sql.Row, error) {
 	select {
 	case row := <- ri.buffer:
-		if len(row)==0 { return nil,io.EOF }
+		if len(row)==0 {
+			if ri.err!=nil { return nil,ri.err }
+			return nil,io.EOF
+		}
 		return row,nil
 	case <- ri.ctx.Done():
 		return nil,ri.ctx.Err()
 	}
-	panic("unreachable")
 }
 var _ sql.RowIter = (*rowIter)(nil)
 
@@ -41,7 +41,7 @@ func predictsBool(expr sql.Expression,b bool) bool {
 	return true
 }
 
-func MinimumTables(tabs []*query.AdHocTable,expr sql.Expression) (i int) {
+func MinimumTables(tabs []query.Leg,expr sql.Expression) (i int) {
 	switch v := expr.(type) {
 	case *expression.GetField:
 		t := v.Table()
@@ -50,7 +50,7 @@ func (t TableSetMap) Has(s string) bool { return t[s] }
 type TableSetSimple string
 func (t TableSetSimple) Has(s string) bool { return string(t)==s }
 
-func TableSetFor(tabs []*query.AdHocTable) TableSet {
+func TableSetFor(tabs []query.Leg) TableSet {
 	switch len(tabs) {
 	case 0: return TableSetMap(nil)
 	case 1: return TableSetSimple(tabs[0].Name())
@@ -198,7 +198,7 @@ func (fs FieldSpecs) String() string {
 }
 
 
-func GetIndex(tabs []*query.AdHocTable,exprs []sql.Expression) (fs FieldSpecs) {
+func GetIndex(tabs []query.Leg,exprs []sql.Expression) (fs FieldSpecs) {
 	fs = make(FieldSpecs)
 	//var tab TableSetSimple
 	table := tabs[len(tabs)-1].Name()
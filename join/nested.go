@@ -0,0 +1,192 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package join
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "github.com/mad-day/datajoin/aggregate"
+import "github.com/mad-day/datajoin/query"
+import "bufio"
+import "fmt"
+import "io"
+
+/* Returns the name of the leg in the query. */
+func legName(leg query.Leg) string {
+	if t,ok := leg.(*query.AdHocTable); ok && t.Alias!="" { return t.Alias }
+	return leg.Name()
+}
+
+func (r *RealJoin) nestNames(names []string) ([]string,error) {
+	if len(names)==0 {
+		for _,t := range r.Tables[1:] { names = append(names,legName(t)) }
+	}
+	if len(names)!=len(r.Tables)-1 { return nil,fmt.Errorf("expected %d names, got %d",len(r.Tables)-1,len(names)) }
+	return names,nil
+}
+
+/*
+Runs the join in the nested-document output mode. Tables[i+1] is nested into Tables[i],
+as an array named names[i]. If names is empty, the table names are used.
+
+In this mode, the join emits one row per row of the driving table, consisting of
+a single column, that holds the document as map[string]interface{}. Limit counts
+documents, not rows of the flat join.
+*/
+func (r *RealJoin) NestedRowIter(ctx *sql.Context,names ...string) (sql.RowIter, error) {
+	names,err := r.nestNames(names)
+	if err!=nil { return nil,err }
+	if len(r.Order)!=0 && r.SrcOrder==nil { return nil,fmt.Errorf("nested documents require the driving table to be read in order") }
+	return newNestIter(r,r.rowIter(ctx,true),names),nil
+}
+
+/*
+The type of the documents of the nested-document output mode.
+*/
+func (r *RealJoin) DocType(names ...string) (*aggregate.DictType,error) {
+	names,err := r.nestNames(names)
+	if err!=nil { return nil,err }
+
+	var doc *aggregate.DictType
+	for i := len(r.Tables)-1; i>=0; i-- {
+		s := r.Tables[i].Schema()
+		fields := make([]aggregate.DictField,0,len(s)+1)
+		for _,c := range s { fields = append(fields,aggregate.DictField{Name:c.Name,Type:c.Type}) }
+		if doc!=nil { fields = append(fields,aggregate.DictField{Name:names[i],Type:aggregate.ListOf(doc)}) }
+		doc = aggregate.NewDictType(fields...)
+	}
+	return doc,nil
+}
+
+/*
+Runs the join in the nested-document output mode and writes one JSON document per line.
+*/
+func (r *RealJoin) WriteJSONLines(ctx *sql.Context,w io.Writer,names ...string) error {
+	t,err := r.DocType(names...)
+	if err!=nil { return err }
+	iter,err := r.NestedRowIter(ctx,names...)
+	if err!=nil { return err }
+	defer iter.Close()
+	bw := bufio.NewWriter(w)
+	for {
+		row,err := iter.Next()
+		if err==io.EOF { break }
+		if err!=nil { return err }
+		data,err := aggregate.MarshalJSON(t,row[0])
+		if err!=nil { return err }
+		data = append(data,'\n')
+		_,err = bw.Write(data)
+		if err!=nil { return err }
+	}
+	return bw.Flush()
+}
+
+/* A row of one of the tables, and the rows of the next table joined to it. */
+type nestNode struct{
+	row   sql.Row
+	list  []*nestNode
+}
+
+/*
+Groups the flat rows of the join into nested documents. In the nested mode, the
+other tables aren't split into chunks, so the join emits all rows belonging to one
+row of the driving table consecutively, and a document is complete as soon as the
+row of the driving table changes.
+
+Every flat row carries the positions of the rows it was joined from. A new node
+starts, whenever the position of its table changes or its parent starts anew, so
+equal rows of a table remain separate entries.
+*/
+type nestIter struct{
+	r      *RealJoin
+	child  sql.RowIter
+	names  [][]string
+	nestAs []string
+	path   []*nestNode
+	last   []int64
+	eof    bool
+	count  int64
+}
+func newNestIter(r *RealJoin,child sql.RowIter,nestAs []string) *nestIter {
+	names := make([][]string,len(r.Tables))
+	for i,t := range r.Tables {
+		for _,c := range t.Schema() { names[i] = append(names[i],c.Name) }
+	}
+	n := len(r.Tables)
+	return &nestIter{r:r,child:child,names:names,nestAs:nestAs,path:make([]*nestNode,n),last:make([]int64,n)}
+}
+func (ni *nestIter) part(row sql.Row,i int) sql.Row {
+	end := len(row)-len(ni.r.Tables)
+	if i+1<len(ni.r.Offsets) { end = ni.r.Offsets[i+1] }
+	return row[ni.r.Offsets[i]:end]
+}
+func (ni *nestIter) doc(n *nestNode,i int) map[string]interface{} {
+	d := make(map[string]interface{},len(n.row)+1)
+	for j,name := range ni.names[i] { d[name] = n.row[j] }
+	if i+1<len(ni.r.Tables) {
+		l := make([]interface{},len(n.list))
+		for j,c := range n.list { l[j] = ni.doc(c,i+1) }
+		d[ni.nestAs[i]] = l
+	}
+	return d
+}
+
+/*
+Adds a flat row to the current document. If it starts a new document, the previous
+one is returned.
+*/
+func (ni *nestIter) add(row sql.Row) (done *nestNode,err error) {
+	pos := row[len(row)-len(ni.r.Tables):]
+	restart := false
+	for i := range ni.path {
+		p,ok := pos[i].(int64)
+		if !ok { return nil,fmt.Errorf("invalid row position %v",pos[i]) }
+		if !restart && ni.path[i]!=nil && ni.last[i]==p { continue }
+		restart = true
+		n := &nestNode{row:ni.part(row,i)}
+		if i==0 {
+			done = ni.path[0]
+		} else {
+			ni.path[i-1].list = append(ni.path[i-1].list,n)
+		}
+		ni.path[i] = n
+		ni.last[i] = p
+	}
+	return
+}
+func (ni *nestIter) Next() (sql.Row, error) {
+	if ni.r.Limit>0 && ni.count>=ni.r.Limit { return nil,io.EOF }
+	for !ni.eof {
+		row,err := ni.child.Next()
+		if err==io.EOF {
+			ni.eof = true
+			break
+		}
+		if err!=nil { return nil,err }
+		done,err := ni.add(row)
+		if err!=nil { return nil,err }
+		if done!=nil {
+			ni.count++
+			return sql.Row{ni.doc(done,0)},nil
+		}
+	}
+	done := ni.path[0]
+	if done==nil { return nil,io.EOF }
+	ni.path[0] = nil
+	ni.count++
+	return sql.Row{ni.doc(done,0)},nil
+}
+func (ni *nestIter) Close() error { return ni.child.Close() }
@@ -0,0 +1,125 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package join
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "github.com/mad-day/datajoin/api"
+import "github.com/mad-day/datajoin/api/memsrc"
+import "github.com/mad-day/datajoin/query"
+import "fmt"
+import "io"
+import "reflect"
+import "sort"
+import "testing"
+
+func memTable(t *testing.T,names []string,types []reflect.Type,rows ...[]interface{}) *memsrc.Table {
+	tab := memsrc.NewTable(names,types)
+	for _,row := range rows {
+		if err := tab.Insert(row...); err!=nil { t.Fatal(err) }
+	}
+	return tab
+}
+
+/* Plans the query and returns its RealJoin. */
+func realJoin(t *testing.T,ds api.DataSource,q string) *RealJoin {
+	tree,err := query.DataContext{DS:ds,Compile:MakeExecutable}.Parse(q)
+	if err!=nil { t.Fatal(err) }
+	var rj *RealJoin
+	_,err = tree.TransformUp(func(n sql.Node) (sql.Node,error) {
+		if r,ok := n.(*RealJoin); ok { rj = r }
+		return n,nil
+	})
+	if err!=nil { t.Fatal(err) }
+	if rj==nil { t.Fatalf("no RealJoin in\n%v",tree) }
+	return rj
+}
+
+/* Prints a document with its nested lists sorted, as the join doesn't order the rows of a lookup. */
+func canonDoc(doc map[string]interface{}) string {
+	for k,v := range doc {
+		l,ok := v.([]interface{})
+		if !ok { continue }
+		items := make([]string,len(l))
+		for i,c := range l { items[i] = canonDoc(c.(map[string]interface{})) }
+		sort.Strings(items)
+		doc[k] = items
+	}
+	return fmt.Sprint(doc)
+}
+
+func TestNestedDuplicates(t *testing.T) {
+	tInt,tStr := reflect.TypeOf(int64(0)),reflect.TypeOf("")
+	ds := api.DataSourceImpl{
+		"customers":memTable(t,[]string{"id","name"},[]reflect.Type{tInt,tStr},
+			[]interface{}{1,"ann"},[]interface{}{2,"bob"},[]interface{}{2,"bob"},[]interface{}{3,"cid"}),
+		"orders":memTable(t,[]string{"cid","item"},[]reflect.Type{tInt,tStr},
+			[]interface{}{1,"book"},[]interface{}{1,"book"},[]interface{}{1,"pen"},[]interface{}{2,"cup"}),
+	}
+	order := func(item string) map[string]interface{} {
+		return map[string]interface{}{"item":item}
+	}
+	customer := func(id int64,name string,items ...string) string {
+		l := make([]interface{},len(items))
+		for i,item := range items {
+			o := order(item)
+			o["cid"] = id
+			l[i] = o
+		}
+		return canonDoc(map[string]interface{}{"id":id,"name":name,"orders":l})
+	}
+
+	/* Equal children stay separate entries, and so do equal documents. */
+	all := []string{
+		customer(1,"ann","book","book","pen"),
+		customer(2,"bob","cup"),
+		customer(2,"bob","cup"),
+	}
+	sort.Strings(all)
+	tests := []struct{
+		chunk int
+		limit int64
+		docs  int
+	}{
+		{0,0,3},
+		{1,0,3},
+		{2,0,3},
+		{1,2,2},
+		{0,5,3},
+	}
+	for _,tt := range tests {
+		rj := realJoin(t,ds,"SELECT * FROM customers JOIN orders ON customers.id = orders.cid")
+		if legSource(rj.Tables[0])!=ds["customers"] { t.Fatalf("driving table is %v",rj.Tables[0]) }
+		rj.Chunk,rj.Limit = tt.chunk,tt.limit
+		iter,err := rj.NestedRowIter(sql.NewEmptyContext())
+		if err!=nil { t.Fatal(err) }
+		var got []string
+		for {
+			row,err := iter.Next()
+			if err==io.EOF { break }
+			if err!=nil { t.Fatal(err) }
+			got = append(got,canonDoc(row[0].(map[string]interface{})))
+		}
+		iter.Close()
+		sort.Strings(got)
+		if len(got)!=tt.docs {
+			t.Errorf("chunk=%d,limit=%d: %d documents, want %d",tt.chunk,tt.limit,len(got),tt.docs)
+		} else if tt.docs==len(all) && !reflect.DeepEqual(got,all) {
+			t.Errorf("chunk=%d,limit=%d:\n got %v\nwant %v",tt.chunk,tt.limit,got,all)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package join
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "github.com/mad-day/datajoin/query"
+import "fmt"
+
+/*
+Anything, that plans a query: query.DataContext or *query.Engine.
+*/
+type Planner interface{
+	Plan(query string) (*query.Plan,error)
+}
+
+/*
+A prepared query. The query is parsed, analyzed and turned into RealJoins once,
+and can then be executed any number of times, concurrently, with different
+values for its placeholders (? or $n).
+*/
+type Stmt struct{
+	Tree   sql.Node
+	Params int
+}
+
+/*
+Prepares the query. If the planner has a plan cache, the executable form
+of the plan is cached as well.
+*/
+func Prepare(p Planner,q string) (*Stmt,error) {
+	plan,err := p.Plan(q)
+	if err!=nil { return nil,err }
+	tree,err := plan.Executable(MakeExecutable)
+	if err!=nil { return nil,err }
+	return &Stmt{tree,plan.Params},nil
+}
+
+func (s *Stmt) Schema() sql.Schema { return s.Tree.Schema() }
+
+/*
+Executes the query with the given values for its placeholders.
+*/
+func (s *Stmt) Execute(ctx *sql.Context,args ...interface{}) (sql.RowIter,error) {
+	if len(args)!=s.Params { return nil,fmt.Errorf("expected %d parameters, got %d",s.Params,len(args)) }
+	return s.Tree.RowIter(query.WithParams(ctx,args))
+}
@@ -19,18 +19,24 @@ package join
 
 import "github.com/mad-day/datajoin/query"
 import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/plan"
 
+/*
+Replaces every MultiJoin by a RealJoin, including the MultiJoins within subqueries
+and within the legs of other MultiJoins.
+*/
 func MakeExecutable(node sql.Node) (sql.Node,error) {
-	repl := make(map[*query.Cookie]sql.Node)
-	for _,mj := range GetAll(node) {
-		repl[mj.Cookie] = NewRealJoin(mj)
-	}
-	return node.TransformUp(func(node sql.Node) (sql.Node,error){
+	var f sql.TransformNodeFunc
+	f = func(node sql.Node) (sql.Node,error){
 		switch v := node.(type) {
+		case *plan.SubqueryAlias:
+			child,err := v.Child.TransformUp(f)
+			if err!=nil { return nil,err }
+			return plan.NewSubqueryAlias(v.Name(),child),nil
 		case *query.MultiJoin:
-			r,ok := repl[v.Cookie]
-			if ok { return r,nil }
+			return NewRealJoin(v),nil
 		}
 		return node,nil
-	})
-}
\ No newline at end of file
+	}
+	return node.TransformUp(f)
+}
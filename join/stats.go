@@ -0,0 +1,98 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package join
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "bytes"
+import "context"
+import "fmt"
+import "sync"
+import "sync/atomic"
+
+type statsKey struct{}
+
+/*
+Per-table counters of a RealJoin.
+*/
+type TableStats struct{
+	Lookups int64 /* Number of RowSource.Lookup calls. */
+	Fetched int64 /* Rows returned by the RowSource. */
+	Passed  int64 /* Rows, that passed the Prefilter. */
+}
+
+type JoinStats struct{
+	Join   *RealJoin
+	Tables []TableStats
+}
+
+/*
+Runtime statistics of the RealJoins of a query execution. See WithStats().
+*/
+type Stats struct{
+	lock  sync.Mutex
+	joins []*JoinStats
+}
+
+/*
+Returns a copy of the context, that collects the runtime statistics of
+all RealJoins, that are executed with it.
+*/
+func WithStats(ctx *sql.Context) (*sql.Context,*Stats) {
+	s := new(Stats)
+	nctx := new(sql.Context)
+	*nctx = *ctx
+	nctx.Context = context.WithValue(nctx.Context,statsKey{},s)
+	return nctx,s
+}
+
+func statsFor(ctx *sql.Context,r *RealJoin) *JoinStats {
+	s,_ := ctx.Value(statsKey{}).(*Stats)
+	if s==nil { return nil }
+	js := &JoinStats{r,make([]TableStats,len(r.Tables))}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.joins = append(s.joins,js)
+	return js
+}
+
+/* Returns a snapshot of the statistics, one entry per RealJoin execution. */
+func (s *Stats) Joins() []JoinStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]JoinStats,len(s.joins))
+	for i,js := range s.joins {
+		res[i].Join = js.Join
+		res[i].Tables = make([]TableStats,len(js.Tables))
+		for j := range js.Tables {
+			t := &js.Tables[j]
+			res[i].Tables[j] = TableStats{atomic.LoadInt64(&t.Lookups),atomic.LoadInt64(&t.Fetched),atomic.LoadInt64(&t.Passed)}
+		}
+	}
+	return res
+}
+
+func (s *Stats) String() string {
+	b := new(bytes.Buffer)
+	for i,js := range s.Joins() {
+		fmt.Fprintf(b,"RealJoin #%d\n",i+1)
+		for j,t := range js.Tables {
+			fmt.Fprintf(b,"  %s: %d lookups, %d rows fetched, %d rows passed\n",js.Join.Tables[j].Name(),t.Lookups,t.Fetched,t.Passed)
+		}
+	}
+	return b.String()
+}
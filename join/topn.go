@@ -0,0 +1,110 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package join
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "github.com/mad-day/datajoin/query"
+import "github.com/mad-day/datajoin/join/apis"
+import "github.com/spf13/cast"
+import "container/heap"
+import "sort"
+
+type sortedRow struct{
+	row  sql.Row
+	keys []interface{}
+}
+
+/*
+A ResultEndpoint, that keeps the best N rows according to an ordering.
+The worst of the rows being kept is on top of the heap.
+*/
+type topN struct{
+	ctx    *sql.Context
+	endpt  apis.ResultEndpoint
+	order  []query.OrderField
+	filter sql.Expression
+	n      int
+	rows   []sortedRow
+}
+func newTopN(ctx *sql.Context,endpt apis.ResultEndpoint,order []query.OrderField,filter sql.Expression,n int64) *topN {
+	return &topN{ctx:ctx,endpt:endpt,order:order,filter:filter,n:int(n)}
+}
+
+/* Returns true, if a is to be sorted before b. */
+func (t *topN) before(a,b sortedRow) bool {
+	for i,o := range t.order {
+		x,y := a.keys[i],b.keys[i]
+		var c int
+		switch {
+		case x==nil && y==nil: c = 0
+		case x==nil: c = -1
+		case y==nil: c = 1
+		default:
+			c,_ = o.Expr.Type().Compare(x,y)
+		}
+		if o.Desc { c = -c }
+		if c!=0 { return c<0 }
+	}
+	return false
+}
+
+func (t *topN) Len() int { return len(t.rows) }
+func (t *topN) Less(i, j int) bool { return t.before(t.rows[j],t.rows[i]) }
+func (t *topN) Swap(i, j int) { t.rows[i],t.rows[j] = t.rows[j],t.rows[i] }
+func (t *topN) Push(x interface{}) { t.rows = append(t.rows,x.(sortedRow)) }
+func (t *topN) Pop() interface{} {
+	l := len(t.rows)-1
+	x := t.rows[l]
+	t.rows = t.rows[:l]
+	return x
+}
+
+func (t *topN) PassResults(rs []sql.Row) error {
+	for _,row := range rs {
+		if t.filter!=nil {
+			ok,err := t.filter.Eval(t.ctx,row)
+			if err!=nil { return err }
+			if !cast.ToBool(ok) { continue }
+		}
+		sr := sortedRow{row,make([]interface{},len(t.order))}
+		for i,o := range t.order {
+			v,err := o.Expr.Eval(t.ctx,row)
+			if err!=nil { return err }
+			sr.keys[i] = v
+		}
+		if len(t.rows)<t.n {
+			heap.Push(t,sr)
+			continue
+		}
+		if !t.before(sr,t.rows[0]) { continue }
+		t.rows[0] = sr
+		heap.Fix(t,0)
+	}
+	return nil
+}
+
+/*
+Passes the rows being kept to the underlying endpoint, in order.
+*/
+func (t *topN) Flush() error {
+	sort.Slice(t.rows,func(i, j int) bool { return t.before(t.rows[i],t.rows[j]) })
+	rs := make([]sql.Row,len(t.rows))
+	for i,sr := range t.rows { rs[i] = sr.row }
+	t.rows = nil
+	return t.endpt.PassResults(rs)
+}
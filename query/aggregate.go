@@ -0,0 +1,524 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package query
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression/function/aggregation"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/plan"
+import "github.com/mad-day/datajoin/api"
+import "github.com/spf13/cast"
+import "fmt"
+import "io"
+import "reflect"
+import "strings"
+
+/*
+Describes, how an output column of an AggregatedTable is computed.
+Group >= 0 refers to a group column. Otherwise Aggr refers to an aggregate.
+If Count >= 0, the column is the average Aggr/Count.
+*/
+type AggrColumn struct{
+	Group int
+	Aggr  int
+	Count int
+}
+
+/*
+A GROUP BY over a single table, that is computed by the RowSource.
+*/
+type AggregatedTable struct{
+	ItsSrc    api.AggregatingSource
+	ItsName   string
+	Groups    []string
+	Aggrs     []api.AggrFunc
+	Filters   []sql.Expression
+	Columns   []AggrColumn
+	ItsSchema sql.Schema
+}
+var _ sql.Node = (*AggregatedTable)(nil)
+
+func (t *AggregatedTable) Resolved() bool { return true }
+func (t *AggregatedTable) String() string {
+	pr := sql.NewTreePrinter()
+	aggrs := make([]string,len(t.Aggrs))
+	for i,a := range t.Aggrs {
+		if a.Column=="" {
+			aggrs[i] = a.Func+"(*)"
+		} else {
+			aggrs[i] = fmt.Sprintf("%s(%s)",a.Func,a.Column)
+		}
+	}
+	filt := make([]string,len(t.Filters))
+	for i,f := range t.Filters { filt[i] = "("+f.String()+")" }
+	_ = pr.WriteNode("AggregatedTable %s GROUP BY (%s)",strings.Join(aggrs,", "),strings.Join(t.Groups,", "))
+	_ = pr.WriteChildren(fmt.Sprintf("Sampler %s %s",t.ItsName,strings.Join(filt," AND ")))
+	return pr.String()
+}
+func (t *AggregatedTable) Schema() sql.Schema { return t.ItsSchema }
+func (t *AggregatedTable) Children() []sql.Node { return nil }
+func (t *AggregatedTable) TransformUp(f sql.TransformNodeFunc) (sql.Node, error) { return f(t) }
+func (t *AggregatedTable) TransformExpressionsUp(sql.TransformExprFunc) (sql.Node, error) { return t,nil }
+
+func mergeAggr(fn string,t sql.Type,a,b interface{}) interface{} {
+	if a==nil { return b }
+	if b==nil { return a }
+	switch fn {
+	case "sum":
+		if sql.IsInteger(t) { return cast.ToInt64(a)+cast.ToInt64(b) }
+		return cast.ToFloat64(a)+cast.ToFloat64(b)
+	case "min":
+		if c,_ := t.Compare(a,b); c>0 { return b }
+	case "max":
+		if c,_ := t.Compare(a,b); c<0 { return b }
+	}
+	return a
+}
+
+func (t *AggregatedTable) RowIter(ctx *sql.Context) (sql.RowIter, error) {
+	specs := make([]interface{},len(t.Filters))
+	for i,f := range t.Filters {
+		e,err := api.BindLiterals(ctx,f)
+		if err!=nil { return nil,err }
+		specs[i] = api.SpecExpr{Expr:e}
+	}
+	ri,err := t.ItsSrc.Aggregate(t.Groups,t.Aggrs,specs...)
+	if err!=nil { return nil,err }
+	defer ri.Close()
+	
+	nms := t.ItsSrc.Names()
+	tps := t.ItsSrc.Types()
+	types := make([]sql.Type,len(t.Aggrs))
+	for i,a := range t.Aggrs {
+		switch a.Func {
+		case "count": types[i] = sql.Int64
+		case "sum": types[i] = sql.Float64
+		default:
+			types[i] = sql.JSON
+			for j,n := range nms {
+				if n==a.Column { types[i] = reftype2sqltype(tps[j]) }
+			}
+		}
+	}
+	
+	/* Merge partial rows of the same group. */
+	ng := len(t.Groups)
+	index := make(map[string]int)
+	var groups []api.Row
+	for ri.Next() {
+		row,err := ri.Fetch()
+		if err!=nil { return nil,err }
+		key := fmt.Sprintf("%#v",row[:ng])
+		i,ok := index[key]
+		if !ok {
+			index[key] = len(groups)
+			groups = append(groups,row)
+			continue
+		}
+		for j,a := range t.Aggrs {
+			groups[i][ng+j] = mergeAggr(a.Merge(),types[j],groups[i][ng+j],row[ng+j])
+		}
+	}
+	
+	rows := make([]sql.Row,len(groups))
+	for i,g := range groups {
+		row := make(sql.Row,len(t.Columns))
+		for j,c := range t.Columns {
+			var v interface{}
+			switch {
+			case c.Group>=0: v = g[c.Group]
+			case c.Count>=0:
+				n := cast.ToFloat64(g[ng+c.Count])
+				if n!=0 { v = cast.ToFloat64(g[ng+c.Aggr])/n }
+			default: v = g[ng+c.Aggr]
+			}
+			if v!=nil {
+				v,err = t.ItsSchema[j].Type.Convert(v)
+				if err!=nil { return nil,err }
+			}
+			row[j] = v
+		}
+		rows[i] = row
+	}
+	return &sliceRowIter{rows},nil
+}
+
+type sliceRowIter struct{
+	rows []sql.Row
+}
+func (s *sliceRowIter) Next() (sql.Row, error) {
+	if len(s.rows)==0 { return nil,io.EOF }
+	r := s.rows[0]
+	s.rows = s.rows[1:]
+	return r,nil
+}
+func (s *sliceRowIter) Close() error { return nil }
+
+/*
+Collects the group columns and the aggregates of a GroupBy over the given table.
+*/
+type aggrBuilder struct{
+	table string
+	t     *AggregatedTable
+}
+func (b *aggrBuilder) group(e sql.Expression) (int,bool) {
+	f,ok := e.(*expression.GetField)
+	if !ok || f.Table()!=b.table { return 0,false }
+	for i,g := range b.t.Groups {
+		if g==f.Name() { return i,true }
+	}
+	return 0,false
+}
+func (b *aggrBuilder) aggr(fn string,e sql.Expression) (int,bool) {
+	a := api.AggrFunc{Func:fn}
+	switch v := e.(type) {
+	case *expression.Star,*expression.Literal:
+		if fn!="count" { return 0,false }
+	case *expression.GetField:
+		if v.Table()!=b.table { return 0,false }
+		a.Column = v.Name()
+	default:
+		return 0,false
+	}
+	for i,o := range b.t.Aggrs {
+		if o==a { return i,true }
+	}
+	b.t.Aggrs = append(b.t.Aggrs,a)
+	return len(b.t.Aggrs)-1,true
+}
+func (b *aggrBuilder) column(e sql.Expression) (c AggrColumn,ok bool) {
+	if a,isa := e.(*expression.Alias); isa { e = a.Child }
+	c = AggrColumn{-1,-1,-1}
+	if c.Group,ok = b.group(e); ok { return }
+	c.Group = -1
+	switch v := e.(type) {
+	case *aggregation.Count: c.Aggr,ok = b.aggr("count",v.Child)
+	case *aggregation.Sum: c.Aggr,ok = b.aggr("sum",v.Child)
+	case *aggregation.Min: c.Aggr,ok = b.aggr("min",v.Child)
+	case *aggregation.Max: c.Aggr,ok = b.aggr("max",v.Child)
+	case *aggregation.Avg:
+		if c.Aggr,ok = b.aggr("sum",v.Child); !ok { return }
+		c.Count,ok = b.aggr("count",v.Child)
+	}
+	return
+}
+
+/*
+Replaces a GroupBy over a single table by an AggregatedTable, if the table's
+RowSource is able to compute the aggregates and to evaluate all filters.
+*/
+func pushDownAggregates(node sql.Node) (sql.Node, error) {
+	gb,ok := node.(*plan.GroupBy)
+	if !ok { return node,nil }
+	child := gb.Child
+	if f,ok := child.(*plan.Filter); ok { child = f.Child }
+	mj,ok := child.(*MultiJoin)
+	if !ok { return node,nil }
+	if len(mj.Tables)>1 {
+		if n,ok := pushPartialAggregates(gb,mj); ok { return n,nil }
+		return node,nil
+	}
+	tab,ok := mj.Tables[0].(*AdHocTable)
+	if !ok { return node,nil }
+	src,ok := tab.ItsSrc.(api.AggregatingSource)
+	if !ok || len(tab.Filters)!=0 { return node,nil }
+	if len(mj.Filters)!=0 {
+		fs,ok := tab.ItsSrc.(api.FilterableSource)
+		if !ok { return node,nil }
+		for _,f := range mj.Filters {
+			if !fs.CanPush(f) { return node,nil }
+		}
+	}
+	
+	b := &aggrBuilder{tab.Name(),&AggregatedTable{ItsSrc:src,ItsName:tab.Name(),Filters:mj.Filters,ItsSchema:gb.Schema()}}
+	for _,g := range gb.Grouping {
+		f,ok := g.(*expression.GetField)
+		if !ok || f.Table()!=tab.Name() { return node,nil }
+		b.t.Groups = append(b.t.Groups,f.Name())
+	}
+	for _,e := range gb.Aggregate {
+		c,ok := b.column(e)
+		if !ok { return node,nil }
+		b.t.Columns = append(b.t.Columns,c)
+	}
+	if !src.CanAggregate(b.t.Groups,b.t.Aggrs) { return node,nil }
+	return b.t,nil
+}
+
+/*
+Combines the partial aggregates, that a partialSource has computed below a join.
+Func is the function, that merges two partial states (see api.AggrFunc.Merge).
+If Count is not nil, the result is the average Child/Count.
+*/
+type mergeAggregate struct{
+	Func  string
+	Child sql.Expression
+	Count sql.Expression
+	typ   sql.Type
+}
+var _ sql.Aggregation = (*mergeAggregate)(nil)
+
+func (m *mergeAggregate) Resolved() bool { return true }
+func (m *mergeAggregate) String() string {
+	if m.Count!=nil { return fmt.Sprintf("merge_avg(%v,%v)",m.Child,m.Count) }
+	return fmt.Sprintf("merge_%s(%v)",m.Func,m.Child)
+}
+func (m *mergeAggregate) Type() sql.Type { return m.typ }
+func (m *mergeAggregate) IsNullable() bool { return true }
+func (m *mergeAggregate) Children() []sql.Expression {
+	if m.Count!=nil { return []sql.Expression{m.Child,m.Count} }
+	return []sql.Expression{m.Child}
+}
+func (m *mergeAggregate) TransformUp(f sql.TransformExprFunc) (sql.Expression, error) {
+	child,err := m.Child.TransformUp(f)
+	if err!=nil { return nil,err }
+	count := m.Count
+	if count!=nil {
+		count,err = count.TransformUp(f)
+		if err!=nil { return nil,err }
+	}
+	return f(&mergeAggregate{m.Func,child,count,m.typ})
+}
+func (m *mergeAggregate) NewBuffer() sql.Row { return sql.Row{nil,nil} }
+func (m *mergeAggregate) Update(ctx *sql.Context, buffer, row sql.Row) error {
+	v,err := m.Child.Eval(ctx,row)
+	if err!=nil { return err }
+	var n interface{}
+	if m.Count!=nil {
+		n,err = m.Count.Eval(ctx,row)
+		if err!=nil { return err }
+	}
+	return m.Merge(ctx,buffer,sql.Row{v,n})
+}
+func (m *mergeAggregate) Merge(ctx *sql.Context, buffer, partial sql.Row) error {
+	if m.Count!=nil {
+		buffer[0] = mergeAggr("sum",sql.Float64,buffer[0],partial[0])
+		buffer[1] = mergeAggr("sum",sql.Int64,buffer[1],partial[1])
+		return nil
+	}
+	buffer[0] = mergeAggr(m.Func,m.typ,buffer[0],partial[0])
+	return nil
+}
+func (m *mergeAggregate) Eval(ctx *sql.Context, buffer sql.Row) (interface{}, error) {
+	if m.Count!=nil {
+		n := cast.ToFloat64(buffer[1])
+		if n==0 || buffer[0]==nil { return nil,nil }
+		return cast.ToFloat64(buffer[0])/n,nil
+	}
+	if buffer[0]==nil {
+		/* Merged counts (the only integer sums) are 0 for no rows. */
+		if m.Func=="sum" && sql.IsInteger(m.typ) { return int64(0),nil }
+		return nil,nil
+	}
+	return m.typ.Convert(buffer[0])
+}
+
+/*
+The RowSource of a table, whose rows are partially aggregated below a join.
+The rows consist of the group columns, followed by the aggregates. Lookup
+passes the specs, it receives from the join, to Aggregate.
+*/
+type partialSource struct{
+	src    api.AggregatingSource
+	groups []string
+	aggrs  []api.AggrFunc
+	names  []string
+	types  []reflect.Type
+}
+func (p *partialSource) Names() []string { return p.names }
+func (p *partialSource) Types() []reflect.Type { return p.types }
+func (p *partialSource) Lookup(specs ...interface{}) (api.RowIter, error) {
+	return p.src.Aggregate(p.groups,p.aggrs,specs...)
+}
+
+/* Changes the indexes of the GetFields of the expression using index. */
+func reindex(e sql.Expression,index func(int) int) (sql.Expression,error) {
+	return e.TransformUp(func(e sql.Expression) (sql.Expression,error) {
+		gf,ok := e.(*expression.GetField)
+		if !ok { return e,nil }
+		return gf.WithIndex(index(gf.Index())),nil
+	})
+}
+
+/* Reports whether the expression refers to other tables than the given one. */
+func refersOthers(e sql.Expression,table string) (others bool) {
+	eachField(e,func(gf *expression.GetField) {
+		if gf.Table()!=table { others = true }
+	})
+	return
+}
+
+/*
+Pushes partial aggregates below a join. If the aggregates refer to the columns of
+the driving table (the first one) only, the table's RowSource is replaced by a
+partialSource, that groups its rows by the columns, the joins and the grouping
+refer to. The filters, that refer to the table only, go to the AdHocTable, so that
+the source evaluates them before grouping. The GroupBy above combines the partial
+aggregates of the joined rows. Sums and counts stay correct, even if a partial row
+joins several rows, because each of the rows it stands for would have joined
+them as well.
+
+Only the driving table is considered, because it is the only table, that doesn't
+receive Lookup specs from the other tables of the join.
+*/
+func pushPartialAggregates(gb *plan.GroupBy,mj *MultiJoin) (sql.Node,bool) {
+	tab,ok := mj.Tables[0].(*AdHocTable)
+	if !ok || len(tab.Filters)!=0 || len(mj.Order)!=0 || mj.Limit!=0 { return nil,false }
+	src,ok := tab.ItsSrc.(api.AggregatingSource)
+	if !ok { return nil,false }
+	name := tab.Name()
+	schema := tab.Schema()
+	
+	/* The columns of the table, that must be kept as group columns. */
+	keep := make(map[int]bool)
+	need := func(e sql.Expression) {
+		eachField(e,func(gf *expression.GetField) {
+			if gf.Table()==name { keep[gf.Index()] = true }
+		})
+	}
+	for _,g := range gb.Grouping { need(g) }
+	aggregates := 0
+	for _,e := range gb.Aggregate {
+		u := e
+		if a,ok := u.(*expression.Alias); ok { u = a.Child }
+		if _,ok := u.(sql.Aggregation); !ok {
+			need(u)
+			continue
+		}
+		for _,c := range u.Children() {
+			if refersOthers(c,name) { return nil,false }
+			if api.HasFields(c) { aggregates++ }
+		}
+	}
+	if aggregates==0 { return nil,false }
+	var local,rest []sql.Expression
+	for _,f := range mj.Filters {
+		if api.HasFields(f) && !refersOthers(f,name) {
+			local = append(local,f)
+		} else {
+			need(f)
+			rest = append(rest,f)
+		}
+	}
+	if len(keep)==0 { return nil,false }
+	if len(local)!=0 {
+		fs,ok := tab.ItsSrc.(api.FilterableSource)
+		if !ok { return nil,false }
+		for _,f := range local {
+			if !fs.CanPush(f) { return nil,false }
+		}
+	}
+	
+	t := &AggregatedTable{ItsSrc:src,ItsName:name}
+	ps := &partialSource{src:src}
+	pos := make(map[int]int)
+	tps := src.Types()
+	for i,c := range schema {
+		if !keep[i] { continue }
+		pos[i] = len(t.Groups)
+		t.Groups = append(t.Groups,c.Name)
+		ps.types = append(ps.types,tps[i])
+	}
+	b := &aggrBuilder{name,t}
+	type partial struct{ aggr,count int }
+	partials := make([]partial,len(gb.Aggregate))
+	for i,e := range gb.Aggregate {
+		u := e
+		if a,ok := u.(*expression.Alias); ok { u = a.Child }
+		p := partial{-1,-1}
+		switch v := u.(type) {
+		case *aggregation.Count: p.aggr,ok = b.aggr("count",v.Child)
+		case *aggregation.Sum: p.aggr,ok = b.aggr("sum",v.Child)
+		case *aggregation.Min: p.aggr,ok = b.aggr("min",v.Child)
+		case *aggregation.Max: p.aggr,ok = b.aggr("max",v.Child)
+		case *aggregation.Avg:
+			if p.aggr,ok = b.aggr("sum",v.Child); ok { p.count,ok = b.aggr("count",v.Child) }
+		case sql.Aggregation: ok = false
+		default: ok = true
+		}
+		if !ok { return nil,false }
+		partials[i] = p
+	}
+	if !src.CanAggregate(t.Groups,t.Aggrs) { return nil,false }
+	ng := len(t.Groups)
+	ps.groups,ps.aggrs = t.Groups,t.Aggrs
+	ps.names = append(ps.names,t.Groups...)
+	for _,a := range t.Aggrs {
+		col := a.Column
+		if col=="" { col = "*" }
+		typ := reflect.TypeOf(int64(0))
+		switch a.Func {
+		case "sum": typ = reflect.TypeOf(float64(0))
+		case "min","max":
+			for j,c := range schema {
+				if c.Name==a.Column { typ = tps[j] }
+			}
+		}
+		ps.names = append(ps.names,fmt.Sprintf("%s(%s)",a.Func,col))
+		ps.types = append(ps.types,typ)
+	}
+	leg := &AdHocTable{ItsSrc:ps,ItsName:name,Filters:local}
+	legSchema := leg.Schema()
+	
+	/*
+	Maps the indexes of the join rows to the indexes after replacing the table.
+	The local filters need no mapping, they go to the source as they are.
+	*/
+	w := len(schema)
+	delta := len(legSchema)-w
+	index := func(i int) int {
+		if i<w { return pos[i] }
+		return i+delta
+	}
+	filters := make([]sql.Expression,len(rest))
+	for i,f := range rest {
+		e,err := reindex(f,index)
+		if err!=nil { return nil,false }
+		filters[i] = e
+	}
+	tables := append([]sql.Node{leg},mj.Tables[1:]...)
+	var child sql.Node = &MultiJoin{Cookie:mj.Cookie,Tables:tables,Filters:filters}
+	if len(filters)!=0 { child = plan.NewFilter(expression.JoinAnd(filters...),child) }
+	
+	grouping := make([]sql.Expression,len(gb.Grouping))
+	for i,g := range gb.Grouping {
+		e,err := reindex(g,index)
+		if err!=nil { return nil,false }
+		grouping[i] = e
+	}
+	field := func(i int) sql.Expression {
+		c := legSchema[ng+i]
+		return expression.NewGetFieldWithTable(ng+i,c.Type,name,c.Name,true)
+	}
+	aggrs := make([]sql.Expression,len(gb.Aggregate))
+	for i,e := range gb.Aggregate {
+		p := partials[i]
+		if p.aggr<0 {
+			r,err := reindex(e,index)
+			if err!=nil { return nil,false }
+			aggrs[i] = r
+			continue
+		}
+		alias := e.String()
+		if a,ok := e.(*expression.Alias); ok { alias,e = a.Name(),a.Child }
+		m := &mergeAggregate{Func:t.Aggrs[p.aggr].Merge(),Child:field(p.aggr),typ:e.Type()}
+		if p.count>=0 { m.Count = field(p.count) }
+		aggrs[i] = expression.NewAlias(m,alias)
+	}
+	return plan.NewGroupBy(aggrs,grouping,child),true
+}
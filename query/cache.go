@@ -0,0 +1,234 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package query
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "github.com/mad-day/datajoin/api"
+import "container/list"
+import "reflect"
+import "strings"
+import "sync"
+
+/*
+A planned query, together with the RowSources it has been planned against.
+*/
+type Plan struct{
+	Tree     sql.Node
+	Params   int
+	Sources  map[string]api.RowSource /* By table name, as returned by the DataSource. */
+	Versions map[string]uint64        /* Schema versions of the api.VersionedSource sources. */
+
+	paths     map[string][]string /* Paths of the qualified table names in Sources. */
+	views     map[string]string   /* Definitions of the views being used. */
+	cacheable bool
+	lock      sync.Mutex
+	exec      sql.Node
+}
+func newPlan(tree sql.Node,mdb *mdbObj) *Plan {
+	p := &Plan{Tree:tree,Params:NumParams(tree),Sources:mdb.Used,Versions:make(map[string]uint64)}
+	p.views = mdb.Views
+	p.paths = make(map[string][]string,len(mdb.Paths))
+	for _,path := range mdb.Paths { p.paths[strings.Join(path,".")] = path }
+	for name,src := range mdb.Used {
+		if vs,ok := src.(api.VersionedSource); ok { p.Versions[name] = vs.SchemaVersion() }
+	}
+
+	/* The results of table-valued functions may differ from call to call. */
+	p.cacheable = len(mdb.Calls)==0
+	return p
+}
+
+/*
+Returns the executable form of the plan. The function compile is called once,
+the result is kept along with the plan.
+*/
+func (p *Plan) Executable(compile func(sql.Node) (sql.Node,error)) (sql.Node,error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.exec==nil {
+		exec,err := compile(p.Tree)
+		if err!=nil { return nil,err }
+		p.exec = exec
+	}
+	return p.exec,nil
+}
+
+/* Returns a comparable value, that identifies the given object, or nil. */
+func identity(x interface{}) interface{} {
+	if x==nil { return nil }
+	v := reflect.ValueOf(x)
+	if v.Type().Comparable() { return x }
+	switch v.Kind() {
+	case reflect.Map,reflect.Slice,reflect.Func,reflect.Ptr:
+		return [2]interface{}{v.Type(),v.Pointer()}
+	}
+	return nil
+}
+
+/*
+Reports whether the DataSource still returns the same RowSources with the same schema,
+and the same definitions of the views.
+*/
+func (p *Plan) Valid(ds api.DataSource) bool {
+	for name,src := range p.Sources {
+		var cur api.RowSource
+		if path,ok := p.paths[name]; ok {
+			cur = api.Resolve(ds,path...)
+		} else {
+			cur = ds.GetSource(name)
+		}
+		if cur==nil { return false }
+		id := identity(src)
+		if id==nil || id!=identity(cur) { return false }
+		if v,ok := p.Versions[name]; ok && v!=cur.(api.VersionedSource).SchemaVersion() { return false }
+	}
+	vs,ok := ds.(api.ViewSource)
+	if !ok { return len(p.views)==0 }
+	for name,text := range p.views {
+		if vs.GetView(name)!=text { return false }
+	}
+
+	/* A view, that has been created since, hides the table. */
+	for name := range p.Sources {
+		if _,ok := p.paths[name]; !ok && vs.GetView(name)!="" { return false }
+	}
+	return true
+}
+
+/*
+Normalizes the whitespace of the query, outside of quoted strings.
+*/
+func normalizeQuery(q string) string {
+	toks,err := lexSQL(q)
+	if err!=nil { return q }
+	parts := make([]string,0,len(toks))
+	for _,t := range toks { parts = append(parts,q[t.start:t.end]) }
+	for len(parts)!=0 && parts[len(parts)-1]==";" { parts = parts[:len(parts)-1] }
+	return strings.Join(parts," ")
+}
+
+type cacheKey struct{
+	ds    interface{}
+	funcs interface{}
+	query string
+	
+	/* Planner settings. */
+	maxGroups int
+}
+type cacheEntry struct{
+	key  cacheKey
+	plan *Plan
+}
+
+/*
+A LRU cache of query plans, keyed by the normalized query text, the DataSource,
+the set of functions and the planner settings. It is safe for concurrent use.
+
+Cached plans are discarded, once the DataSource returns a different RowSource for one
+of the tables, or an api.VersionedSource reports a schema change.
+*/
+type PlanCache struct{
+	lock  sync.Mutex
+	size  int
+	lru   *list.List
+	items map[cacheKey]*list.Element
+}
+
+/* Creates a cache holding up to size plans. */
+func NewPlanCache(size int) *PlanCache {
+	if size<=0 { size = 256 }
+	return &PlanCache{size:size,lru:list.New(),items:make(map[cacheKey]*list.Element)}
+}
+
+func (c *PlanCache) get(key cacheKey,ds api.DataSource) (*Plan,bool) {
+	/* The plan is read under the lock, as put() may replace it concurrently. */
+	var plan *Plan
+	c.lock.Lock()
+	e,ok := c.items[key]
+	if ok {
+		c.lru.MoveToFront(e)
+		plan = e.Value.(*cacheEntry).plan
+	}
+	c.lock.Unlock()
+	if !ok { return nil,false }
+	if plan.Valid(ds) { return plan,true }
+	c.lock.Lock()
+	if c.items[key]==e && e.Value.(*cacheEntry).plan==plan {
+		c.lru.Remove(e)
+		delete(c.items,key)
+	}
+	c.lock.Unlock()
+	return nil,false
+}
+func (c *PlanCache) put(key cacheKey,plan *Plan) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e,ok := c.items[key]; ok {
+		e.Value = &cacheEntry{key,plan}
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.lru.PushFront(&cacheEntry{key,plan})
+	for c.lru.Len()>c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.items,e.Value.(*cacheEntry).key)
+	}
+}
+
+/* Discards all plans. */
+func (c *PlanCache) Purge() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lru.Init()
+	c.items = make(map[cacheKey]*list.Element)
+}
+
+/* Returns the number of cached plans. */
+func (c *PlanCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+func (dc DataContext) cachedPlan(query string,pl *planner) (*Plan,error) {
+	var key cacheKey
+	if dc.Cache!=nil {
+		key = cacheKey{identity(dc.DS),identity(pl.funcs),normalizeQuery(query),dc.MaxGroups}
+		if plan,ok := dc.Cache.get(key,dc.DS); ok { return plan,nil }
+	}
+	plan,err := dc.parseAll(query,pl)
+	if err!=nil { return nil,err }
+	if dc.Cache!=nil && plan.cacheable { dc.Cache.put(key,plan) }
+	return plan,nil
+}
+
+/*
+Plans the query, or returns the cached plan, if the DataContext has a Cache.
+*/
+func (dc DataContext) Plan(query string) (*Plan,error) {
+	return dc.cachedPlan(query,defaultPlanner())
+}
+
+/*
+Plans the query using the functions registered with the engine, or returns the cached plan,
+if the engine has a Cache. Registering a function invalidates the cached plans.
+*/
+func (e *Engine) Plan(query string) (*Plan,error) {
+	return e.cachedPlan(query,e.planner())
+}
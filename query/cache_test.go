@@ -0,0 +1,123 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package query
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "github.com/mad-day/datajoin/api"
+import "github.com/mad-day/datajoin/api/memsrc"
+import "reflect"
+import "sync"
+import "sync/atomic"
+import "testing"
+
+/* A DataSource, whose tables may be replaced while it is in use. */
+type swapSource struct{
+	lock sync.RWMutex
+	tabs map[string]api.RowSource
+}
+func (s *swapSource) GetSource(name string) api.RowSource {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.tabs[name]
+}
+func (s *swapSource) set(name string,src api.RowSource) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tabs[name] = src
+}
+
+func newSwapSource() *swapSource {
+	tInt,tStr := reflect.TypeOf(int64(0)),reflect.TypeOf("")
+	return &swapSource{tabs:map[string]api.RowSource{
+		"a":memsrc.NewTable([]string{"id","name"},[]reflect.Type{tInt,tStr}),
+		"b":memsrc.NewTable([]string{"id","value"},[]reflect.Type{tInt,tInt}),
+	}}
+}
+
+func TestPlanCacheKey(t *testing.T) {
+	ds := newSwapSource()
+	cache := NewPlanCache(16)
+	dc := DataContext{DS:ds,Cache:cache}
+	first,err := dc.Plan("SELECT id FROM a WHERE name = 'x'")
+	if err!=nil { t.Fatal(err) }
+	tests := []struct{
+		name  string
+		dc    DataContext
+		query string
+		same  bool
+		swap  bool
+	}{
+		{"same query",dc,"SELECT id FROM a WHERE name = 'x'",true,false},
+		{"whitespace",dc,"SELECT  id\n\tFROM a WHERE name = 'x' ;",true,false},
+		{"string",dc,"SELECT id FROM a WHERE name = 'x '",false,false},
+		{"max groups",DataContext{DS:ds,Cache:cache,MaxGroups:10},"SELECT id FROM a WHERE name = 'x'",false,false},
+		{"other source",DataContext{DS:newSwapSource(),Cache:cache},"SELECT id FROM a WHERE name = 'x'",false,false},
+		{"replaced table",dc,"SELECT id FROM a WHERE name = 'x'",false,true},
+	}
+	for _,tt := range tests {
+		if tt.swap { ds.set("a",memsrc.NewTable([]string{"id","name"},[]reflect.Type{reflect.TypeOf(int64(0)),reflect.TypeOf("")})) }
+		plan,err := tt.dc.Plan(tt.query)
+		if err!=nil { t.Errorf("%s: %v",tt.name,err); continue }
+		if (plan==first)!=tt.same { t.Errorf("%s: cached plan reused: %v, want %v",tt.name,plan==first,tt.same) }
+	}
+}
+
+/* Run with -race. */
+func TestPlanCacheConcurrent(t *testing.T) {
+	queries := []string{
+		"SELECT * FROM a",
+		"SELECT id FROM a WHERE id > 1",
+		"SELECT a.name, b.value FROM a JOIN b ON a.id = b.id",
+		"SELECT count(*) FROM b",
+		"SELECT name FROM a ORDER BY name LIMIT 2",
+		"SELECT * FROM b WHERE value = ?",
+	}
+	ds := newSwapSource()
+	var compiled int64
+	dc := DataContext{DS:ds,Cache:NewPlanCache(4),Compile:func(n sql.Node) (sql.Node,error) {
+		atomic.AddInt64(&compiled,1)
+		return n,nil
+	}}
+
+	var wg sync.WaitGroup
+	errs := make(chan error,8)
+	for g := 0; g<8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i<100; i++ {
+				q := queries[(g+i)%len(queries)]
+				switch {
+				case g==0 && i%10==0:
+					/* Invalidates the plans of the table. */
+					ds.set("b",memsrc.NewTable([]string{"id","value"},[]reflect.Type{reflect.TypeOf(int64(0)),reflect.TypeOf(int64(0))}))
+				case g==1 && i%25==0:
+					dc.Cache.Purge()
+				}
+				tree,err := dc.Parse(q)
+				if err!=nil { errs <- err; return }
+				if tree==nil { t.Errorf("%s: no tree",q) }
+				if n := dc.Cache.Len(); n>4 { t.Errorf("%d plans cached, limit is 4",n) }
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs { t.Error(err) }
+	if atomic.LoadInt64(&compiled)==0 { t.Error("Compile never called") }
+}
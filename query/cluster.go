@@ -0,0 +1,68 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package query
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/plan"
+import "github.com/mad-day/datajoin/aggregate"
+
+/*
+Asks the MultiJoin to deliver its rows in cluster order, if it doesn't have an ordering yet.
+*/
+func clusterChain(node sql.Node,cluster []sql.Expression) sql.Node {
+	switch v := node.(type) {
+	case *MultiJoin:
+		if len(v.Order)!=0 { break }
+		order := make([]OrderField,len(cluster))
+		for i,e := range cluster { order[i] = OrderField{e,false} }
+		return &MultiJoin{Cookie:v.Cookie,Tables:v.Tables,Filters:v.Filters,Limit:v.Limit,Order:order}
+	case *plan.Filter:
+		if _,ok := v.Child.(*MultiJoin); !ok { break }
+		return plan.NewFilter(v.Expression,clusterChain(v.Child,cluster))
+	}
+	return node
+}
+
+/*
+Turns GROUP BY row_cluster(...) into a streaming aggregation.
+*/
+func streamClusters(node sql.Node) (sql.Node, error) {
+	gb,ok := node.(*plan.GroupBy)
+	if !ok { return node,nil }
+	var cluster,grouping []sql.Expression
+	for _,g := range gb.Grouping {
+		if rc,ok := g.(aggregate.RowCluster); ok {
+			cluster = append(cluster,rc.Children()...)
+		} else {
+			grouping = append(grouping,g)
+		}
+	}
+	if len(cluster)==0 { return node,nil }
+	return aggregate.NewClusterGroupBy(gb.Aggregate,cluster,grouping,clusterChain(gb.Child,cluster)),nil
+}
+
+/*
+Replaces the remaining GroupBy nodes by a GROUP BY with bounded memory. Aggregates
+without grouping are left alone: they have a single group, that exists even if
+there are no rows.
+*/
+func (dc DataContext) spillGroups(node sql.Node) (sql.Node, error) {
+	gb,ok := node.(*plan.GroupBy)
+	if !ok || len(gb.Grouping)==0 { return node,nil }
+	return aggregate.NewSpillGroupBy(gb.Aggregate,gb.Grouping,gb.Child,dc.MaxGroups),nil
+}
@@ -0,0 +1,329 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package query
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "github.com/mad-day/datajoin/api"
+import "github.com/mad-day/datajoin/aggregate"
+import "bytes"
+import "fmt"
+import "strconv"
+import "strings"
+import "sync"
+
+/*
+The signature of a function. A nil entry in Args accepts any type.
+If Variadic is set, the last entry of Args may be repeated any number of times.
+*/
+type Signature struct{
+	Args     []sql.Type
+	Variadic bool
+	Result   sql.Type
+}
+
+var numericTypes = []sql.Type{sql.Int32,sql.Int64,sql.Uint32,sql.Uint64,sql.Float32,sql.Float64}
+
+func isNumeric(t sql.Type) bool {
+	for _,n := range numericTypes {
+		if t==n { return true }
+	}
+	return false
+}
+
+/* Reports whether a value of type got may be passed as argument of type want. */
+func assignable(want,got sql.Type) bool {
+	switch {
+	case want==nil || want==sql.JSON: return true
+	case got==sql.Null: return true
+	case isNumeric(want) && isNumeric(got): return true
+	}
+	return want.String()==got.String()
+}
+
+func (s *Signature) String() string {
+	a := make([]string,len(s.Args))
+	for i,t := range s.Args {
+		if t==nil {
+			a[i] = "ANY"
+		} else {
+			a[i] = t.String()
+		}
+	}
+	if s.Variadic && len(a)!=0 { a[len(a)-1] += "..." }
+	return "("+strings.Join(a,", ")+")"
+}
+
+/* Validates the types of the arguments of a call of the named function. */
+func (s *Signature) Check(name string,types []sql.Type) error {
+	n := len(s.Args)
+	if len(types)<n && !(s.Variadic && len(types)==n-1) || len(types)>n && !s.Variadic {
+		return fmt.Errorf("%s%v: expected %d arguments, got %d",name,s,n,len(types))
+	}
+	for i,t := range types {
+		var want sql.Type
+		if i<n {
+			want = s.Args[i]
+		} else if n>0 {
+			want = s.Args[n-1]
+		}
+		if !assignable(want,t) { return fmt.Errorf("%s%v: argument %d has type %v",name,s,i+1,t) }
+	}
+	return nil
+}
+
+func exprTypes(args []sql.Expression) []sql.Type {
+	types := make([]sql.Type,len(args))
+	for i,a := range args { types[i] = a.Type() }
+	return types
+}
+
+/*
+A call of a scalar function, that has been registered by Engine.RegisterScalar().
+*/
+type ScalarCall struct{
+	Name string
+	Sig  *Signature
+	Func func(ctx *sql.Context,args []interface{}) (interface{}, error)
+	Args []sql.Expression
+}
+var _ sql.Expression = (*ScalarCall)(nil)
+func (s *ScalarCall) Resolved() bool {
+	for _,a := range s.Args {
+		if !a.Resolved() { return false }
+	}
+	return true
+}
+func (s *ScalarCall) String() string {
+	a := make([]string,len(s.Args))
+	for i,e := range s.Args { a[i] = e.String() }
+	return s.Name+"("+strings.Join(a,", ")+")"
+}
+func (s *ScalarCall) Type() sql.Type { return s.Sig.Result }
+func (s *ScalarCall) IsNullable() bool { return true }
+func (s *ScalarCall) Eval(ctx *sql.Context, row sql.Row) (interface{}, error) {
+	vals := make([]interface{},len(s.Args))
+	for i,a := range s.Args {
+		v,err := a.Eval(ctx,row)
+		if err!=nil { return nil,err }
+		vals[i] = v
+	}
+	return s.Func(ctx,vals)
+}
+func (s *ScalarCall) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) {
+	args := make([]sql.Expression,len(s.Args))
+	for i,a := range s.Args {
+		var err error
+		args[i],err = a.TransformUp(st)
+		if err!=nil { return nil,err }
+	}
+	return st(&ScalarCall{s.Name,s.Sig,s.Func,args})
+}
+func (s *ScalarCall) Children() []sql.Expression { return s.Args }
+
+/*
+A table-valued function. It is called in the FROM clause with literal arguments,
+and returns the RowSource to read from.
+*/
+type TableFunction struct{
+	Sig  Signature
+	Func func(args []interface{}) (api.RowSource, error)
+}
+
+func literalType(v interface{}) sql.Type {
+	switch v.(type) {
+	case nil: return sql.Null
+	case int64: return sql.Int64
+	case float64: return sql.Float64
+	case bool: return sql.Boolean
+	}
+	return sql.Text
+}
+
+/* Parses the literal arguments of a table-valued function call. */
+func literalArgs(s string,toks []sqlToken) (vals []interface{},err error) {
+	if len(toks)==0 { return }
+	for _,arg := range splitTopLevel(s,toks,func(t sqlToken) bool { return t.kind==',' }) {
+		text := tokenText(s,arg)
+		switch {
+		case len(arg)==1 && arg[0].kind=='s' && text[0]=='\'':
+			vals = append(vals,strings.Replace(text[1:len(text)-1],"''","'",-1))
+		case strings.EqualFold(text,"null"):
+			vals = append(vals,nil)
+		case strings.EqualFold(text,"true"),strings.EqualFold(text,"false"):
+			vals = append(vals,strings.EqualFold(text,"true"))
+		default:
+			num := strings.Replace(text," ","",-1)
+			if i,err := strconv.ParseInt(num,10,64); err==nil {
+				vals = append(vals,i)
+			} else if f,err := strconv.ParseFloat(num,64); err==nil {
+				vals = append(vals,f)
+			} else {
+				return nil,fmt.Errorf("table function arguments must be literals, got %q",text)
+			}
+		}
+	}
+	return
+}
+
+/*
+Replaces every call of a table-valued function in the FROM clause by a generated
+table name, and records the RowSource returned by the function. If the query has
+been planned before (see parseAll), the RowSource of that pass is used instead of
+calling the function again.
+*/
+func rewriteTableFunctions(query string,tvfs map[string]*TableFunction,mdb *mdbObj) (string,error) {
+	if len(tvfs)==0 { return query,nil }
+	toks,err := lexSQL(query)
+	if err!=nil { return "",err }
+	b := new(bytes.Buffer)
+	last := 0
+	for i := 1; i+1<len(toks); i++ {
+		t := toks[i]
+		if t.kind!='w' || toks[i+1].kind!='(' { continue }
+		prev := toks[i-1]
+		if !(isWord(query,prev,"from") || isWord(query,prev,"join") || prev.kind==',') { continue }
+		name := strings.ToLower(query[t.start:t.end])
+		tf,ok := tvfs[name]
+		if !ok { continue }
+		close := matchParen(toks,i+1)
+		if close<0 { return "",fmt.Errorf("unbalanced parentheses in call of %s",name) }
+		args,err := literalArgs(query,toks[i+2:close])
+		if err!=nil { return "",err }
+		types := make([]sql.Type,len(args))
+		for j,a := range args { types[j] = literalType(a) }
+		err = tf.Sig.Check(name,types)
+		if err!=nil { return "",err }
+		tn := fmt.Sprintf("%s_call_%d",name,len(mdb.Calls)+1)
+		src,ok := mdb.reuse[tn]
+		if !ok {
+			src,err = tf.Func(args)
+			if err!=nil { return "",err }
+		}
+		if mdb.Calls==nil { mdb.Calls = make(map[string]api.RowSource) }
+		mdb.Calls[tn] = src
+		b.WriteString(query[last:t.start])
+		b.WriteString(tn)
+		last = toks[close].end
+		i = close
+	}
+	b.WriteString(query[last:])
+	return b.String(),nil
+}
+
+/*
+A long-lived query engine. It owns the function registry and the table-valued
+functions, so that they are registered once, rather than being passed to every
+call of DataContext.ParseEx.
+
+The Register methods may be called concurrently with Parse.
+*/
+type Engine struct{
+	DataContext
+
+	lock   sync.RWMutex
+	pl     *planner
+	custom sql.Functions
+	aggrs  map[string]bool
+	tables map[string]*TableFunction
+}
+
+/*
+Creates an engine with the default functions, the aggregations of the aggregate package
+and the special functions of this package.
+*/
+func NewEngine(ds api.DataSource) *Engine {
+	e := &Engine{DataContext:DataContext{DS:ds},custom:make(sql.Functions),aggrs:make(map[string]bool),tables:make(map[string]*TableFunction)}
+	for k,v := range aggregate.Defaults { e.custom[k] = v }
+	e.pl = newPlanner(buildFunctions(e.custom),e.tables)
+	return e
+}
+
+func (e *Engine) register(name string,f sql.Function) error {
+	name = strings.ToLower(name)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if _,ok := e.tables[name]; ok { return fmt.Errorf("function %q already registered",name) }
+	e.custom[name] = f
+	e.pl = newPlanner(buildFunctions(e.custom),e.tables)
+	return nil
+}
+
+/*
+Registers a scalar function. The arguments are validated against the signature
+when the query is analyzed.
+*/
+func (e *Engine) RegisterScalar(name string,sig Signature,fn func(ctx *sql.Context,args []interface{}) (interface{}, error)) error {
+	if sig.Result==nil { return fmt.Errorf("function %q: missing result type",name) }
+	return e.register(name,sql.FunctionN(func(args ...sql.Expression) (sql.Expression, error) {
+		err := sig.Check(name,exprTypes(args))
+		if err!=nil { return nil,err }
+		return &ScalarCall{name,&sig,fn,args},nil
+	}))
+}
+
+/*
+Registers an aggregation. The arguments are validated against the signature,
+before the constructor is called.
+*/
+func (e *Engine) RegisterAggregate(name string,sig Signature,fn func(args []sql.Expression) (sql.Aggregation, error)) error {
+	err := e.register(name,sql.FunctionN(func(args ...sql.Expression) (sql.Expression, error) {
+		err := sig.Check(name,exprTypes(args))
+		if err!=nil { return nil,err }
+		return fn(args)
+	}))
+	if err!=nil { return err }
+	e.lock.Lock()
+	e.aggrs[strings.ToLower(name)] = true
+	e.lock.Unlock()
+	return nil
+}
+
+/*
+Registers a table-valued function, that can be called in the FROM clause.
+*/
+func (e *Engine) RegisterTable(name string,sig Signature,fn func(args []interface{}) (api.RowSource, error)) error {
+	name = strings.ToLower(name)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if _,ok := e.custom[name]; ok { return fmt.Errorf("function %q already registered",name) }
+	e.tables[name] = &TableFunction{sig,fn}
+	e.pl = newPlanner(buildFunctions(e.custom),e.tables)
+	return nil
+}
+
+/* Reports whether the named function has been registered as aggregation. */
+func (e *Engine) IsAggregate(name string) bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.aggrs[strings.ToLower(name)]
+}
+
+/*
+Parses and plans the query, using the functions registered with the engine.
+*/
+func (e *Engine) Parse(query string) (sql.Node,error) {
+	plan,err := e.Plan(query)
+	if err!=nil { return nil,err }
+	return e.tree(plan)
+}
+
+func (e *Engine) planner() *planner {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.pl
+}
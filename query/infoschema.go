@@ -0,0 +1,228 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package query
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "github.com/mad-day/datajoin/api"
+import "github.com/mad-day/datajoin/api/memsrc"
+import "fmt"
+import "reflect"
+import "strings"
+
+var (
+	tString = reflect.TypeOf("")
+	tInt64  = reflect.TypeOf(int64(0))
+)
+
+/*
+Calls f for every table of the DataSource and its namespaces, that can be listed.
+The schema is the dotted path of the namespace, or "" for the top level.
+*/
+func walkTables(ds api.DataSource,path []string,f func(schema,name string,ds api.DataSource)) {
+	schema := strings.Join(path,".")
+	if ls,ok := ds.(api.ListableSource); ok {
+		for _,name := range ls.ListTables() { f(schema,name,ds) }
+	}
+	if ln,ok := ds.(api.ListableNamespaces); ok {
+		for _,name := range ln.ListNamespaces() {
+			if ns := ln.GetNamespace(name); ns!=nil { walkTables(ns,append(path[:len(path):len(path)],name),f) }
+		}
+	}
+}
+
+/* Calls f for every namespace of the DataSource, that can be listed. */
+func walkNamespaces(ds api.DataSource,path []string,f func(schema string)) {
+	ln,ok := ds.(api.ListableNamespaces)
+	if !ok { return }
+	for _,name := range ln.ListNamespaces() {
+		p := append(path[:len(path):len(path)],name)
+		f(strings.Join(p,"."))
+		if ns := ln.GetNamespace(name); ns!=nil { walkNamespaces(ns,p,f) }
+	}
+}
+
+func yesNo(b bool) string {
+	if b { return "YES" }
+	return "NO"
+}
+
+type infoTable struct{
+	names []string
+	types []reflect.Type
+}
+
+var infoTables = map[string]infoTable{
+	"schemata": {[]string{"schema_name"},[]reflect.Type{tString}},
+	"tables":   {[]string{"table_schema","table_name"},[]reflect.Type{tString,tString}},
+	"columns":  {
+		[]string{"table_schema","table_name","column_name","ordinal_position","data_type","column_type","is_nullable"},
+		[]reflect.Type{tString,tString,tString,tInt64,tString,tString,tString},
+	},
+}
+
+/* The names of the information_schema tables, sorted. */
+var infoNames = []string{"columns","schemata","tables"}
+
+/*
+Builds the virtual table information_schema.<name> of the DataSource.
+The tables are snapshots, taken when the query is planned:
+
+	information_schema.schemata (schema_name)
+	information_schema.tables   (table_schema, table_name)
+	information_schema.columns  (table_schema, table_name, column_name, ordinal_position,
+	                             data_type, column_type, is_nullable)
+
+Only tables of DataSources implementing api.ListableSource (and namespaces of
+api.ListableNamespaces) are listed, along with the information_schema tables themselves.
+The columns of a view are those of its planned query. Views, that fail to plan, have
+no columns.
+*/
+func infoSchema(mdb *mdbObj,name string) (api.RowSource,error) {
+	ds := mdb.DS
+	name = strings.ToLower(name)
+	it,ok := infoTables[name]
+	if !ok { return nil,fmt.Errorf("No such table %q","information_schema."+name) }
+	t := memsrc.NewTable(it.names,it.types)
+	switch name {
+	case "schemata":
+		t.Insert("information_schema")
+		walkNamespaces(ds,nil,func(schema string) { t.Insert(schema) })
+	case "tables":
+		for _,n := range infoNames { t.Insert("information_schema",n) }
+		walkTables(ds,nil,func(schema,name string,_ api.DataSource) { t.Insert(schema,name) })
+	case "columns":
+		add := func(schema,name string,cols []api.ColumnInfo) {
+			for i,c := range cols {
+				t.Insert(schema,name,c.Name,int64(i+1),reftype2sqltype(c.Type).String(),c.DatabaseType,yesNo(c.Nullable))
+			}
+		}
+		for _,n := range infoNames {
+			it := infoTables[n]
+			cols := make([]api.ColumnInfo,len(it.names))
+			for i := range cols { cols[i] = api.ColumnInfo{Name:it.names[i],Type:it.types[i]} }
+			add("information_schema",n,cols)
+		}
+		walkTables(ds,nil,func(schema,name string,ds api.DataSource) {
+			if !isView(ds,[]string{name}) {
+				if src := ds.GetSource(name); src!=nil { add(schema,name,api.Describe(src)) }
+				return
+			}
+			s,err := mdb.viewSchema(ds,name)
+			if err!=nil { return }
+			for i,c := range s {
+				t.Insert(schema,name,c.Name,int64(i+1),c.Type.String(),"",yesNo(c.Nullable))
+			}
+		})
+	}
+	return t,nil
+}
+
+/*
+Plans the view of the DataSource and returns its schema. The view is expanded by
+expandView(), so it fails the same way, such as for a view, that is being planned
+already (it reads information_schema.columns itself).
+*/
+func (m *mdbObj) viewSchema(ds api.DataSource,name string) (sql.Schema,error) {
+	sub := &mdbObj{DS:ds,pl:m.pl,Srcs:make(map[string]api.RowSource),Used:make(map[string]api.RowSource)}
+	sub.viewStack = append([]string(nil),m.viewStack...)
+	tree,err := sub.expandView(name)
+	if err!=nil { return nil,err }
+	tree,err = DataContext{DS:ds}.plan(tree,sub,0)
+	if err!=nil { return nil,fmt.Errorf("view %q: %v",name,err) }
+	return tree.Schema(),nil
+}
+
+/* Reports whether the unqualified name is a view of the DataSource. */
+func isView(ds api.DataSource,parts []string) bool {
+	vs,ok := ds.(api.ViewSource)
+	return ok && len(parts)==1 && vs.GetView(parts[0])!=""
+}
+
+func isInfoSchema(parts []string) bool {
+	return len(parts)==2 && strings.EqualFold(parts[0],"information_schema")
+}
+
+func quoteString(s string) string {
+	return "'"+strings.Replace(s,"'","''",-1)+"'"
+}
+
+/*
+Translates SHOW TABLES, SHOW DATABASES, SHOW COLUMNS and DESCRIBE into queries
+over the information_schema tables. Other statements are returned unchanged.
+The rows of the information_schema tables are already sorted.
+
+	SHOW [FULL] TABLES [FROM|IN schema] [LIKE 'pattern']
+	SHOW DATABASES | SHOW SCHEMAS
+	SHOW [FULL] COLUMNS FROM table | DESCRIBE table | DESC table
+*/
+func rewriteShow(query string,ds api.DataSource) (string,error) {
+	toks,err := lexSQL(query)
+	if err!=nil { return "",err }
+	for len(toks)!=0 && query[toks[len(toks)-1].start]==';' { toks = toks[:len(toks)-1] }
+	if len(toks)<2 { return query,nil }
+	word := func(i int,w string) bool { return i<len(toks) && isWord(query,toks[i],w) }
+	
+	i := 1
+	switch {
+	case word(0,"describe") || word(0,"desc"):
+	case word(0,"show"):
+		if word(i,"full") { i++ }
+		switch {
+		case word(i,"databases") || word(i,"schemas"):
+			if i+1!=len(toks) { return "",fmt.Errorf("unexpected %q",tokenText(query,toks[i+1:])) }
+			return "SELECT schema_name AS `Database` FROM information_schema.schemata",nil
+		case word(i,"tables"):
+			i++
+			schema := ""
+			if word(i,"from") || word(i,"in") {
+				parts,next := dottedName(query,toks,i+1)
+				if len(parts)==0 { return "",fmt.Errorf("missing schema name") }
+				schema = strings.Join(parts,".")
+				i = next
+			}
+			q := "SELECT table_name AS `Tables` FROM information_schema.tables WHERE table_schema = "+quoteString(schema)
+			if word(i,"like") && i+1<len(toks) && toks[i+1].kind=='s' {
+				q += " AND table_name LIKE "+query[toks[i+1].start:toks[i+1].end]
+				i += 2
+			}
+			if i!=len(toks) { return "",fmt.Errorf("unexpected %q",tokenText(query,toks[i:])) }
+			return q,nil
+		case word(i,"columns") || word(i,"fields"):
+			i++
+			if !(word(i,"from") || word(i,"in")) { return "",fmt.Errorf("missing FROM in SHOW COLUMNS") }
+			i++
+		default:
+			return query,nil
+		}
+	default:
+		return query,nil
+	}
+	
+	parts,next := dottedName(query,toks,i)
+	if len(parts)==0 { return "",fmt.Errorf("missing table name") }
+	if next!=len(toks) { return "",fmt.Errorf("unexpected %q",tokenText(query,toks[next:])) }
+	if isInfoSchema(parts) {
+		if _,ok := infoTables[strings.ToLower(parts[1])]; !ok { return "",fmt.Errorf("No such table %q",strings.Join(parts,".")) }
+		parts = []string{"information_schema",strings.ToLower(parts[1])}
+	} else if api.Resolve(ds,parts...)==nil && !isView(ds,parts) {
+		return "",fmt.Errorf("No such table %q",strings.Join(parts,"."))
+	}
+	schema := strings.Join(parts[:len(parts)-1],".")
+	name := parts[len(parts)-1]
+	return "SELECT column_name AS `Field`, data_type AS `Type`, is_nullable AS `Null` FROM information_schema.columns WHERE table_schema = "+quoteString(schema)+" AND table_name = "+quoteString(name),nil
+}
@@ -0,0 +1,123 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package query
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/plan"
+import "reflect"
+import "fmt"
+
+/*
+An ordering requirement of a MultiJoin.
+*/
+type OrderField struct{
+	Expr sql.Expression
+	Desc bool
+}
+func (o OrderField) String() string {
+	if o.Desc { return fmt.Sprintf("%v DESC",o.Expr) }
+	return fmt.Sprintf("%v ASC",o.Expr)
+}
+
+/*
+plan.Limit and plan.Offset neither export their sizes (Limit.size and Offset.n)
+nor have accessors for them. Reflection is allowed to read unexported fields,
+as long as Interface() isn't called on them. Returns -1, if the field is missing.
+*/
+func nodeSize(node sql.Node,field string) int64 {
+	f := reflect.ValueOf(node).Elem().FieldByName(field)
+	if f.Kind()!=reflect.Int64 { return -1 }
+	return f.Int()
+}
+
+/*
+Passes the number of rows, the parent node needs, down to the MultiJoin.
+Only row-preserving nodes are passed through.
+*/
+func limitChain(node sql.Node,n int64) (sql.Node,bool) {
+	switch v := node.(type) {
+	case *MultiJoin:
+		if v.Limit!=0 && v.Limit<=n { return node,false }
+		return &MultiJoin{Cookie:v.Cookie,Tables:v.Tables,Filters:v.Filters,Limit:n,Order:v.Order},true
+	case *plan.Offset:
+		o := nodeSize(v,"n")
+		if o<0 { break }
+		c,ok := limitChain(v.Child,n+o)
+		if ok { return plan.NewOffset(o,c),true }
+	case *plan.Project:
+		c,ok := limitChain(v.Child,n)
+		if ok { return plan.NewProject(v.Projections,c),true }
+	case *plan.Filter:
+		/* The RealJoin evaluates all of its filters before counting. */
+		if _,ok := v.Child.(*MultiJoin); !ok { break }
+		c,ok := limitChain(v.Child,n)
+		if ok { return plan.NewFilter(v.Expression,c),true }
+	case *plan.Sort:
+		order := make([]OrderField,len(v.SortFields))
+		for i,sf := range v.SortFields {
+			order[i] = OrderField{sf.Column,sf.Order==plan.Descending}
+		}
+		c,ok := orderChain(v.Child,order,n)
+		if ok { return plan.NewSort(v.SortFields,c),true }
+	}
+	return node,false
+}
+
+/*
+Passes the ordering requirement and the number of rows down to the MultiJoin.
+*/
+func orderChain(node sql.Node,order []OrderField,n int64) (sql.Node,bool) {
+	switch v := node.(type) {
+	case *MultiJoin:
+		return &MultiJoin{Cookie:v.Cookie,Tables:v.Tables,Filters:v.Filters,Limit:n,Order:order},true
+	case *plan.Project:
+		/* Express the ordering in terms of the Project's input. */
+		norder := make([]OrderField,len(order))
+		for i,o := range order {
+			e,err := o.Expr.TransformUp(func(e sql.Expression) (sql.Expression, error) {
+				gf,ok := e.(*expression.GetField)
+				if !ok { return e,nil }
+				if gf.Index()<0 || gf.Index()>=len(v.Projections) { return nil,fmt.Errorf("invalid field %v",gf) }
+				p := v.Projections[gf.Index()]
+				if a,ok := p.(*expression.Alias); ok { p = a.Child }
+				return p,nil
+			})
+			if err!=nil { return node,false }
+			norder[i] = OrderField{e,o.Desc}
+		}
+		c,ok := orderChain(v.Child,norder,n)
+		if ok { return plan.NewProject(v.Projections,c),true }
+	case *plan.Filter:
+		if _,ok := v.Child.(*MultiJoin); !ok { break }
+		c,ok := orderChain(v.Child,order,n)
+		if ok { return plan.NewFilter(v.Expression,c),true }
+	}
+	return node,false
+}
+
+func pushDownLimits(node sql.Node) (sql.Node, error) {
+	switch v := node.(type) {
+	case *plan.Limit:
+		n := nodeSize(v,"size")
+		if n<0 { break }
+		c,ok := limitChain(v.Child,n)
+		if ok { return plan.NewLimit(n,c),nil }
+	}
+	return node,nil
+}
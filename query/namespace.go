@@ -0,0 +1,220 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package query
+
+import "github.com/mad-day/datajoin/api"
+import "bytes"
+import "fmt"
+import "sort"
+import "strings"
+
+/* Words, that end the table list of a FROM clause. */
+var fromEnd = map[string]bool{
+	"where":true, "group":true, "order":true, "limit":true, "having":true,
+	"union":true, "select":true, "on":true, "using":true,
+}
+
+/* Words, that may follow a table name, but are not its alias. */
+var notAlias = map[string]bool{
+	"where":true, "group":true, "order":true, "limit":true, "having":true,
+	"union":true, "on":true, "using":true, "join":true, "inner":true,
+	"left":true, "right":true, "cross":true, "natural":true, "outer":true,
+	"straight_join":true,
+}
+
+func identPart(s string,t sqlToken) (string,bool) {
+	switch {
+	case t.kind=='w': return s[t.start:t.end],true
+	case t.kind=='s' && s[t.start]=='`': return strings.Replace(s[t.start+1:t.end-1],"``","`",-1),true
+	}
+	return "",false
+}
+
+func quoteIdent(name string) string {
+	return "`"+strings.Replace(name,"`","``",-1)+"`"
+}
+
+/*
+Reads a dotted name, such as crm.public.customers, starting at toks[i].
+Returns its parts and the index of the token after it.
+*/
+func dottedName(s string,toks []sqlToken,i int) (parts []string,next int) {
+	for i<len(toks) {
+		p,ok := identPart(s,toks[i])
+		if !ok { break }
+		parts = append(parts,p)
+		i++
+		if i+1<len(toks) && toks[i].kind=='o' && s[toks[i].start]=='.' {
+			i++
+			continue
+		}
+		break
+	}
+	return parts,i
+}
+
+type textEdit struct{
+	start,end int
+	text      string
+}
+
+/*
+Replaces every qualified table name (catalog.schema.table or schema.table) in the
+FROM clauses by a generated table name, and records the path of the table, if the
+DataSource is an api.NamespacedSource. The information_schema tables are built
+right away, see infoSchema(). Tables without an alias are aliased by their
+unqualified name, unless another table of the query is exposed by the same name
+(as in crm.users JOIN billing.users). Those keep the generated name. Column
+references, that are qualified by the full table path,
+are shortened accordingly.
+*/
+func rewriteQualified(query string,mdb *mdbObj) (string,error) {
+	ds := mdb.DS
+	if v,ok := ds.(*Views); ok { ds = v.DataSource }
+	_,namespaced := ds.(api.NamespacedSource)
+	toks,err := lexSQL(query)
+	if err!=nil { return "",err }
+	var edits []textEdit
+	exposed := make(map[string]string)
+	tables := make(map[int]int) /* Start -> end token of the rewritten table names. */
+	
+	/* The rewritten tables without an alias, and the number of tables exposed by each name. */
+	type unaliased struct{
+		parts     []string
+		gen       string
+		start,end int
+	}
+	var pending []unaliased
+	names := make(map[string]int)
+	aliasAt := func(next int) string {
+		if next>=len(toks) { return "" }
+		a := toks[next]
+		if isWord(query,a,"as") && next+1<len(toks) {
+			alias,_ := identPart(query,toks[next+1])
+			return alias
+		}
+		if name,ok := identPart(query,a); ok && !(a.kind=='w' && notAlias[strings.ToLower(name)]) { return name }
+		return ""
+	}
+	
+	inFrom := []bool{false}
+	tablePos := false
+	for i := 0; i<len(toks); i++ {
+		t := toks[i]
+		top := len(inFrom)-1
+		switch {
+		case t.kind=='(':
+			inFrom = append(inFrom,false)
+			tablePos = false
+			continue
+		case t.kind==')':
+			if top>0 { inFrom = inFrom[:top] }
+			tablePos = false
+			continue
+		case isWord(query,t,"from") || isWord(query,t,"join"):
+			inFrom[top] = true
+			tablePos = true
+			continue
+		case t.kind==',':
+			tablePos = inFrom[top]
+			continue
+		case t.kind=='w' && fromEnd[strings.ToLower(query[t.start:t.end])]:
+			inFrom[top] = false
+			tablePos = false
+			continue
+		}
+		if !tablePos { continue }
+		tablePos = false
+		parts,next := dottedName(query,toks,i)
+		if len(parts)==0 { continue }
+		alias := aliasAt(next)
+		if alias=="" {
+			names[strings.ToLower(parts[len(parts)-1])]++
+		} else {
+			names[strings.ToLower(alias)]++
+		}
+		if len(parts)<2 { continue }
+		
+		var gen string
+		if isInfoSchema(parts) {
+			gen = fmt.Sprintf("information_schema_%d",len(mdb.Calls)+1)
+			src,ok := mdb.reuse[gen]
+			if !ok {
+				src,err = infoSchema(mdb,parts[1])
+				if err!=nil { return "",err }
+			}
+			if mdb.Calls==nil { mdb.Calls = make(map[string]api.RowSource) }
+			mdb.Calls[gen] = src
+		} else if namespaced {
+			if mdb.Paths==nil { mdb.Paths = make(map[string][]string) }
+			gen = fmt.Sprintf("qualified_%d",len(mdb.Paths)+1)
+			mdb.Paths[gen] = parts
+		} else {
+			i = next-1
+			continue
+		}
+		
+		if alias=="" {
+			pending = append(pending,unaliased{parts,gen,t.start,toks[next-1].end})
+		} else {
+			exposed[strings.Join(parts,".")] = alias
+			edits = append(edits,textEdit{t.start,toks[next-1].end,gen})
+		}
+		tables[i] = next
+		i = next-1
+	}
+	for _,u := range pending {
+		alias,text := u.parts[len(u.parts)-1],u.gen
+		if names[strings.ToLower(alias)]>1 {
+			alias = u.gen
+		} else {
+			text += " AS "+quoteIdent(alias)
+		}
+		exposed[strings.Join(u.parts,".")] = alias
+		edits = append(edits,textEdit{u.start,u.end,text})
+	}
+	if len(edits)==0 { return query,nil }
+	
+	for i := 0; i<len(toks); i++ {
+		if end,ok := tables[i]; ok {
+			i = end-1
+			continue
+		}
+		parts,next := dottedName(query,toks,i)
+		if len(parts)<3 {
+			if next>i { i = next-1 }
+			continue
+		}
+		alias,ok := exposed[strings.Join(parts[:len(parts)-1],".")]
+		if ok {
+			edits = append(edits,textEdit{toks[i].start,toks[next-1].end,quoteIdent(alias)+"."+quoteIdent(parts[len(parts)-1])})
+		}
+		i = next-1
+	}
+	
+	sort.Slice(edits,func(i,j int) bool { return edits[i].start<edits[j].start })
+	b := new(bytes.Buffer)
+	last := 0
+	for _,e := range edits {
+		b.WriteString(query[last:e.start])
+		b.WriteString(e.text)
+		last = e.end
+	}
+	b.WriteString(query[last:])
+	return b.String(),nil
+}
@@ -0,0 +1,78 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package query
+
+import "github.com/mad-day/datajoin/api"
+import "reflect"
+import "testing"
+
+func TestRewriteQualified(t *testing.T) {
+	namespaced := &api.Namespaces{Spaces:map[string]api.DataSource{"crm":api.DataSourceImpl{},"billing":api.DataSourceImpl{}}}
+	tests := []struct{
+		ds    api.DataSource
+		query string
+		want  string
+		paths map[string][]string
+	}{
+		{namespaced,
+			"SELECT * FROM users WHERE x = 'crm.a.b'",
+			"SELECT * FROM users WHERE x = 'crm.a.b'",
+			nil},
+		{namespaced,
+			"SELECT * FROM crm.users",
+			"SELECT * FROM qualified_1 AS `users`",
+			map[string][]string{"qualified_1":{"crm","users"}}},
+		{namespaced,
+			"SELECT crm.users.id FROM crm.users u WHERE crm.users.name = 'x'",
+			"SELECT `u`.`id` FROM qualified_1 u WHERE `u`.`name` = 'x'",
+			map[string][]string{"qualified_1":{"crm","users"}}},
+		{namespaced,
+			"SELECT * FROM `crm`.`my users` AS m, billing.invoices",
+			"SELECT * FROM qualified_1 AS m, qualified_2 AS `invoices`",
+			map[string][]string{"qualified_1":{"crm","my users"},"qualified_2":{"billing","invoices"}}},
+
+		/* Tables exposed by the same name keep their generated names. */
+		{namespaced,
+			"SELECT crm.users.id FROM crm.users JOIN billing.users ON crm.users.id = billing.users.id",
+			"SELECT `qualified_1`.`id` FROM qualified_1 JOIN qualified_2 ON `qualified_1`.`id` = `qualified_2`.`id`",
+			map[string][]string{"qualified_1":{"crm","users"},"qualified_2":{"billing","users"}}},
+
+		/* Strings, quoted texts and comments are left alone. */
+		{namespaced,
+			"SELECT 'FROM crm.x' /* FROM crm.y */ FROM crm.users -- JOIN billing.z\nWHERE name = \"crm.users.id\"",
+			"SELECT 'FROM crm.x' /* FROM crm.y */ FROM qualified_1 AS `users` -- JOIN billing.z\nWHERE name = \"crm.users.id\"",
+			map[string][]string{"qualified_1":{"crm","users"}}},
+		{namespaced,
+			"SELECT * FROM (SELECT id FROM crm.users) AS u WHERE id IN (SELECT id FROM billing.users)",
+			"SELECT * FROM (SELECT id FROM qualified_1) AS u WHERE id IN (SELECT id FROM qualified_2)",
+			map[string][]string{"qualified_1":{"crm","users"},"qualified_2":{"billing","users"}}},
+
+		/* Without namespaces, the names are left to the DataSource. */
+		{api.DataSourceImpl{},
+			"SELECT * FROM crm.users",
+			"SELECT * FROM crm.users",
+			nil},
+	}
+	for _,tt := range tests {
+		mdb := &mdbObj{DS:tt.ds}
+		got,err := rewriteQualified(tt.query,mdb)
+		if err!=nil { t.Errorf("rewriteQualified(%q): %v",tt.query,err); continue }
+		if got!=tt.want { t.Errorf("rewriteQualified(%q)\n got %q\nwant %q",tt.query,got,tt.want) }
+		if !reflect.DeepEqual(mdb.Paths,tt.paths) { t.Errorf("rewriteQualified(%q): paths %v, want %v",tt.query,mdb.Paths,tt.paths) }
+	}
+}
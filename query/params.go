@@ -0,0 +1,174 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package query
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "github.com/spf13/cast"
+import "bytes"
+import "context"
+import "fmt"
+import "strconv"
+
+type paramsKey struct{}
+
+/*
+Returns a copy of the context, that carries the values of the bind parameters.
+*/
+func WithParams(ctx *sql.Context,args []interface{}) *sql.Context {
+	nctx := new(sql.Context)
+	*nctx = *ctx
+	nctx.Context = context.WithValue(nctx.Context,paramsKey{},args)
+	return nctx
+}
+
+/*
+A bind parameter. Its value is taken from the context, see WithParams(), and converted
+to Typ, unless the type is unknown (sql.JSON).
+
+It is column-free, so an equality between a column and a parameter is a dominated
+specifier, that is resolved by the RowSource.
+*/
+type Param struct{
+	N   int /* 1-based */
+	Typ sql.Type
+}
+var _ sql.Expression = (*Param)(nil)
+func (p *Param) Resolved() bool { return true }
+func (p *Param) String() string { return fmt.Sprintf("$%d",p.N) }
+func (p *Param) Type() sql.Type { return p.Typ }
+func (p *Param) IsNullable() bool { return true }
+func (p *Param) Eval(ctx *sql.Context, row sql.Row) (interface{}, error) {
+	var args []interface{}
+	if ctx!=nil && ctx.Context!=nil {
+		args,_ = ctx.Value(paramsKey{}).([]interface{})
+	}
+	if p.N>len(args) { return nil,fmt.Errorf("missing value for parameter %v",p) }
+	v := args[p.N-1]
+	if v==nil || p.Typ==sql.JSON { return v,nil }
+	return p.Typ.Convert(v)
+}
+func (p *Param) TransformUp(st sql.TransformExprFunc) (sql.Expression, error) { return st(p) }
+func (p *Param) Children() []sql.Expression { return nil }
+
+func NewParam(args ...sql.Expression) (sql.Expression, error) {
+	if len(args)!=1 { return nil,sql.ErrInvalidArgumentNumber.New(1, len(args)) }
+	lit,ok := args[0].(*expression.Literal)
+	if !ok { return nil,fmt.Errorf("expected integer literal, got %v",args[0]) }
+	n,err := cast.ToIntE(lit.Value())
+	if err!=nil { return nil,err }
+	if n<1 { return nil,fmt.Errorf("invalid parameter number %d",n) }
+	return &Param{n,sql.JSON},nil
+}
+
+/*
+Returns the number of parameters, the tree refers to.
+*/
+func NumParams(tree sql.Node) (n int) {
+	count := func(e sql.Expression) (sql.Expression, error) {
+		if p,ok := e.(*Param); ok && p.N>n { n = p.N }
+		return e,nil
+	}
+	_,_ = tree.TransformExpressionsUp(count)
+	_,_ = tree.TransformUp(runOnEachSubqueryExpr(count))
+	_,_ = tree.TransformUp(runOnEachSubquery(func(node sql.Node) (sql.Node, error) {
+		if mj,ok := node.(*MultiJoin); ok {
+			for _,f := range mj.Filters { _,_ = f.TransformUp(count) }
+		}
+		return node,nil
+	}))
+	return
+}
+
+/*
+Rewrites the placeholders ? and $n into calls of param(n).
+The ?-placeholders are numbered from left to right.
+Also returns the number of distinct placeholders.
+*/
+func rewriteParams(query string) (string,int,error) {
+	toks,err := lexSQL(query)
+	if err!=nil { return "",0,err }
+	b := new(bytes.Buffer)
+	last := 0
+	n := 0
+	seen := make(map[int]bool)
+	for _,t := range toks {
+		text := query[t.start:t.end]
+		var num int
+		switch {
+		case t.kind=='o' && text=="?":
+			n++
+			num = n
+		case t.kind=='w' && len(text)>1 && text[0]=='$':
+			num,err = strconv.Atoi(text[1:])
+			if err!=nil { continue }
+		default:
+			continue
+		}
+		seen[num] = true
+		b.WriteString(query[last:t.start])
+		fmt.Fprintf(b,"param(%d)",num)
+		last = t.end
+	}
+	b.WriteString(query[last:])
+	return b.String(),len(seen),nil
+}
+
+/*
+Rejects references to parameters beyond the number of placeholders of the query,
+such as $3 in a query with two placeholders, or an explicit call of param(n).
+*/
+func checkParams(tree sql.Node,placeholders int) error {
+	if n := NumParams(tree); n>placeholders {
+		return fmt.Errorf("parameter $%d used, but the query has %d placeholders",n,placeholders)
+	}
+	return nil
+}
+
+/*
+Assigns the type of the other operand of an equality to the parameters, so that
+the join builds properly typed specifiers.
+*/
+func typeParams(expr sql.Expression) (sql.Expression, error) {
+	typed := func(e sql.Expression,t sql.Type) sql.Expression {
+		if p,ok := e.(*Param); ok { return &Param{p.N,t} }
+		return e
+	}
+	switch v := expr.(type) {
+	case *expression.Equals:
+		l := typed(v.Left(),v.Right().Type())
+		r := typed(v.Right(),v.Left().Type())
+		return expression.NewEquals(l,r),nil
+	case Equal:
+		var t sql.Type
+		for _,e := range v {
+			if _,ok := e.(*Param); !ok { t = e.Type(); break }
+		}
+		if t==nil { break }
+		ne := make(Equal,len(v))
+		for i,e := range v { ne[i] = typed(e,t) }
+		return ne,nil
+	case *expression.In:
+		tup,ok := v.Right().(expression.Tuple)
+		if !ok { break }
+		nt := make(expression.Tuple,len(tup))
+		for i,e := range tup { nt[i] = typed(e,v.Left().Type()) }
+		return expression.NewIn(v.Left(),nt),nil
+	}
+	return expr,nil
+}
@@ -0,0 +1,61 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package query
+
+import "testing"
+
+func TestRewriteParams(t *testing.T) {
+	tests := []struct{
+		query string
+		want  string
+		n     int
+		fails bool
+	}{
+		{"SELECT * FROM t",
+			"SELECT * FROM t",0,false},
+		{"SELECT * FROM t WHERE a = ? AND b IN (?,?)",
+			"SELECT * FROM t WHERE a = param(1) AND b IN (param(2),param(3))",3,false},
+		{"SELECT * FROM t WHERE a = $2 OR b = $1 OR c = $2",
+			"SELECT * FROM t WHERE a = param(2) OR b = param(1) OR c = param(2)",2,false},
+
+		/* Placeholders in strings, quoted names and comments are no placeholders. */
+		{"SELECT '?', \"$1\" FROM t WHERE a = ? -- b = ?\nAND c = ?",
+			"SELECT '?', \"$1\" FROM t WHERE a = param(1) -- b = ?\nAND c = param(2)",2,false},
+		{"/* $1 */ SELECT `$1`, 'it''s ?' FROM t WHERE x = $1 # $2",
+			"/* $1 */ SELECT `$1`, 'it''s ?' FROM t WHERE x = param(1) # $2",1,false},
+		{"SELECT 'a\\'?' FROM t WHERE x = ?",
+			"SELECT 'a\\'?' FROM t WHERE x = param(1)",1,false},
+
+		/* Names with a dollar sign are left untouched. */
+		{"SELECT $a, a$1 FROM t",
+			"SELECT $a, a$1 FROM t",0,false},
+
+		{"SELECT 'unterminated FROM t WHERE a = ?",
+			"",0,true},
+		{"SELECT * FROM t /* unterminated",
+			"",0,true},
+	}
+	for _,tt := range tests {
+		got,n,err := rewriteParams(tt.query)
+		if (err!=nil)!=tt.fails {
+			t.Errorf("rewriteParams(%q): error %v",tt.query,err)
+		} else if err==nil && (got!=tt.want || n!=tt.n) {
+			t.Errorf("rewriteParams(%q)\n got %q,%d\nwant %q,%d",tt.query,got,n,tt.want,tt.n)
+		}
+	}
+}
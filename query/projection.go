@@ -0,0 +1,105 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package query
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/plan"
+import "github.com/mad-day/datajoin/api"
+
+func eachField(expr sql.Expression,f func(gf *expression.GetField)) {
+	if gf,ok := expr.(*expression.GetField); ok { f(gf) }
+	for _,subex := range expr.Children() { eachField(subex,f) }
+}
+
+type columnUsage struct{
+	used map[string]map[string]bool
+	full map[string]bool
+}
+func (c *columnUsage) field(gf *expression.GetField) {
+	t := c.used[gf.Table()]
+	if t==nil {
+		t = make(map[string]bool)
+		c.used[gf.Table()] = t
+	}
+	t[gf.Name()] = true
+}
+func (c *columnUsage) expr(expr sql.Expression) (sql.Expression, error) {
+	eachField(expr,c.field)
+	return expr,nil
+}
+
+/*
+Marks every table, whose rows leave the query without passing a projection
+(or aggregation), as being fully used.
+*/
+func (c *columnUsage) walk(node sql.Node,consumed bool) {
+	switch v := node.(type) {
+	case *MultiJoin:
+		for _,t := range v.Tables {
+			a,ok := t.(*AdHocTable)
+			if !ok {
+				c.walk(t,false)
+				continue
+			}
+			/* The columns of a partialSource aren't the ones of the table. */
+			_,partial := a.ItsSrc.(*partialSource)
+			if partial || !consumed { c.full[a.Name()] = true }
+		}
+		for _,f := range v.Filters { eachField(f,c.field) }
+		return
+	case *plan.Project,*plan.GroupBy:
+		consumed = true
+	case *AggregatedTable:
+		c.full[v.ItsName] = true
+		return
+	case *plan.SubqueryAlias:
+		consumed = false
+		_,_ = v.Child.TransformExpressionsUp(c.expr)
+	}
+	for _,child := range node.Children() { c.walk(child,consumed) }
+}
+
+/*
+Computes the columns, that are referenced by the projections, the filters and
+the join conditions of the query. Returns the narrowed column list for every
+table, whose RowSource implements api.ProjectableSource and which is not fully used.
+*/
+func projectColumns(tree sql.Node,srcs map[string]api.RowSource) (proj map[string][]string) {
+	c := &columnUsage{make(map[string]map[string]bool),make(map[string]bool)}
+	_,_ = tree.TransformExpressionsUp(c.expr)
+	c.walk(tree,false)
+	
+	for name,src := range srcs {
+		if c.full[name] { continue }
+		if _,ok := src.(api.ProjectableSource); !ok { continue }
+		used := c.used[name]
+		names := src.Names()
+		cols := make([]string,0,len(used))
+		for _,n := range names {
+			if used[n] { cols = append(cols,n) }
+		}
+		
+		/* Keep one column, so that the rows are still being counted. */
+		if len(cols)==0 && len(names)!=0 { cols = append(cols,names[0]) }
+		if len(cols)==len(names) { continue }
+		if proj==nil { proj = make(map[string][]string) }
+		proj[name] = cols
+	}
+	return
+}
@@ -25,9 +25,11 @@ import "gopkg.in/src-d/go-mysql-server.v0/sql/analyzer"
 import "gopkg.in/src-d/go-mysql-server.v0/sql/plan"
 import "gopkg.in/src-d/go-mysql-server.v0/mem"
 import "github.com/mad-day/datajoin/api"
+import "github.com/mad-day/datajoin/aggregate"
 import "fmt"
 import "strings"
 import "reflect"
+import "sync"
 
 func runOnEachSubquery(f sql.TransformNodeFunc) (r sql.TransformNodeFunc) {
 	r = func(node sql.Node) (sql.Node, error) {
@@ -61,9 +63,22 @@ func indent(i int) sql.TransformExprFunc {
 	}
 }
 
+/* Takes the AdHocTables out of the *plan.ResolvedTable, they are wrapped in for the analyzer. */
+func unwrapTables (node sql.Node) (sql.Node, error) {
+	if rt,ok := node.(*plan.ResolvedTable); ok {
+		if t,ok := rt.Table.(*AdHocTable); ok { return t,nil }
+	}
+	return node,nil
+}
+
 func unAlias (node sql.Node) (sql.Node, error) {
 	switch v := node.(type) {
 	case *plan.TableAlias:
+		if t,ok := v.Child.(*AdHocTable); ok {
+			c := *t
+			c.Alias = v.Name()
+			return &c,nil
+		}
 		return v.Child,nil
 	}
 	return node,nil
@@ -94,6 +109,14 @@ func unifyJoins (node sql.Node) (sql.Node, error) {
 	case *plan.CrossJoin:
 		lmj,lok := v.Left.(*MultiJoin)
 		rmj,rok := v.Right.(*MultiJoin)
+		
+		/* Subqueries take part in the join as legs, that can't receive Lookup specs. */
+		if sa,ok := v.Left.(*plan.SubqueryAlias); ok && (rok || isSubquery(v.Right)) {
+			lmj,lok = &MultiJoin{Cookie:new(Cookie),Tables:[]sql.Node{sa}},true
+		}
+		if sa,ok := v.Right.(*plan.SubqueryAlias); ok && lok {
+			rmj,rok = &MultiJoin{Cookie:new(Cookie),Tables:[]sql.Node{sa}},true
+		}
 		if !(lok&&rok) { return node,nil }
 		mj := new(MultiJoin)
 		mj.Cookie = new(Cookie)
@@ -109,8 +132,11 @@ func unifyJoins (node sql.Node) (sql.Node, error) {
 		return mj,nil
 	default: return node,nil
 	}
-	
-	return node,nil
+}
+
+func isSubquery(node sql.Node) bool {
+	_,ok := node.(*plan.SubqueryAlias)
+	return ok
 }
 
 func pullOffFilters (node sql.Node) (sql.Node, error) {
@@ -158,24 +184,61 @@ func pushDownFilters (node sql.Node) (sql.Node, error) {
 }
 
 type mdbObj struct{
-	DB *mem.Database
 	DS api.DataSource
+	pl *planner
 	nn int
+	
+	/* Results of table-valued function calls, by their generated table name. */
+	Calls map[string]api.RowSource
+	reuse map[string]api.RowSource /* The Calls of an earlier pass over the same query. */
+	
+	/* Qualified table names, by their generated table name. */
+	Paths map[string][]string
+	
+	/* The RowSources, the DataSource returned, by (qualified) table name. */
+	Used map[string]api.RowSource
+	
+	/* The definitions of the views being used, by view name. */
+	Views map[string]string
+	viewAliases map[string]bool /* Names of the SubqueryAliases, that stem from views. */
+	viewStack   []string
+	
+	/* Per-Sampler source and column projection. */
+	Srcs map[string]api.RowSource
+	Proj map[string][]string
 }
 func (m *mdbObj) replaceAll(node sql.Node) (sql.Node, error) {
 	switch v := node.(type){
 	case *plan.UnresolvedTable:
-		tab := m.DS.GetSource(v.Name)
-		if tab==nil { return nil,fmt.Errorf("No such table %q",v.Name) }
+		name := v.Name()
+		tab,ok := m.Calls[name]
+		if path,isq := m.Paths[name]; isq {
+			name = strings.Join(path,".")
+			tab = api.Resolve(m.DS,path...)
+		} else if !ok {
+			if isView(m.DS,[]string{name}) { return m.expandView(name) }
+			tab = m.DS.GetSource(name)
+		}
+		if tab==nil { return nil,fmt.Errorf("No such table %q",name) }
+		if m.Used!=nil && !ok { m.Used[name] = tab }
 		m.nn++
 		nn := fmt.Sprintf("sampler_%d",m.nn)
 		
-		m.DB.AddTable(nn,NewAdHocTable(tab,nn))
-		return plan.NewTableAlias(v.Name,plan.NewUnresolvedTable(nn)),nil
+		if cols,ok := m.Proj[nn]; ok {
+			var err error
+			tab,err = tab.(api.ProjectableSource).Project(cols)
+			if err!=nil { return nil,err }
+		}
+		if m.Srcs!=nil { m.Srcs[nn] = tab }
+		return plan.NewTableAlias(v.Name(),plan.NewResolvedTable(NewAdHocTable(tab,nn))),nil
 	case *plan.TableAlias:
 		if ta,ok := v.Child.(*plan.TableAlias); ok {
 			return plan.NewTableAlias(v.Name(),ta.Child),nil
 		}
+		if sa,ok := v.Child.(*plan.SubqueryAlias); ok && m.viewAliases[sa.Name()] {
+			m.viewAliases[v.Name()] = true
+			return plan.NewSubqueryAlias(v.Name(),sa.Child),nil
+		}
 	}
 	return node,nil
 }
@@ -186,7 +249,7 @@ func findMultiJoin(expr sql.Node) (sql.Node, error) {
 	switch v := expr.(type) {
 	case *MultiJoin:
 		for _,c := range v.Tables {
-			if _,ok := c.(*AdHocTable) ; !ok { return nil,ebad_mj }
+			if _,ok := c.(Leg) ; !ok { return nil,ebad_mj }
 		}
 		return nil,efound_mj
 	}
@@ -202,38 +265,179 @@ func emplaceMultiJoin(expr sql.Node) (sql.Node, error) {
 
 type DataContext struct{
 	DS api.DataSource
+	
+	/* Maximum number of groups of a GROUP BY being held in memory. 0 means default. */
+	MaxGroups int
+	
+	/* If not nil, the plans of Parse and Plan are cached. */
+	Cache *PlanCache
+	
+	/*
+	If not nil, Parse returns the tree converted by Compile (such as join.MakeExecutable).
+	The converted tree is kept along with the cached plan.
+	*/
+	Compile func(sql.Node) (sql.Node,error)
+}
+func (dc DataContext) tree(plan *Plan) (sql.Node,error) {
+	if dc.Compile==nil { return plan.Tree,nil }
+	return plan.Executable(dc.Compile)
 }
 func (dc DataContext) Parse(query string) (sql.Node,error) {
-	return dc.ParseEx(query,nil)
+	plan,err := dc.Plan(query)
+	if err!=nil { return nil,err }
+	return dc.tree(plan)
 }
+
+/*
+Parses the query with additional functions. Unlike Parse, the functions are registered
+with a new analyzer on every call, see Engine for a long-lived alternative.
+*/
 func (dc DataContext) ParseEx(query string, costomFuncs sql.Functions) (sql.Node,error) {
-	db := mem.NewDatabase("public")
-	
-	mdb := &mdbObj{DB:db,DS:dc.DS}
-	
-	an := analyzer.NewDefault(sql.NewCatalog())
-	an.Catalog.AddDatabase(db)
+	plan,err := dc.parseAll(query,newPlanner(buildFunctions(costomFuncs),nil))
+	if err!=nil { return nil,err }
+	return dc.tree(plan)
+}
+
+/*
+Collects the functions available to a query: The defaults, the window functions,
+the given functions and the special functions of this package.
+*/
+func buildFunctions(costomFuncs sql.Functions) sql.Functions {
+	funcs := make(sql.Functions)
+	for k,v := range function.Defaults { funcs[k] = v }
+	for k,v := range aggregate.WindowFunctions { funcs[k] = v }
+	for k,v := range costomFuncs { funcs[k] = v }
+	funcs["equal"] = sql.FunctionN(NewEqual)
+	funcs["each"] = sql.FunctionN(NewEach)
+	funcs["anyof"] = sql.FunctionN(NewAny)
+	funcs["lowest"] = sql.FunctionN(NewLowest)
+	funcs["highest"] = sql.FunctionN(NewHighest)
+	funcs["param"] = sql.FunctionN(NewParam)
+	return funcs
+}
+
+/*
+The analyzer, with the functions registered in its catalog, and the table-valued functions.
+It is built once per set of functions, and shared by the queries planned with them.
+The tables of a query never enter the catalog, they are resolved by mdbObj.replaceAll.
+*/
+type planner struct{
+	funcs  sql.Functions
+	tables map[string]*TableFunction
+	an     *analyzer.Analyzer
+}
+func newPlanner(funcs sql.Functions,tables map[string]*TableFunction) *planner {
+	cat := sql.NewCatalog()
+	cat.AddDatabase(mem.NewDatabase("public"))
+	for k,v := range funcs { cat.RegisterFunction(k,v) }
+	an := analyzer.NewDefault(cat)
 	an.CurrentDatabase = "public"
-	for k,v := range function.Defaults {
-		an.Catalog.RegisterFunction(k,v)
+	dropRules(an,skippedRules)
+	tvfs := make(map[string]*TableFunction,len(tables))
+	for k,v := range tables { tvfs[k] = v }
+	return &planner{funcs,tvfs,an}
+}
+
+/*
+Rules of the analyzer, that aren't applied. The ones preparing the tables of the
+catalog for execution don't apply to AdHocTables, which are read by the join.
+eval_filter would evaluate the column-free filters while planning, before the
+parameters are bound.
+*/
+var skippedRules = map[string]bool{
+	"eval_filter":true,
+	"pushdown":true,
+	"track_process":true,
+	"parallelize":true,
+}
+
+func dropRules(an *analyzer.Analyzer,names map[string]bool) {
+	for _,b := range an.Batches {
+		rules := b.Rules[:0:0]
+		for _,r := range b.Rules {
+			if !names[r.Name] { rules = append(rules,r) }
+		}
+		b.Rules = rules
 	}
-	for k,v := range costomFuncs {
-		an.Catalog.RegisterFunction(k,v)
+}
+
+var defaultPlannerOnce sync.Once
+var defaultPlannerObj *planner
+
+/* The planner with the default functions, used by DataContext. */
+func defaultPlanner() *planner {
+	defaultPlannerOnce.Do(func() { defaultPlannerObj = newPlanner(buildFunctions(nil),nil) })
+	return defaultPlannerObj
+}
+
+func (dc DataContext) parseAll(query string, pl *planner) (*Plan,error) {
+	mdb := &mdbObj{Srcs:make(map[string]api.RowSource),Used:make(map[string]api.RowSource)}
+	tree,err := dc.parse(query,pl,mdb)
+	if err!=nil { return nil,err }
+	
+	/*
+	If some of the tables can be narrowed down to the columns being used,
+	plan the query again, so that the analyzer assigns the GetField indexes
+	according to the narrowed schemas. The table-valued functions aren't
+	called again, their results are reused.
+	*/
+	proj := projectColumns(tree,mdb.Srcs)
+	if len(proj)!=0 {
+		mdb = &mdbObj{Proj:proj,Used:make(map[string]api.RowSource),reuse:mdb.Calls}
+		tree,err = dc.parse(query,pl,mdb)
+		if err!=nil { return nil,err }
 	}
-	an.Catalog.RegisterFunction("equal",sql.FunctionN(NewEqual))
-	an.Catalog.RegisterFunction("each",sql.FunctionN(NewEach))
-	an.Catalog.RegisterFunction("anyof",sql.FunctionN(NewAny))
-	an.Catalog.RegisterFunction("lowest",sql.FunctionN(NewLowest))
-	an.Catalog.RegisterFunction("highest",sql.FunctionN(NewHighest))
+	return newPlan(tree,mdb),nil
+}
+func (dc DataContext) parse(query string, pl *planner, mdb *mdbObj) (sql.Node,error) {
+	mdb.DS = dc.DS
+	mdb.pl = pl
+	tree,placeholders,err := mdb.parseQuery(query)
+	if err!=nil { return nil,err }
+	return dc.plan(tree,mdb,placeholders)
+}
+
+/*
+Rewrites the query text, parses it and resolves its tables. The views, that the
+query refers to, are expanded the same way, see expandView(). Also returns the
+number of placeholders.
+*/
+func (m *mdbObj) parseQuery(query string) (sql.Node,int,error) {
+	query,err := rewriteShow(query,m.DS)
+	if err!=nil { return nil,0,err }
+	
+	query,err = rewriteTableFunctions(query,m.pl.tables,m)
+	if err!=nil { return nil,0,err }
+	
+	query,err = rewriteQualified(query,m)
+	if err!=nil { return nil,0,err }
+	
+	query,err = rewriteOver(query)
+	if err!=nil { return nil,0,err }
+	
+	query,placeholders,err := rewriteParams(query)
+	if err!=nil { return nil,0,err }
+	
+	tree,err := parse.Parse(sql.NewEmptyContext(),query)
+	if err!=nil { return nil,0,err }
 	
+	tree,err = tree.TransformUp(runOnEachSubquery(m.replaceAll))
+	if err!=nil { return nil,0,err }
+	return tree,placeholders,nil
+}
+
+/*
+Analyzes the parsed tree and applies the planning passes of this package.
+*/
+func (dc DataContext) plan(tree sql.Node, mdb *mdbObj, placeholders int) (sql.Node,error) {
 	ec := sql.NewEmptyContext()
-	tree,err := parse.Parse(ec,query)
+	tree,err := mdb.pl.an.Analyze(ec,tree)
 	if err!=nil { return nil,err }
 	
-	tree,err = tree.TransformUp(runOnEachSubquery(mdb.replaceAll))
+	tree,err = tree.TransformUp(runOnEachSubquery(unwrapTables))
 	if err!=nil { return nil,err }
 	
-	tree,err = an.Analyze(ec,tree)
+	tree,err = mdb.mergeViews(tree)
 	if err!=nil { return nil,err }
 	
 	tree,err = tree.TransformExpressionsUp(convertSpecialOne)
@@ -242,6 +446,18 @@ func (dc DataContext) ParseEx(query string, costomFuncs sql.Functions) (sql.Node
 	tree,err = tree.TransformUp(runOnEachSubqueryExpr(convertSpecialOne))
 	if err!=nil { return nil,err }
 	
+	tree,err = tree.TransformExpressionsUp(typeParams)
+	if err!=nil { return nil,err }
+	
+	tree,err = tree.TransformUp(runOnEachSubqueryExpr(typeParams))
+	if err!=nil { return nil,err }
+	
+	err = checkParams(tree,placeholders)
+	if err!=nil { return nil,err }
+	
+	tree,err = tree.TransformUp(runOnEachSubquery(planWindows))
+	if err!=nil { return nil,err }
+	
 	tree,err = tree.TransformUp(runOnEachSubquery(unAlias))
 	if err!=nil { return nil,err }
 	
@@ -263,6 +479,18 @@ func (dc DataContext) ParseEx(query string, costomFuncs sql.Functions) (sql.Node
 	tree,err = tree.TransformUp(runOnEachSubquery(pushDownFilters))
 	if err!=nil { return nil,err }
 	
+	tree,err = tree.TransformUp(runOnEachSubquery(streamClusters))
+	if err!=nil { return nil,err }
+	
+	tree,err = tree.TransformUp(runOnEachSubquery(pushDownAggregates))
+	if err!=nil { return nil,err }
+	
+	tree,err = tree.TransformUp(runOnEachSubquery(dc.spillGroups))
+	if err!=nil { return nil,err }
+	
+	tree,err = tree.TransformUp(runOnEachSubquery(pushDownLimits))
+	if err!=nil { return nil,err }
+	
 	tree,err = tree.TransformExpressionsUp(validateSpecial)
 	if err!=nil { return nil,err }
 	
@@ -275,6 +503,13 @@ func (dc DataContext) ParseEx(query string, costomFuncs sql.Functions) (sql.Node
 type AdHocTable struct{
 	ItsSrc  api.RowSource
 	ItsName string
+	Alias   string /* The name of the table in the query. */
+	
+	/*
+	Filters, that are passed to every Lookup as SpecExpr, besides the ones the
+	join pushes down. They may refer to columns, the RowSource doesn't return.
+	*/
+	Filters []sql.Expression
 }
 func NewAdHocTable(src api.RowSource,name string) (t *AdHocTable) {
 	t = new(AdHocTable)
@@ -315,17 +550,33 @@ func (t *AdHocTable) Schema() (s sql.Schema) {
 }
 func (t *AdHocTable) Name() string { return t.ItsName }
 func (t *AdHocTable) Resolved() bool { return true }
-func (t *AdHocTable) String() string { return fmt.Sprintf("Sampler %s",t.ItsName) }
+func (t *AdHocTable) String() string {
+	if len(t.Filters)==0 { return fmt.Sprintf("Sampler %s",t.ItsName) }
+	return fmt.Sprintf("Sampler %s %v",t.ItsName,expression.JoinAnd(t.Filters...))
+}
 func (t *AdHocTable) Children() []sql.Node { return nil }
 func (t *AdHocTable) RowIter(*sql.Context) (sql.RowIter, error) { return nil,fmt.Errorf("In 100 years we're dead!") }
+func (t *AdHocTable) Partitions(*sql.Context) (sql.PartitionIter, error) { return nil,fmt.Errorf("In 100 years we're dead!") }
+func (t *AdHocTable) PartitionRows(*sql.Context,sql.Partition) (sql.RowIter, error) { return nil,fmt.Errorf("In 100 years we're dead!") }
 func (t *AdHocTable) TransformUp(f sql.TransformNodeFunc) (sql.Node, error) { return f(t)}
 func (t *AdHocTable) TransformExpressionsUp(sql.TransformExprFunc) (sql.Node, error) { return t,nil }
 
+/*
+A leg of a MultiJoin. Either an *AdHocTable, whose RowSource receives the Lookup specs,
+or any other named node, such as a subquery, whose rows are read as they are.
+*/
+type Leg interface{
+	sql.Node
+	sql.Nameable
+}
+
 type Cookie struct{}
 type MultiJoin struct {
 	*Cookie
-	Tables  []sql.Node
+	Tables  []sql.Node /* Legs of the join. */
 	Filters []sql.Expression
+	Limit   int64 /* Maximum number of rows needed. 0 means unlimited. */
+	Order   []OrderField /* Required ordering of the first Limit rows. */
 }
 func (m *MultiJoin) Resolved() bool { return true }
 func (m *MultiJoin) String() string {
@@ -338,7 +589,14 @@ func (m *MultiJoin) String() string {
 	for i, expr := range m.Filters {
 		exprs[i] = "("+expr.String()+")"
 	}
-	_ = pr.WriteNode("MultiJoin %s", strings.Join(exprs, " AND "))
+	var order = make([]string, len(m.Order))
+	for i, o := range m.Order {
+		order[i] = o.String()
+	}
+	var suffix string
+	if len(m.Order)!=0 { suffix += " ORDER BY "+strings.Join(order, ", ") }
+	if m.Limit!=0 { suffix += fmt.Sprintf(" LIMIT %d", m.Limit) }
+	_ = pr.WriteNode("MultiJoin %s%s", strings.Join(exprs, " AND "), suffix)
 	_ = pr.WriteChildren(childs...)
 	return pr.String()
 }
@@ -353,8 +611,18 @@ func (m *MultiJoin) Schema() (s sql.Schema) {
 	return
 }
 
+/* Transforms the legs, that aren't AdHocTables (such as subqueries), and then the MultiJoin itself. */
 func (m *MultiJoin) TransformUp(f sql.TransformNodeFunc) (sql.Node, error) {
-	return f(m)
+	var tables []sql.Node
+	for i,t := range m.Tables {
+		if _,ok := t.(*AdHocTable); ok { continue }
+		nt,err := t.TransformUp(f)
+		if err!=nil { return nil,err }
+		if tables==nil { tables = append([]sql.Node(nil),m.Tables...) }
+		tables[i] = nt
+	}
+	if tables==nil { return f(m) }
+	return f(&MultiJoin{Cookie:m.Cookie,Tables:tables,Filters:m.Filters,Limit:m.Limit,Order:m.Order})
 }
 func (m *MultiJoin) TransformExpressionsUp(sql.TransformExprFunc) (sql.Node, error) {
 	return m,nil
@@ -0,0 +1,339 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package query
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/parse"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/plan"
+import "github.com/mad-day/datajoin/api"
+import "fmt"
+import "sort"
+import "sync"
+
+/* Maximum nesting depth of views. */
+const maxViewDepth = 16
+
+/*
+A DataSource with named views on top of another DataSource. A view is a SELECT
+statement, that is expanded into the queries, that refer to it.
+
+Views, that consist of a projection over filtered joins, are merged into the
+surrounding join, so that their tables get the same Lookup pushdown as the tables
+of the query itself. Other views (with GROUP BY, ORDER BY, LIMIT, DISTINCT, ...)
+are planned as subqueries.
+*/
+type Views struct{
+	api.DataSource
+
+	lock  sync.RWMutex
+	views map[string]string
+}
+var _ api.ViewSource = (*Views)(nil)
+var _ api.ListableNamespaces = (*Views)(nil)
+
+func NewViews(ds api.DataSource) *Views {
+	return &Views{DataSource:ds,views:make(map[string]string)}
+}
+
+func (v *Views) GetView(name string) string {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.views[name]
+}
+
+/*
+Defines a view. If replace is false, an existing view or table of the same name
+is an error. The statement is checked for syntax errors only; the tables and
+functions are resolved, when the view is used.
+*/
+func (v *Views) CreateView(name,query string,replace bool) error {
+	if name=="" { return fmt.Errorf("missing view name") }
+	toks,err := lexSQL(query)
+	if err!=nil { return err }
+	if len(toks)==0 || !isWord(query,toks[0],"select") { return fmt.Errorf("view %q: expected a SELECT statement",name) }
+	q,err := rewriteOver(query)
+	if err!=nil { return fmt.Errorf("view %q: %v",name,err) }
+	_,err = parse.Parse(sql.NewEmptyContext(),q)
+	if err!=nil { return fmt.Errorf("view %q: %v",name,err) }
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if !replace {
+		if _,ok := v.views[name]; ok { return fmt.Errorf("view %q already exists",name) }
+		if v.DataSource.GetSource(name)!=nil { return fmt.Errorf("table %q already exists",name) }
+	}
+	v.views[name] = query
+	return nil
+}
+
+/* Removes a view. Returns false, if there is no such view. */
+func (v *Views) DropView(name string) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	_,ok := v.views[name]
+	delete(v.views,name)
+	return ok
+}
+
+/*
+Executes CREATE [OR REPLACE] VIEW name AS SELECT ... and DROP VIEW [IF EXISTS] name.
+Returns false, if the statement is none of these.
+*/
+func (v *Views) Exec(stmt string) (bool,error) {
+	toks,err := lexSQL(stmt)
+	if err!=nil { return false,nil }
+	for len(toks)!=0 && stmt[toks[len(toks)-1].start]==';' { toks = toks[:len(toks)-1] }
+	word := func(i int,w string) bool { return i<len(toks) && isWord(stmt,toks[i],w) }
+	switch {
+	case word(0,"create"):
+		i := 1
+		replace := word(1,"or") && word(2,"replace")
+		if replace { i = 3 }
+		if !word(i,"view") { return false,nil }
+		parts,next := dottedName(stmt,toks,i+1)
+		if len(parts)!=1 { return true,fmt.Errorf("expected a view name") }
+		if !word(next,"as") || next+1>=len(toks) { return true,fmt.Errorf("expected AS SELECT ...") }
+		return true,v.CreateView(parts[0],tokenText(stmt,toks[next+1:]),replace)
+	case word(0,"drop") && word(1,"view"):
+		i := 2
+		ifExists := word(2,"if") && word(3,"exists")
+		if ifExists { i = 4 }
+		parts,next := dottedName(stmt,toks,i)
+		if len(parts)!=1 || next!=len(toks) { return true,fmt.Errorf("expected a view name") }
+		if !v.DropView(parts[0]) && !ifExists { return true,fmt.Errorf("no such view %q",parts[0]) }
+		return true,nil
+	}
+	return false,nil
+}
+
+/* Lists the tables of the underlying DataSource, if it can, and the views. */
+func (v *Views) ListTables() []string {
+	var names []string
+	if ls,ok := v.DataSource.(api.ListableSource); ok { names = ls.ListTables() }
+	v.lock.RLock()
+	for name := range v.views { names = append(names,name) }
+	v.lock.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+/* Forwards to the underlying DataSource, if it is an api.NamespacedSource. */
+func (v *Views) GetNamespace(name string) api.DataSource {
+	ns,ok := v.DataSource.(api.NamespacedSource)
+	if !ok { return nil }
+	return ns.GetNamespace(name)
+}
+
+/* Forwards to the underlying DataSource, if it is an api.ListableNamespaces. */
+func (v *Views) ListNamespaces() []string {
+	ln,ok := v.DataSource.(api.ListableNamespaces)
+	if !ok { return nil }
+	return ln.ListNamespaces()
+}
+
+/*
+Parses the view of m.DS the same way as a query (see parseQuery) and resolves its
+tables. The result is a SubqueryAlias named after the view, which mergeViews() may
+dissolve later on. Fails, if the view refers to itself, directly or through other
+views, or if the views are nested too deeply.
+*/
+func (m *mdbObj) expandView(name string) (sql.Node,error) {
+	vs,ok := m.DS.(api.ViewSource)
+	if !ok { return nil,fmt.Errorf("No such view %q",name) }
+	text := vs.GetView(name)
+	if text=="" { return nil,fmt.Errorf("No such view %q",name) }
+	for _,n := range m.viewStack {
+		if n==name { return nil,fmt.Errorf("view %q refers to itself",name) }
+	}
+	if len(m.viewStack)>=maxViewDepth { return nil,fmt.Errorf("view %q: views nested too deeply",name) }
+	m.viewStack = append(m.viewStack,name)
+	defer func() { m.viewStack = m.viewStack[:len(m.viewStack)-1] }()
+
+	tree,placeholders,err := m.parseQuery(text)
+	if err!=nil { return nil,fmt.Errorf("view %q: %v",name,err) }
+	if placeholders!=0 { return nil,fmt.Errorf("view %q: views can't have placeholders",name) }
+
+	if m.Views==nil { m.Views = make(map[string]string) }
+	m.Views[name] = text
+	if m.viewAliases==nil { m.viewAliases = make(map[string]bool) }
+	m.viewAliases[name] = true
+	return plan.NewSubqueryAlias(name,tree),nil
+}
+
+/*
+The columns of a node, expressed in terms of the columns of its replacement.
+A nil layout means, that the columns haven't changed.
+*/
+type layout []sql.Expression
+
+func identityLayout(s sql.Schema,offset int) layout {
+	l := make(layout,len(s))
+	for i,c := range s { l[i] = expression.NewGetFieldWithTable(i+offset,c.Type,c.Source,c.Name,c.Nullable) }
+	return l
+}
+
+func (l layout) rewrite(e sql.Expression) (sql.Expression,error) {
+	if l==nil { return e,nil }
+	return e.TransformUp(func(e sql.Expression) (sql.Expression,error) {
+		gf,ok := e.(*expression.GetField)
+		if !ok || gf.Index()>=len(l) { return e,nil }
+		return l[gf.Index()],nil
+	})
+}
+func (l layout) rewriteAll(es []sql.Expression) ([]sql.Expression,error) {
+	if l==nil { return es,nil }
+	res := make([]sql.Expression,len(es))
+	for i,e := range es {
+		r,err := l.rewrite(e)
+		if err!=nil { return nil,err }
+		res[i] = r
+	}
+	return res,nil
+}
+
+/* Restores the columns of the replaced node using a projection. */
+func restoreLayout(n sql.Node,l layout,s sql.Schema) sql.Node {
+	if l==nil { return n }
+	exprs := make([]sql.Expression,len(l))
+	for i,e := range l { exprs[i] = expression.NewAlias(e,s[i].Name) }
+	return plan.NewProject(exprs,n)
+}
+
+/* Reports whether the node consists of filtered joins of tables only. */
+func isJoinTree(n sql.Node) bool {
+	switch v := n.(type) {
+	case *plan.Filter: return isJoinTree(v.Child)
+	case *plan.CrossJoin: return isJoinTree(v.Left) && isJoinTree(v.Right)
+	case *plan.InnerJoin: return isJoinTree(v.Left) && isJoinTree(v.Right)
+	case *plan.TableAlias: return isJoinTree(v.Child)
+	case *AdHocTable: return true
+	}
+	return false
+}
+
+/*
+Dissolves the views, that consist of a projection over filtered joins, into the
+surrounding query. The view is replaced by its joins, and the references to the
+columns of the view are replaced by the projected expressions.
+*/
+func (m *mdbObj) mergeViews(node sql.Node) (sql.Node,error) {
+	if len(m.viewAliases)==0 { return node,nil }
+	n,l,err := m.merge(node)
+	if err!=nil { return nil,err }
+	return restoreLayout(n,l,node.Schema()),nil
+}
+
+func (m *mdbObj) merge(node sql.Node) (sql.Node,layout,error) {
+	switch v := node.(type) {
+	case *plan.SubqueryAlias:
+		child,err := m.mergeViews(v.Child)
+		if err!=nil { return nil,nil,err }
+		if p,ok := child.(*plan.Project); ok && m.viewAliases[v.Name()] && isJoinTree(p.Child) {
+			l := make(layout,len(p.Projections))
+			for i,e := range p.Projections {
+				if a,ok := e.(*expression.Alias); ok { e = a.Child }
+				l[i] = e
+			}
+			return p.Child,l,nil
+		}
+		return plan.NewSubqueryAlias(v.Name(),child),nil,nil
+	case *plan.CrossJoin,*plan.InnerJoin:
+		var left,right sql.Node
+		var cond sql.Expression
+		if cj,ok := v.(*plan.CrossJoin); ok {
+			left,right = cj.Left,cj.Right
+		} else {
+			ij := v.(*plan.InnerJoin)
+			left,right,cond = ij.Left,ij.Right,ij.Cond
+		}
+		nl,ll,err := m.merge(left)
+		if err!=nil { return nil,nil,err }
+		nr,rl,err := m.merge(right)
+		if err!=nil { return nil,nil,err }
+		if ll==nil && rl==nil {
+			if cond==nil { return plan.NewCrossJoin(nl,nr),nil,nil }
+			return plan.NewInnerJoin(nl,nr,cond),nil,nil
+		}
+		if ll==nil { ll = identityLayout(left.Schema(),0) }
+		width := len(nl.Schema())
+		l := append(layout(nil),ll...)
+		if rl==nil {
+			l = append(l,identityLayout(right.Schema(),width)...)
+		} else {
+			for _,e := range rl {
+				s,err := e.TransformUp(indent(width))
+				if err!=nil { return nil,nil,err }
+				l = append(l,s)
+			}
+		}
+		if cond==nil { return plan.NewCrossJoin(nl,nr),l,nil }
+		cond,err = l.rewrite(cond)
+		if err!=nil { return nil,nil,err }
+		return plan.NewInnerJoin(nl,nr,cond),l,nil
+	case *plan.Filter:
+		c,l,err := m.merge(v.Child)
+		if err!=nil { return nil,nil,err }
+		e,err := l.rewrite(v.Expression)
+		if err!=nil { return nil,nil,err }
+		return plan.NewFilter(e,c),l,nil
+	case *plan.Sort:
+		c,l,err := m.merge(v.Child)
+		if err!=nil { return nil,nil,err }
+		fields := make([]plan.SortField,len(v.SortFields))
+		for i,sf := range v.SortFields {
+			sf.Column,err = l.rewrite(sf.Column)
+			if err!=nil { return nil,nil,err }
+			fields[i] = sf
+		}
+		return plan.NewSort(fields,c),l,nil
+	case *plan.Limit:
+		n := nodeSize(v,"Limit(%d)")
+		if n<0 { break }
+		c,l,err := m.merge(v.Child)
+		if err!=nil { return nil,nil,err }
+		return plan.NewLimit(n,c),l,nil
+	case *plan.Offset:
+		n := nodeSize(v,"Offset(%d)")
+		if n<0 { break }
+		c,l,err := m.merge(v.Child)
+		if err!=nil { return nil,nil,err }
+		return plan.NewOffset(n,c),l,nil
+	case *plan.Project:
+		c,l,err := m.merge(v.Child)
+		if err!=nil { return nil,nil,err }
+		exprs,err := l.rewriteAll(v.Projections)
+		if err!=nil { return nil,nil,err }
+		return plan.NewProject(exprs,c),nil,nil
+	case *plan.GroupBy:
+		c,l,err := m.merge(v.Child)
+		if err!=nil { return nil,nil,err }
+		aggr,err := l.rewriteAll(v.Aggregate)
+		if err!=nil { return nil,nil,err }
+		grp,err := l.rewriteAll(v.Grouping)
+		if err!=nil { return nil,nil,err }
+		return plan.NewGroupBy(aggr,grp,c),nil,nil
+	case *plan.Distinct:
+		c,err := m.mergeViews(v.Child)
+		if err!=nil { return nil,nil,err }
+		return plan.NewDistinct(c),nil,nil
+	}
+
+	/* Other nodes keep their views as subqueries. */
+	return node,nil,nil
+}
@@ -0,0 +1,271 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package query
+
+import "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/expression"
+import "gopkg.in/src-d/go-mysql-server.v0/sql/plan"
+import "github.com/mad-day/datajoin/aggregate"
+import "bytes"
+import "fmt"
+import "strings"
+
+/*
+A token of a SQL text. Kind is 'w' for words, 's' for quoted strings and names,
+'(' , ')' and ',' for themselves and 'o' for everything else. Comments are skipped.
+*/
+type sqlToken struct{
+	kind  byte
+	start int
+	end   int
+}
+
+func isWordChar(c byte) bool {
+	return c=='_' || c=='$' || (c>='a' && c<='z') || (c>='A' && c<='Z') || (c>='0' && c<='9') || c>=0x80
+}
+
+func lexSQL(s string) (toks []sqlToken,err error) {
+	for i := 0; i<len(s); {
+		c := s[i]
+		switch {
+		case c==' ' || c=='\t' || c=='\n' || c=='\r':
+			i++
+		case c=='#' || (c=='-' && i+1<len(s) && s[i+1]=='-'):
+			/* Like the SQL parser, "--" starts a comment, even without a space after it. */
+			for i<len(s) && s[i]!='\n' { i++ }
+		case c=='/' && i+1<len(s) && s[i+1]=='*':
+			j := strings.Index(s[i+2:],"*/")
+			if j<0 { return nil,fmt.Errorf("unterminated comment at position %d",i) }
+			i += j+4
+		case c=='\'' || c=='"' || c=='`':
+			j := i+1
+			for ; j<len(s); j++ {
+				if s[j]=='\\' && c!='`' { j++; continue }
+				if s[j]!=c { continue }
+				if j+1<len(s) && s[j+1]==c { j++; continue }
+				break
+			}
+			if j>=len(s) { return nil,fmt.Errorf("unterminated quote at position %d",i) }
+			toks = append(toks,sqlToken{'s',i,j+1})
+			i = j+1
+		case isWordChar(c):
+			j := i
+			for j<len(s) && isWordChar(s[j]) { j++ }
+			toks = append(toks,sqlToken{'w',i,j})
+			i = j
+		case c=='(' || c==')' || c==',':
+			toks = append(toks,sqlToken{c,i,i+1})
+			i++
+		default:
+			toks = append(toks,sqlToken{'o',i,i+1})
+			i++
+		}
+	}
+	return
+}
+
+func isWord(s string,t sqlToken,w string) bool {
+	return t.kind=='w' && strings.EqualFold(s[t.start:t.end],w)
+}
+
+/* Finds the parenthesis matching toks[i]. */
+func matchParen(toks []sqlToken,i int) int {
+	depth := 0
+	step,open := 1,byte('(')
+	if toks[i].kind==')' { step,open = -1,')' }
+	for ; i>=0 && i<len(toks); i += step {
+		switch toks[i].kind {
+		case open: depth++
+		case '(',')':
+			depth--
+			if depth==0 { return i }
+		}
+	}
+	return -1
+}
+
+/*
+Splits the tokens at the given words, that appear outside of parentheses.
+Each part starts with the token after the word.
+*/
+func splitTopLevel(s string,toks []sqlToken,split func(t sqlToken) bool) (parts [][]sqlToken) {
+	depth := 0
+	last := 0
+	for i,t := range toks {
+		switch t.kind {
+		case '(': depth++
+		case ')': depth--
+		}
+		if depth==0 && split(t) {
+			parts = append(parts,toks[last:i])
+			last = i+1
+		}
+	}
+	return append(parts,toks[last:])
+}
+
+func tokenText(s string,toks []sqlToken) string {
+	if len(toks)==0 { return "" }
+	return s[toks[0].start:toks[len(toks)-1].end]
+}
+
+/*
+Translates the content of an OVER (...) clause into the arguments of window_over().
+*/
+func windowSpec(s string) (string,error) {
+	toks,err := lexSQL(s)
+	if err!=nil { return "",err }
+	b := new(bytes.Buffer)
+	depth := 0
+	clause := ""
+	from := 0
+	flush := func(to int) error {
+		body := toks[from:to]
+		switch clause {
+		case "":
+			if len(body)!=0 { return fmt.Errorf("unexpected %q in OVER clause",tokenText(s,body)) }
+		case "partition":
+			fmt.Fprintf(b,",partition_by(%s)",tokenText(s,body))
+		case "order":
+			for _,item := range splitTopLevel(s,body,func(t sqlToken) bool { return t.kind==',' }) {
+				if len(item)==0 { return fmt.Errorf("empty ORDER BY item in OVER clause") }
+				last := item[len(item)-1]
+				dir := ""
+				if isWord(s,last,"desc") { dir = ",'desc'" }
+				if isWord(s,last,"asc") || isWord(s,last,"desc") { item = item[:len(item)-1] }
+				fmt.Fprintf(b,",order_by(%s%s)",tokenText(s,item),dir)
+			}
+		case "rows","range":
+			bounds := []string{"","current row"}
+			if len(body)!=0 && isWord(s,body[0],"between") {
+				parts := splitTopLevel(s,body[1:],func(t sqlToken) bool { return isWord(s,t,"and") })
+				if len(parts)!=2 { return fmt.Errorf("invalid frame %q",tokenText(s,body)) }
+				bounds[0],bounds[1] = tokenText(s,parts[0]),tokenText(s,parts[1])
+			} else {
+				bounds[0] = tokenText(s,body)
+			}
+			fmt.Fprintf(b,",window_frame('%s','%s','%s')",clause,strings.Join(strings.Fields(bounds[0])," "),strings.Join(strings.Fields(bounds[1])," "))
+		}
+		return nil
+	}
+	for i := 0; i<len(toks); i++ {
+		t := toks[i]
+		switch t.kind {
+		case '(': depth++
+		case ')': depth--
+		}
+		if depth!=0 || t.kind!='w' { continue }
+		next := ""
+		switch {
+		case (isWord(s,t,"partition") || isWord(s,t,"order")) && i+1<len(toks) && isWord(s,toks[i+1],"by"):
+			next = strings.ToLower(s[t.start:t.end])
+		case isWord(s,t,"rows") || isWord(s,t,"range"):
+			next = strings.ToLower(s[t.start:t.end])
+		default:
+			continue
+		}
+		err = flush(i)
+		if err!=nil { return "",err }
+		clause = next
+		from = i+1
+		if clause!="rows" && clause!="range" { from++; i++ }
+	}
+	err = flush(len(toks))
+	if err!=nil { return "",err }
+	return b.String(),nil
+}
+
+/* Reports whether the tokens contain OVER followed by a parenthesis. */
+func hasOver(s string,toks []sqlToken) bool {
+	for i := 0; i+1<len(toks); i++ {
+		if isWord(s,toks[i],"over") && toks[i+1].kind=='(' { return true }
+	}
+	return false
+}
+
+/*
+Rewrites every f(...) OVER (...) within the SQL text into a call of window_over(),
+as the SQL parser has no support for window functions.
+*/
+func rewriteOver(query string) (string,error) {
+	toks,err := lexSQL(query)
+	
+	/* Leave the errors to the SQL parser. */
+	if err!=nil || !hasOver(query,toks) { return query,nil }
+	for {
+		toks,err := lexSQL(query)
+		if err!=nil { return "",err }
+		found := false
+		for i := 1; i+1<len(toks); i++ {
+			if !(isWord(query,toks[i],"over") && toks[i-1].kind==')' && toks[i+1].kind=='(') { continue }
+			open := matchParen(toks,i-1)
+			if open<1 || toks[open-1].kind!='w' { continue }
+			close := matchParen(toks,i+1)
+			if close<0 { return "",fmt.Errorf("unbalanced parentheses in OVER clause") }
+			spec,err := windowSpec(query[toks[i+1].end:toks[close].start])
+			if err!=nil { return "",err }
+			fn := toks[open-1].start
+			query = query[:fn]+"window_over("+query[fn:toks[i-1].end]+spec+")"+query[toks[close].end:]
+			found = true
+			break
+		}
+		if !found { return query,nil }
+	}
+}
+
+/* Reports whether one of the expressions contains a window function. */
+func hasWindow(exprs []sql.Expression) (found bool) {
+	for _,e := range exprs {
+		_,_ = e.TransformUp(func(e sql.Expression) (sql.Expression, error) {
+			if _,ok := e.(*aggregate.WindowOver); ok { found = true }
+			return e,nil
+		})
+	}
+	return
+}
+
+/*
+Moves the window functions of a projection into a Window node below it.
+Window functions over the groups of a GROUP BY aren't supported.
+*/
+func planWindows(node sql.Node) (sql.Node, error) {
+	if gb,ok := node.(*plan.GroupBy); ok {
+		if hasWindow(gb.Aggregate) || hasWindow(gb.Grouping) {
+			return nil,fmt.Errorf("window functions can't be combined with GROUP BY")
+		}
+		return node,nil
+	}
+	pr,ok := node.(*plan.Project)
+	if !ok { return node,nil }
+	base := len(pr.Child.Schema())
+	var windows []sql.Expression
+	extract := func(e sql.Expression) (sql.Expression, error) {
+		w,ok := e.(*aggregate.WindowOver)
+		if !ok { return e,nil }
+		windows = append(windows,w)
+		return expression.NewGetField(base+len(windows)-1,w.Type(),w.String(),true),nil
+	}
+	projs := make([]sql.Expression,len(pr.Projections))
+	for i,p := range pr.Projections {
+		var err error
+		projs[i],err = p.TransformUp(extract)
+		if err!=nil { return nil,err }
+	}
+	if len(windows)==0 { return node,nil }
+	return plan.NewProject(projs,aggregate.NewWindow(windows,pr.Child)),nil
+}
@@ -0,0 +1,68 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package query
+
+import "testing"
+
+func TestRewriteOver(t *testing.T) {
+	tests := []struct{
+		query string
+		want  string
+		fails bool
+	}{
+		/* Queries without OVER, even in comments or strings, are left untouched. */
+		{"SELECT a FROM t",
+			"SELECT a FROM t",false},
+		{"SELECT a /* sum(a) over (b) */ FROM t -- over (c)",
+			"SELECT a /* sum(a) over (b) */ FROM t -- over (c)",false},
+		{"SELECT 'sum(a) over (b)', `over` FROM t",
+			"SELECT 'sum(a) over (b)', `over` FROM t",false},
+		{"SELECT 'unterminated FROM t",
+			"SELECT 'unterminated FROM t",false},
+
+		{"SELECT sum(x) OVER (PARTITION BY a ORDER BY b DESC) FROM t",
+			"SELECT window_over(sum(x),partition_by(a),order_by(b,'desc')) FROM t",false},
+		{"SELECT a, sum(x) OVER (), count(*) over (partition by a, c) FROM t",
+			"SELECT a, window_over(sum(x)), window_over(count(*),partition_by(a, c)) FROM t",false},
+		{"SELECT sum(x) OVER (ORDER BY t ROWS BETWEEN 2 PRECEDING AND CURRENT ROW) FROM s",
+			"SELECT window_over(sum(x),order_by(t),window_frame('rows','2 PRECEDING','CURRENT ROW')) FROM s",false},
+		{"SELECT sum(x) OVER (ORDER BY t RANGE UNBOUNDED PRECEDING) FROM s",
+			"SELECT window_over(sum(x),order_by(t),window_frame('range','UNBOUNDED PRECEDING','current row')) FROM s",false},
+
+		/* Comments within the OVER clause are dropped, quoted names are kept. */
+		{"SELECT rank() OVER (/* by region */ PARTITION BY region -- the region\n ORDER BY sales) FROM t",
+			"SELECT window_over(rank(),partition_by(region),order_by(sales)) FROM t",false},
+		{"SELECT first(`x`) OVER (PARTITION BY `order` ORDER BY `by` ASC), 'a) over (b' FROM t",
+			"SELECT window_over(first(`x`),partition_by(`order`),order_by(`by`)), 'a) over (b' FROM t",false},
+		{"SELECT lag(x, 1) OVER (ORDER BY concat(a, ')'), b desc) FROM t",
+			"SELECT window_over(lag(x, 1),order_by(concat(a, ')')),order_by(b,'desc')) FROM t",false},
+
+		{"SELECT sum(x) OVER (PARTITION BY a FROM t",
+			"",true},
+		{"SELECT sum(x) OVER (a) FROM t",
+			"",true},
+	}
+	for _,tt := range tests {
+		got,err := rewriteOver(tt.query)
+		if (err!=nil)!=tt.fails {
+			t.Errorf("rewriteOver(%q): error %v",tt.query,err)
+		} else if err==nil && got!=tt.want {
+			t.Errorf("rewriteOver(%q)\n got %q\nwant %q",tt.query,got,tt.want)
+		}
+	}
+}
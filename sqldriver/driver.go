@@ -0,0 +1,204 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+/*
+A database/sql driver over DataSources.
+
+	sqldriver.Register("shop",ds)
+	db,err := sql.Open("datajoin","shop")
+	rows,err := db.Query("SELECT c.name, o.total FROM customers c, orders o WHERE c.id = o.customer AND c.id = ?",42)
+
+The driver is read-only. It doesn't support Exec or transactions.
+*/
+package sqldriver
+
+import gms "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "github.com/mad-day/datajoin"
+import "github.com/mad-day/datajoin/aggregate"
+import "github.com/mad-day/datajoin/api"
+import "github.com/mad-day/datajoin/join"
+import "github.com/mad-day/datajoin/query"
+import "database/sql"
+import "database/sql/driver"
+import "context"
+import "errors"
+import "fmt"
+import "io"
+import "math"
+import "reflect"
+import "strconv"
+import "sync"
+import "time"
+
+var ErrReadOnly = errors.New("datajoin: the driver is read-only")
+
+func init() {
+	sql.Register("datajoin",Driver{})
+}
+
+var (
+	sourcesLock sync.RWMutex
+	sources = make(map[string]query.DataContext)
+)
+
+/*
+Registers the DataSource under the given name, which serves as DSN for sql.Open("datajoin",name).
+The plans of the queries are cached per name.
+*/
+func Register(name string,ds api.DataSource) {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	sources[name] = query.DataContext{DS:ds,Cache:query.NewPlanCache(0)}
+}
+
+/* Removes the DataSource registered under the given name. */
+func Unregister(name string) {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	delete(sources,name)
+}
+
+type Driver struct{}
+func (Driver) Open(name string) (driver.Conn, error) {
+	sourcesLock.RLock()
+	dc,ok := sources[name]
+	sourcesLock.RUnlock()
+	if !ok { return nil,fmt.Errorf("datajoin: no DataSource registered as %q",name) }
+	return &conn{dc},nil
+}
+
+type conn struct{
+	dc query.DataContext
+}
+var _ driver.QueryerContext = (*conn)(nil)
+func (c *conn) Prepare(q string) (driver.Stmt, error) {
+	s,err := join.Prepare(c.dc,q)
+	if err!=nil { return nil,err }
+	return &stmt{s},nil
+}
+func (c *conn) Close() error { return nil }
+func (c *conn) Begin() (driver.Tx, error) { return nil,ErrReadOnly }
+func (c *conn) QueryContext(ctx context.Context, q string, args []driver.NamedValue) (driver.Rows, error) {
+	s,err := join.Prepare(c.dc,q)
+	if err!=nil { return nil,err }
+	return (&stmt{s}).QueryContext(ctx,args)
+}
+
+type stmt struct{
+	s *join.Stmt
+}
+var _ driver.StmtQueryContext = (*stmt)(nil)
+func (s *stmt) Close() error { return nil }
+func (s *stmt) NumInput() int { return s.s.Params }
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) { return nil,ErrReadOnly }
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	vals := make([]interface{},len(args))
+	for i,a := range args { vals[i] = a }
+	return s.query(context.Background(),vals)
+}
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	vals := make([]interface{},len(args))
+	for _,a := range args {
+		if a.Name!="" { return nil,fmt.Errorf("datajoin: named parameters are not supported") }
+		if a.Ordinal<1 || a.Ordinal>len(vals) { return nil,fmt.Errorf("datajoin: invalid parameter ordinal %d",a.Ordinal) }
+		vals[a.Ordinal-1] = a.Value
+	}
+	return s.query(ctx,vals)
+}
+func (s *stmt) query(ctx context.Context,vals []interface{}) (driver.Rows, error) {
+	r,err := datajoin.Exec(ctx,s.s,vals...)
+	if err!=nil { return nil,err }
+	return &rows{r},nil
+}
+
+type rows struct{
+	r *datajoin.Rows
+}
+var _ driver.RowsColumnTypeDatabaseTypeName = (*rows)(nil)
+var _ driver.RowsColumnTypeNullable = (*rows)(nil)
+var _ driver.RowsColumnTypeScanType = (*rows)(nil)
+func (r *rows) Columns() []string {
+	cols := r.r.Columns()
+	names := make([]string,len(cols))
+	for i,c := range cols { names[i] = c.Name }
+	return names
+}
+func (r *rows) Close() error { return r.r.Close() }
+func (r *rows) Next(dest []driver.Value) error {
+	if !r.r.Next() {
+		if err := r.r.Err(); err!=nil { return err }
+		return io.EOF
+	}
+	cols := r.r.Columns()
+	for i,v := range r.r.Values() {
+		dv,err := driverValue(cols[i].Shape,v)
+		if err!=nil { return err }
+		dest[i] = dv
+	}
+	return nil
+}
+func (r *rows) ColumnTypeDatabaseTypeName(index int) string { return r.r.Columns()[index].Type.String() }
+func (r *rows) ColumnTypeNullable(index int) (nullable, ok bool) { return r.r.Columns()[index].Nullable,true }
+func (r *rows) ColumnTypeScanType(index int) reflect.Type { return scanType(r.r.Columns()[index].Type) }
+
+var (
+	typeInt64 = reflect.TypeOf(int64(0))
+	typeUint64 = reflect.TypeOf(uint64(0))
+	typeFloat64 = reflect.TypeOf(float64(0))
+	typeBool = reflect.TypeOf(false)
+	typeString = reflect.TypeOf("")
+	typeBytes = reflect.TypeOf([]byte(nil))
+	typeTime = reflect.TypeOf(time.Time{})
+)
+
+func scanType(t gms.Type) reflect.Type {
+	switch {
+	case t==gms.Uint64: return typeUint64
+	case gms.IsInteger(t): return typeInt64
+	case gms.IsDecimal(t): return typeFloat64
+	case t==gms.Boolean: return typeBool
+	case t==gms.Text: return typeString
+	case t==gms.Timestamp || t==gms.Date: return typeTime
+	}
+	return typeBytes
+}
+
+/*
+Converts a value into one of the types allowed by database/sql.
+Unsigned integers beyond the range of int64 are returned as decimal strings.
+Objects and arrays are converted into JSON.
+*/
+func driverValue(t gms.Type,v interface{}) (driver.Value, error) {
+	switch x := v.(type) {
+	case nil,int64,float64,bool,[]byte,string,time.Time: return x,nil
+	case int: return int64(x),nil
+	case int8: return int64(x),nil
+	case int16: return int64(x),nil
+	case int32: return int64(x),nil
+	case uint8: return int64(x),nil
+	case uint16: return int64(x),nil
+	case uint32: return int64(x),nil
+	case uint: return unsignedValue(uint64(x)),nil
+	case uint64: return unsignedValue(x),nil
+	case float32: return float64(x),nil
+	}
+	return aggregate.MarshalJSON(t,v)
+}
+func unsignedValue(x uint64) driver.Value {
+	if x>math.MaxInt64 { return strconv.FormatUint(x,10) }
+	return int64(x)
+}
@@ -0,0 +1,129 @@
+/*
+   Copyright 2018 Simon Schmidt
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+
+package sqldriver
+
+import gms "gopkg.in/src-d/go-mysql-server.v0/sql"
+import "github.com/mad-day/datajoin/aggregate"
+import "github.com/mad-day/datajoin/api"
+import "github.com/mad-day/datajoin/api/memsrc"
+import "database/sql"
+import "database/sql/driver"
+import "math"
+import "reflect"
+import "testing"
+
+func testDB(t *testing.T) *sql.DB {
+	tInt,tFloat,tStr := reflect.TypeOf(int64(0)),reflect.TypeOf(float64(0)),reflect.TypeOf("")
+	customers := memsrc.NewTable([]string{"id","name"},[]reflect.Type{tInt,tStr})
+	orders := memsrc.NewTable([]string{"cid","item","total"},[]reflect.Type{tInt,tStr,tFloat})
+	for _,row := range [][]interface{}{{1,"ann"},{2,"bob"},{3,nil}} {
+		if err := customers.Insert(row...); err!=nil { t.Fatal(err) }
+	}
+	for _,row := range [][]interface{}{{1,"book",7.0},{1,"pen",5.5},{2,"cup",3.25}} {
+		if err := orders.Insert(row...); err!=nil { t.Fatal(err) }
+	}
+	Register("driver-test",api.DataSourceImpl{"customers":customers,"orders":orders})
+	db,err := sql.Open("datajoin","driver-test")
+	if err!=nil { t.Fatal(err) }
+	return db
+}
+
+func TestRoundTrip(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	defer Unregister("driver-test")
+	tests := []struct{
+		query string
+		args  []interface{}
+		cols  []string
+		rows  [][]interface{}
+	}{
+		{"SELECT id, name FROM customers ORDER BY id",nil,
+			[]string{"id","name"},
+			[][]interface{}{{int64(1),"ann"},{int64(2),"bob"},{int64(3),nil}}},
+		{"SELECT c.name, o.total FROM customers c JOIN orders o ON c.id = o.cid WHERE c.id = ? ORDER BY o.total",[]interface{}{1},
+			[]string{"name","total"},
+			[][]interface{}{{"ann",5.5},{"ann",7.0}}},
+		{"SELECT count(*) AS n FROM orders WHERE cid = $1 OR total > $2",[]interface{}{2,6},
+			[]string{"n"},
+			[][]interface{}{{int64(2)}}},
+		{"SELECT item FROM orders WHERE cid = ?",[]interface{}{42},
+			[]string{"item"},
+			nil},
+
+		/* Arrays are sent as JSON. */
+		{"SELECT cid, split(item, 'o') AS parts FROM orders WHERE cid = 1 ORDER BY item",nil,
+			[]string{"cid","parts"},
+			[][]interface{}{{int64(1),[]byte(`["b","","k"]`)},{int64(1),[]byte(`["pen"]`)}}},
+	}
+	for _,tt := range tests {
+		rows,err := db.Query(tt.query,tt.args...)
+		if err!=nil { t.Errorf("%s: %v",tt.query,err); continue }
+		cols,err := rows.Columns()
+		if err!=nil { t.Fatal(err) }
+		if !reflect.DeepEqual(cols,tt.cols) { t.Errorf("%s: columns %v, want %v",tt.query,cols,tt.cols) }
+		var got [][]interface{}
+		for rows.Next() {
+			row := make([]interface{},len(cols))
+			ptrs := make([]interface{},len(cols))
+			for i := range row { ptrs[i] = &row[i] }
+			if err := rows.Scan(ptrs...); err!=nil { t.Fatal(err) }
+			got = append(got,row)
+		}
+		if err := rows.Err(); err!=nil { t.Errorf("%s: %v",tt.query,err) }
+		rows.Close()
+		if !reflect.DeepEqual(got,tt.rows) { t.Errorf("%s:\n got %v\nwant %v",tt.query,got,tt.rows) }
+	}
+}
+
+func TestErrors(t *testing.T) {
+	db := testDB(t)
+	defer db.Close()
+	defer Unregister("driver-test")
+	if _,err := db.Exec("SELECT 1"); err==nil { t.Error("Exec succeeded") }
+	if _,err := db.Query("SELECT * FROM customers WHERE id = ?"); err==nil { t.Error("query with a missing parameter succeeded") }
+	if _,err := db.Query("SELECT * FROM nope"); err==nil { t.Error("query of an unknown table succeeded") }
+	other,err := sql.Open("datajoin","not-registered")
+	if err!=nil { t.Fatal(err) }
+	defer other.Close()
+	if err := other.Ping(); err==nil { t.Error("unregistered DataSource opened") }
+}
+
+func TestDriverValue(t *testing.T) {
+	list := aggregate.ListOf(gms.Int64)
+	tests := []struct{
+		typ  gms.Type
+		in   interface{}
+		want driver.Value
+	}{
+		{gms.Int64,nil,nil},
+		{gms.Int32,int32(-5),int64(-5)},
+		{gms.Uint32,uint8(200),int64(200)},
+		{gms.Uint64,uint(7),int64(7)},
+		{gms.Uint64,uint64(math.MaxInt64),int64(math.MaxInt64)},
+		{gms.Uint64,uint64(math.MaxUint64),"18446744073709551615"},
+		{gms.Float32,float32(0.5),float64(0.5)},
+		{gms.Text,"x",`x`},
+		{list,[]interface{}{int64(1),int64(2)},[]byte(`[1,2]`)},
+	}
+	for _,tt := range tests {
+		got,err := driverValue(tt.typ,tt.in)
+		if err!=nil { t.Errorf("driverValue(%v): %v",tt.in,err); continue }
+		if !reflect.DeepEqual(got,tt.want) { t.Errorf("driverValue(%#v) = %#v, want %#v",tt.in,got,tt.want) }
+	}
+}